@@ -2,6 +2,9 @@
 const STORAGE_KEY = 'eino_conversations_v1';
 const API_BASE = window.API_BASE || 'http://localhost:8080';
 const STREAM_ENABLED = window.ENABLE_STREAM !== false;
+const USER_ID = window.USER_ID || '';
+// agent mode streams from /agent/stream, which adds step / tool_call / tool_result events
+const AGENT_ENABLED = window.ENABLE_AGENT === true;
 
 function uid(){return Math.random().toString(36).slice(2,9)}
 function now(){return new Date().toLocaleString()}
@@ -21,6 +24,45 @@ function load(){
 
 function save(){localStorage.setItem(STORAGE_KEY, JSON.stringify(conversations))}
 
+function apiHeaders(extra){
+  const h = {'Content-Type':'application/json', ...(extra||{})}
+  if(USER_ID) h['X-User-ID'] = USER_ID
+  return h
+}
+
+// sync sidebar with server-side conversation metadata; local-only conversations are kept
+async function syncFromServer(){
+  try{
+    const res = await fetch(API_BASE + '/conversations', {headers: apiHeaders()})
+    if(!res.ok) return
+    const data = await res.json()
+    const list = Array.isArray(data.conversations) ? data.conversations : []
+    list.slice().reverse().forEach(sc=>{
+      const local = conversations.find(c=>c.conversationId===sc.id)
+      if(local){
+        if(sc.title) local.title = sc.title
+        return
+      }
+      conversations.unshift({id:uid(), title: sc.title || '新对话', created: Date.parse(sc.created_at) || Date.now(), messages:[], conversationId: sc.id})
+    })
+    if(!currentId && conversations.length) currentId = conversations[0].id
+    save(); renderSidebar(); renderMessages()
+    loadServerMessages(conversations.find(c=>c.id===currentId))
+  }catch(e){/* server unreachable: keep local list */}
+}
+
+// apply a server-generated title unless the user renamed the conversation
+function applyServerTitle(conv, title){
+  if(!title || conv.titleLocked) return
+  conv.title = title
+  save(); renderSidebar(); renderMessages()
+}
+
+function patchServerTitle(conv){
+  if(!conv.conversationId) return
+  fetch(API_BASE + '/conversations/' + encodeURIComponent(conv.conversationId), {method:'PATCH', headers: apiHeaders(), body: JSON.stringify({title: conv.title})}).catch(()=>{})
+}
+
 function createConversation(title){
   const c = {id:uid(), title: title||'新对话', created: Date.now(), messages:[], conversationId:null}
   conversations.unshift(c)
@@ -30,6 +72,10 @@ function createConversation(title){
 }
 
 function deleteConversation(id){
+  const conv = conversations.find(c=>c.id===id)
+  if(conv && conv.conversationId){
+    fetch(API_BASE + '/conversations/' + encodeURIComponent(conv.conversationId), {method:'DELETE', headers: apiHeaders()}).catch(()=>{})
+  }
   conversations = conversations.filter(c=>c.id!==id)
   if(currentId===id) currentId = conversations.length?conversations[0].id:null
   save(); renderSidebar(); renderMessages()
@@ -57,10 +103,57 @@ function renameConversation(id){
   const name = (newName||'').trim()
   if(name.length===0) return
   conv.title = name
+  conv.titleLocked = true
+  patchServerTitle(conv)
   save(); renderSidebar(); renderMessages()
 }
 
-window.selectConversation = function(id){ currentId=id; renderSidebar(); renderMessages() }
+// load stored history for conversations synced from the server (e.g. opened on a new device)
+async function loadServerMessages(conv){
+  if(!conv || !conv.conversationId || conv.messages.length>0 || conv._loading) return
+  conv._loading = true
+  try{
+    const out = []
+    let pendingTools = []
+    let cursor = ''
+    while(true){
+      const q = cursor ? ('?after=' + encodeURIComponent(cursor)) : ''
+      const res = await fetch(API_BASE + '/conversations/' + encodeURIComponent(conv.conversationId) + '/messages' + q, {headers: apiHeaders()})
+      if(!res.ok) break
+      const data = await res.json()
+      // tool calls and their results are folded into the assistant reply that follows them
+      ;(data.messages||[]).forEach(m=>{
+        if(m.role==='tool'){
+          const t = pendingTools.find(t=>t.id===m.tool_call_id)
+          if(t){ t.output = m.content; t.status = 'done' }
+          return
+        }
+        if(m.role!=='user' && m.role!=='assistant') return
+        if(m.role==='assistant' && Array.isArray(m.tool_calls) && m.tool_calls.length){
+          m.tool_calls.forEach(tc=>pendingTools.push({id:tc.id, name:tc.name, arguments:tc.arguments, status:'running'}))
+          if(!m.content) return
+        }
+        const msg = {role:m.role, content:m.content, time: m.created_at ? new Date(m.created_at).toLocaleString() : ''}
+        if(m.role==='assistant' && pendingTools.length){ msg.tools = pendingTools; pendingTools = [] }
+        if(m.role==='user') pendingTools = []
+        out.push(msg)
+      })
+      if(!data.next_cursor) break
+      cursor = data.next_cursor
+    }
+    if(out.length && conv.messages.length===0){
+      conv.messages = out
+      save()
+      if(conv.id===currentId) renderMessages()
+    }
+  }catch(e){/* ignore */}
+  finally{ conv._loading = false }
+}
+
+window.selectConversation = function(id){
+  currentId=id; renderSidebar(); renderMessages()
+  loadServerMessages(conversations.find(c=>c.id===id))
+}
 
 function renderMessages(){
   const conv = conversations.find(c=>c.id===currentId)
@@ -107,7 +200,12 @@ function renderMessages(){
       return
     }
     const contentHtml = renderContent(m.role, m.content)
-    d.innerHTML = `<div class="meta"><strong>${m.role==='user'?'你':'Eino'}</strong> <span class="time">${m.time||''}</span></div><div class="content markdown-content">${contentHtml}</div>`
+    // only the latest answer can be regenerated from here; older versions stay on the server as branches
+    const canRegen = m.role==='assistant' && idx===conv.messages.length-1 && conv.conversationId && !m._streaming
+    const actions = canRegen ? `<div class="msg-actions"><button class="regen-btn" title="重新生成回答">↻ 重新生成</button></div>` : ''
+    d.innerHTML = `<div class="meta"><strong>${m.role==='user'?'你':'Eino'}</strong> <span class="time">${m.time||''}</span>${m.step? ` <span class="step">第 ${m.step} 步</span>`:''}</div>${renderTools(m.tools)}<div class="content markdown-content">${contentHtml}</div>${actions}`
+    const regenBtn = d.querySelector('.regen-btn')
+    if(regenBtn) regenBtn.onclick = ()=>regenerateLast(conv)
     $messages.appendChild(d)
   })
   $messages.scrollTop = $messages.scrollHeight
@@ -141,6 +239,40 @@ function renderContent(role, content){
   return escapeHtml(content)
 }
 
+// tool calls made by the agent, shown as collapsible rows above the answer
+function renderTools(tools){
+  if(!Array.isArray(tools) || !tools.length) return ''
+  const rows = tools.map(t=>{
+    const status = t.status==='running' ? '运行中…' : (t.error ? '失败' : '完成') + (t.duration_ms!==undefined ? ` · ${t.duration_ms}ms` : '')
+    const output = t.output!==undefined ? `<div class="tool-label">结果${t.truncated?'（已截断）':''}</div><pre>${escapeHtml(t.output)}</pre>` : ''
+    return `<details class="tool-call${t.error?' failed':''}"><summary>🔧 ${escapeHtml(t.name)} <span class="tool-status">${status}</span></summary><div class="tool-label">参数</div><pre>${escapeHtml(t.arguments||'{}')}</pre>${output}</details>`
+  })
+  return `<div class="tool-calls">${rows.join('')}</div>`
+}
+
+async function regenerateLast(conv){
+  const last = conv.messages[conv.messages.length-1]
+  if(!last || last.role!=='assistant' || !conv.conversationId) return
+  const prev = {content:last.content, tools:last.tools, time:last.time}
+  last._typing = true; renderMessages()
+  $sendBtn.disabled = true
+  try{
+    const res = await fetch(API_BASE + '/conversations/' + encodeURIComponent(conv.conversationId) + '/regenerate', {method:'POST', headers: apiHeaders(), body:'{}'})
+    if(!res.ok) throw new Error('请求失败 '+res.status)
+    const data = await res.json()
+    last.content = data.answer || ''
+    delete last.tools
+    last.time = now()
+  }catch(err){
+    Object.assign(last, prev)
+    alert('重新生成出错：'+err.message)
+  }finally{
+    last._typing = false
+    $sendBtn.disabled = false
+    save(); renderMessages()
+  }
+}
+
 function canStream(){
   return STREAM_ENABLED && typeof ReadableStream !== 'undefined' && typeof TextDecoder !== 'undefined'
 }
@@ -176,7 +308,7 @@ async function sendCurrent(){
   try{
     const payload = {question: text}
     if(conv.conversationId) payload.conversation_id = conv.conversationId
-    const res = await fetch(API_BASE + '/ask', {method:'POST',headers:{'Content-Type':'application/json'}, body:JSON.stringify(payload)})
+    const res = await fetch(API_BASE + '/ask', {method:'POST',headers:apiHeaders(), body:JSON.stringify(payload)})
     if(!res.ok) throw new Error('请求失败 '+res.status)
     const data = await res.json()
     const reply = data.answer || data.reply || data.text || JSON.stringify(data)
@@ -189,6 +321,7 @@ async function sendCurrent(){
     const assistantMsg = {role:'assistant', content: reply, time: now()}
     conv.messages.push(assistantMsg)
     save(); renderMessages()
+    applyServerTitle(conv, data.title)
   }catch(err){
     const idx = conv.messages.findIndex(m=>m._typing)
     if(idx>=0) conv.messages.splice(idx,1)
@@ -237,15 +370,41 @@ async function sendCurrentStream(conv, text){
       }
       return
     }
+    if(event === 'step'){
+      assistantMsg.step = payload.step
+      renderMessages()
+      return
+    }
+    if(event === 'tool_call'){
+      assistantMsg.tools = assistantMsg.tools || []
+      assistantMsg.tools.push({id:payload.id, name:payload.name, arguments:payload.arguments, status:'running'})
+      // text before a tool call is the model thinking aloud; the final answer starts fresh
+      assistantMsg.content = ''
+      renderMessages()
+      return
+    }
+    if(event === 'tool_result'){
+      const t = (assistantMsg.tools||[]).find(t=>t.id===payload.id)
+      if(t){
+        Object.assign(t, {output:payload.output, truncated:!!payload.truncated, error:!!payload.error, duration_ms:payload.duration_ms, status:'done'})
+        renderMessages()
+      }
+      return
+    }
     if(event === 'done'){
       if(payload.conversation_id) conv.conversationId = payload.conversation_id
       if(payload.answer !== undefined){
         assistantMsg.content = payload.answer
       }
+      delete assistantMsg.step
       assistantMsg._streaming = false
       save(); renderMessages()
       return
     }
+    if(event === 'title'){
+      applyServerTitle(conv, payload.title)
+      return
+    }
     if(event === 'error'){
       throw new Error(payload.error || 'stream error')
     }
@@ -279,7 +438,7 @@ async function sendCurrentStream(conv, text){
   try{
     const payload = {question: text}
     if(conv.conversationId) payload.conversation_id = conv.conversationId
-    const res = await fetch(API_BASE + '/ask/stream', {method:'POST',headers:{'Content-Type':'application/json'}, body:JSON.stringify(payload)})
+    const res = await fetch(API_BASE + (AGENT_ENABLED ? '/agent/stream' : '/ask/stream'), {method:'POST',headers:apiHeaders(), body:JSON.stringify(payload)})
     if(!res.ok) throw new Error('请求失败 '+res.status)
     if(!res.body) throw new Error('stream not supported')
 
@@ -319,6 +478,7 @@ document.addEventListener('DOMContentLoaded', ()=>{
   console.log('Eino frontend: DOM bound', {newConvBtn: !!$newConvBtn, sendBtn: !!$sendBtn})
 
   load(); renderSidebar(); renderMessages();
+  syncFromServer()
   if($newConvBtn) $newConvBtn.addEventListener('click', ()=>createConversation('新对话'))
   if($sendBtn) $sendBtn.addEventListener('click', sendCurrent)
   if($clearBtn) $clearBtn.addEventListener('click', ()=>{
@@ -0,0 +1,334 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/JekYUlll/eino-mini/internal/llm"
+	"github.com/JekYUlll/eino-mini/internal/session"
+)
+
+// /agent 和 /ask 的流程相同（加锁 → AppendUser → 模型 → 落库），区别是模型可以多轮调用工具，
+// 整轮新增的消息（带 tool_calls 的 assistant、tool 结果、最终回复）一次性挂到 user 后面。
+
+type agentResp struct {
+	ConversationID string `json:"conversation_id"`
+	Answer         string `json:"answer"`
+	Steps          int    `json:"steps"`
+	Title          string `json:"title,omitempty"`
+}
+
+// maxSSEToolOutput 是 tool_result 事件里工具输出的最大字符数，只用于展示，完整结果仍然落库。
+const maxSSEToolOutput = 1000
+
+// toolCallEvent / toolResultEvent 是 /agent/stream 的进度事件，step 从 1 开始，
+// 同一步里的 tool_call 和 tool_result 用 id 对应。
+type toolCallEvent struct {
+	Step      int    `json:"step"`
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type toolResultEvent struct {
+	Step       int    `json:"step"`
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Output     string `json:"output"`
+	Truncated  bool   `json:"truncated,omitempty"`
+	Error      bool   `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+var errConversationBusy = errors.New("conversation is busy, try again")
+
+// acquireConversation 在 CHAT_LOCK_WAIT 内排队等会话锁，等不到返回 errConversationBusy；
+// 排队时位置变化回调 queued（可以为 nil）。租约在请求期间自动续期，Release 可以重复调用。
+// 返回的 request 带着租约的 fencing 号，之后的写操作要用它的 Context。
+func (s *Server) acquireConversation(r *http.Request, convID string, queued func(pos int)) (*http.Request, *session.Lease, error) {
+	wait := getDurationEnv("CHAT_LOCK_WAIT", 8*time.Second)
+	lease, ok, err := s.Store.AcquireLock(r.Context(), convID, wait, queued)
+	if err != nil {
+		return r, nil, err
+	}
+	if !ok {
+		return r, nil, errConversationBusy
+	}
+	return r.WithContext(session.WithFence(r.Context(), lease.Fence())), lease, nil
+}
+
+// lockConversation 同 acquireConversation；失败时已经写好错误响应，返回 ok=false。
+func (s *Server) lockConversation(w http.ResponseWriter, r *http.Request, convID string) (*http.Request, *session.Lease, bool) {
+	r, lease, err := s.acquireConversation(r, convID, nil)
+	if errors.Is(err, errConversationBusy) {
+		http.Error(w, err.Error(), http.StatusTooManyRequests) // 429
+		return r, nil, false
+	}
+	if err != nil {
+		http.Error(w, "store lock error: "+err.Error(), http.StatusBadGateway)
+		return r, nil, false
+	}
+	return r, lease, true
+}
+
+// insertReply 把本轮回复挂到 userID 后面，冲突时重试；租约已经丢了时不再写，返回 session.ErrLeaseLost。
+func (s *Server) insertReply(ctx context.Context, lease *session.Lease, convID, userID string, reply []session.Message) error {
+	const maxRetry = 3
+	var err error
+	for i := 0; i < maxRetry; i++ {
+		if err := lease.Err(); err != nil {
+			return err
+		}
+		err = s.Store.InsertReply(ctx, convID, userID, reply)
+		if !errors.Is(err, session.ErrConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *Server) agentAsk(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, "POST, OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	var req askReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Question == "" {
+		http.Error(w, "bad json or empty question", http.StatusBadRequest)
+		return
+	}
+	if s.Store == nil || s.LLM == nil {
+		http.Error(w, "server misconfig", http.StatusInternalServerError)
+		return
+	}
+	if s.Agent == nil {
+		http.Error(w, "agent disabled", http.StatusNotImplemented)
+		return
+	}
+
+	convID := req.ConversationID
+	if convID == "" {
+		convID = s.Store.NewConversationID()
+	}
+	conv, ok := s.askConversation(w, r, convID, req)
+	if !ok {
+		return
+	}
+
+	r, lease, ok := s.lockConversation(w, r, convID)
+	if !ok {
+		return
+	}
+	defer lease.Release()
+
+	history, userID, err := s.Store.AppendUser(r.Context(), convID, req.Question)
+	if err != nil {
+		http.Error(w, "store append user error: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	res, err := s.Agent.Filter(conv.Tools).WithOptions(s.modelOptions(conv)...).Run(r.Context(), history)
+	if err != nil {
+		http.Error(w, "agent error: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	// 和 /ask 一样用户优先：落库失败也返回答案
+	var title string
+	if err := s.insertReply(r.Context(), lease, convID, userID, res.Messages); err == nil {
+		titleCh := s.startTitle(convID, conv, req.Question, res.Answer)
+		lease.Release()
+		s.startSummary(convID, conv)
+		title = waitTitle(r.Context(), titleCh)
+	}
+
+	writeJSON(w, http.StatusOK, agentResp{
+		ConversationID: convID,
+		Answer:         res.Answer,
+		Steps:          res.Steps,
+		Title:          title,
+	})
+}
+
+func (s *Server) agentStream(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, "POST, OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	var req askReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Question == "" {
+		http.Error(w, "bad json or empty question", http.StatusBadRequest)
+		return
+	}
+	if s.Store == nil || s.LLM == nil {
+		http.Error(w, "server misconfig", http.StatusInternalServerError)
+		return
+	}
+	if s.Agent == nil {
+		http.Error(w, "agent disabled", http.StatusNotImplemented)
+		return
+	}
+
+	convID := req.ConversationID
+	if convID == "" {
+		convID = s.Store.NewConversationID()
+	}
+	conv, ok := s.askConversation(w, r, convID, req)
+	if !ok {
+		return
+	}
+
+	r, lease, ok := s.lockConversation(w, r, convID)
+	if !ok {
+		return
+	}
+	defer lease.Release()
+
+	history, userID, err := s.Store.AppendUser(r.Context(), convID, req.Question)
+	if err != nil {
+		http.Error(w, "store append user error: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	setSSEHeaders(w)
+
+	_ = writeSSE(w, "meta", map[string]string{"conversation_id": convID})
+	flusher.Flush()
+
+	send := func(event string, data any) {
+		_ = writeSSE(w, event, data)
+		flusher.Flush()
+	}
+	res, err := s.Agent.Filter(conv.Tools).WithOptions(s.modelOptions(conv)...).Stream(r.Context(), history, llm.AgentEvents{
+		OnStep: func(step int) {
+			send("step", map[string]int{"step": step})
+		},
+		OnDelta: func(delta string) {
+			send("delta", map[string]string{"delta": delta})
+		},
+		OnToolCall: func(step int, call session.ToolCall) {
+			send("tool_call", toolCallEvent{Step: step, ID: call.ID, Name: call.Name, Arguments: call.Arguments})
+		},
+		OnToolResult: func(step int, tr llm.ToolResult) {
+			out, truncated := llm.TruncateRunes(tr.Output, maxSSEToolOutput)
+			send("tool_result", toolResultEvent{
+				Step:       step,
+				ID:         tr.Call.ID,
+				Name:       tr.Call.Name,
+				Output:     out,
+				Truncated:  truncated,
+				Error:      tr.Failed,
+				DurationMS: tr.Duration.Milliseconds(),
+			})
+		},
+	})
+	if err != nil {
+		_ = writeSSE(w, "error", map[string]string{"error": "agent error: " + err.Error()})
+		flusher.Flush()
+		return
+	}
+
+	err = s.insertReply(r.Context(), lease, convID, userID, res.Messages)
+	if err != nil && err != session.ErrUserPruned {
+		_ = writeSSE(w, "error", map[string]string{"error": "store insert error: " + err.Error()})
+		flusher.Flush()
+		return
+	}
+
+	_ = writeSSE(w, "done", map[string]any{
+		"answer":          res.Answer,
+		"steps":           res.Steps,
+		"conversation_id": convID,
+	})
+	flusher.Flush()
+
+	if err == nil {
+		titleCh := s.startTitle(convID, conv, req.Question, res.Answer)
+		lease.Release()
+		s.startSummary(convID, conv)
+		if title := waitTitle(r.Context(), titleCh); title != "" {
+			_ = writeSSE(w, "title", map[string]string{
+				"title":           title,
+				"conversation_id": convID,
+			})
+			flusher.Flush()
+		}
+	}
+}
+
+// validateTools 检查会话的工具白名单：每一项必须是合法的通配，并且至少匹配一个已注册的工具，
+// 防止拼错名字后 agent 悄悄变成没有工具可用。
+func (s *Server) validateTools(allow []string) error {
+	if len(allow) == 0 {
+		return nil
+	}
+	if s.Agent == nil {
+		return errors.New("agent disabled")
+	}
+	for _, p := range allow {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("bad tool pattern %q", p)
+		}
+		matched := false
+		for _, info := range s.Agent.Tools() {
+			if llm.MatchTool([]string{p}, info.Name) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("no tool matches %q", p)
+		}
+	}
+	return nil
+}
+
+type toolInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// GET /agent/tools：列出 agent 可用的全部工具（内置 + MCP），供设置会话白名单。
+func (s *Server) agentTools(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, "GET, OPTIONS")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Agent == nil {
+		http.Error(w, "agent disabled", http.StatusNotImplemented)
+		return
+	}
+	out := make([]toolInfo, 0, len(s.Agent.Tools()))
+	for _, info := range s.Agent.Tools() {
+		out = append(out, toolInfo{Name: info.Name, Description: info.Desc})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"tools": out})
+}
@@ -0,0 +1,201 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/JekYUlll/eino-mini/internal/session"
+)
+
+// 分支：消息是一棵树（见 session/branch.go）。编辑历史 user 消息是在它旁边挂一个新 user 重新回答，
+// 原来的 user 连同之后的轮次留在树上成为分支；切换分支把当前激活的叶子换到目标分支最新的叶子，
+// 之后 /ask 等都沿新路径继续。分支 ID 就是分支第一条消息的 ID，树上任意一条消息都可以切过去。
+
+type editMessageReq struct {
+	Content string `json:"content"`
+}
+
+type editMessageResp struct {
+	ConversationID string `json:"conversation_id"`
+	MessageID      string `json:"message_id"` // 编辑后的新 user 消息
+	Answer         string `json:"answer"`
+	BranchID       string `json:"branch_id"` // 原消息及之后的轮次所在的分支（就是原消息的 ID）
+}
+
+type switchBranchResp struct {
+	ConversationID string            `json:"conversation_id"`
+	BranchID       string            `json:"branch_id,omitempty"` // 换下来的分支，已经在目标路径上时为空
+	Messages       []session.Message `json:"messages"`            // 切换后的当前路径
+}
+
+type branchesResp struct {
+	ConversationID string           `json:"conversation_id"`
+	Branches       []session.Branch `json:"branches"`
+}
+
+// editUser 编辑 user 消息，冲突时重试。
+func (s *Server) editUser(r *http.Request, convID, msgID, content string) ([]session.Message, string, *session.Branch, error) {
+	const maxRetry = 3
+	var (
+		history []session.Message
+		userID  string
+		b       *session.Branch
+		err     error
+	)
+	for i := 0; i < maxRetry; i++ {
+		history, userID, b, err = s.Store.EditUser(r.Context(), convID, msgID, content)
+		if !errors.Is(err, session.ErrConflict) {
+			break
+		}
+	}
+	return history, userID, b, err
+}
+
+// POST /conversations/{id}/messages/{msgID}/edit
+func (s *Server) editMessage(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, "POST, OPTIONS")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	var req editMessageReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Content) == "" {
+		http.Error(w, "bad json or empty content", http.StatusBadRequest)
+		return
+	}
+	if s.Store == nil || s.LLM == nil {
+		http.Error(w, "server misconfig", http.StatusInternalServerError)
+		return
+	}
+
+	convID := r.PathValue("id")
+	conv, err := s.getOwnedConversation(r, convID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	r, lease, ok := s.lockConversation(w, r, convID)
+	if !ok {
+		return
+	}
+	defer lease.Release()
+
+	history, userID, b, err := s.editUser(r, convID, r.PathValue("msgID"), req.Content)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	resp, err := s.LLM.Generate(r.Context(), history, s.modelOptions(conv)...)
+	if err != nil {
+		http.Error(w, "llm error: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	err = s.insertReply(r.Context(), lease, convID, userID, []session.Message{{Role: "assistant", Content: resp.Content}})
+	if err == nil {
+		lease.Release()
+		s.startSummary(convID, conv)
+	}
+
+	out := editMessageResp{ConversationID: convID, MessageID: userID, Answer: resp.Content}
+	if b != nil {
+		out.BranchID = b.ID
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// POST /conversations/{id}/branches/{branchID}/switch
+func (s *Server) switchBranch(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, "POST, OPTIONS")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Store == nil {
+		http.Error(w, "server misconfig", http.StatusInternalServerError)
+		return
+	}
+
+	convID := r.PathValue("id")
+	if _, err := s.getOwnedConversation(r, convID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	r, lease, ok := s.lockConversation(w, r, convID)
+	if !ok {
+		return
+	}
+	defer lease.Release()
+
+	const maxRetry = 3
+	var (
+		b   *session.Branch
+		err error
+	)
+	for i := 0; i < maxRetry; i++ {
+		b, err = s.Store.SwitchBranch(r.Context(), convID, r.PathValue("branchID"))
+		if !errors.Is(err, session.ErrConflict) {
+			break
+		}
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	msgs, err := s.Store.History(r.Context(), convID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	out := switchBranchResp{ConversationID: convID, Messages: msgs}
+	if b != nil {
+		out.BranchID = b.ID
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// GET /conversations/{id}/branches?at={msgID}：列出不在当前路径上的分支（旧版本），at 只看从某条消息分出去的。
+func (s *Server) conversationBranches(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, "GET, OPTIONS")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Store == nil {
+		http.Error(w, "server misconfig", http.StatusInternalServerError)
+		return
+	}
+
+	convID := r.PathValue("id")
+	if _, err := s.getOwnedConversation(r, convID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	list, err := s.Store.Branches(r.Context(), convID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	out := []session.Branch{}
+	at := r.URL.Query().Get("at")
+	for _, b := range list {
+		if at == "" || b.ParentID == at {
+			out = append(out, b)
+		}
+	}
+	writeJSON(w, http.StatusOK, branchesResp{ConversationID: convID, Branches: out})
+}
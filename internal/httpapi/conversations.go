@@ -0,0 +1,356 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/JekYUlll/eino-mini/internal/session"
+)
+
+// 目前没有鉴权，会话归属只看 X-User-ID 头（为空即匿名）。
+const ownerHeader = "X-User-ID"
+
+func ownerOf(r *http.Request) string {
+	return strings.TrimSpace(r.Header.Get(ownerHeader))
+}
+
+func setCORS(w http.ResponseWriter, methods string) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", methods)
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, "+ownerHeader+", "+idempotencyHeader)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeStoreError 把 store 错误映射成 HTTP 状态码。
+func writeStoreError(w http.ResponseWriter, err error) {
+	if errors.Is(err, session.ErrNotFound) || errors.Is(err, session.ErrMessageNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, session.ErrBranchNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, session.ErrLeaseLost) || errors.Is(err, session.ErrFenced) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, session.ErrExpired) {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	http.Error(w, "store error: "+err.Error(), http.StatusBadGateway)
+}
+
+// ensureConversation 创建（或读取）会话元数据；会话属于其他 owner 时按不存在处理。
+func (s *Server) ensureConversation(r *http.Request, convID string) (*session.Conversation, error) {
+	return s.ensureConversationAs(r, session.Conversation{ID: convID, Model: s.LLM.Model()})
+}
+
+// ensureConversationAs 同 ensureConversation，新建时按 tmpl 填元数据（owner 总是取请求方）。
+func (s *Server) ensureConversationAs(r *http.Request, tmpl session.Conversation) (*session.Conversation, error) {
+	tmpl.Owner = ownerOf(r)
+	c, err := s.Store.EnsureConversation(r.Context(), tmpl)
+	if err != nil {
+		return nil, err
+	}
+	if c.Owner != ownerOf(r) {
+		return nil, session.ErrNotFound
+	}
+	return c, nil
+}
+
+// getOwnedConversation 读取会话元数据并校验归属。
+func (s *Server) getOwnedConversation(r *http.Request, convID string) (*session.Conversation, error) {
+	c, err := s.Store.GetConversation(r.Context(), convID)
+	if err != nil {
+		return nil, err
+	}
+	if c.Owner != ownerOf(r) {
+		return nil, session.ErrNotFound
+	}
+	return c, nil
+}
+
+type listConversationsResp struct {
+	Conversations []session.Conversation `json:"conversations"`
+}
+
+// GET /conversations
+func (s *Server) conversations(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, "GET, OPTIONS")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Store == nil {
+		http.Error(w, "server misconfig", http.StatusInternalServerError)
+		return
+	}
+
+	list, err := s.Store.ListConversations(r.Context(), ownerOf(r))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if list == nil {
+		list = []session.Conversation{}
+	}
+	writeJSON(w, http.StatusOK, listConversationsResp{Conversations: list})
+}
+
+// GET / PATCH / DELETE /conversations/{id}
+func (s *Server) conversation(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, "GET, PATCH, DELETE, OPTIONS")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if s.Store == nil {
+		http.Error(w, "server misconfig", http.StatusInternalServerError)
+		return
+	}
+
+	convID := r.PathValue("id")
+	c, err := s.getOwnedConversation(r, convID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, c)
+
+	case http.MethodPatch:
+		var patch session.ConversationPatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		if patch.Title != nil {
+			t := strings.TrimSpace(*patch.Title)
+			patch.Title = &t
+		}
+		if patch.PrunePolicy != nil {
+			// 空串表示恢复默认策略
+			p := strings.ToLower(strings.TrimSpace(*patch.PrunePolicy))
+			if _, err := session.ParsePolicy(p); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			patch.PrunePolicy = &p
+		}
+		if patch.SystemPrompt != nil {
+			// 空串表示恢复默认 system prompt
+			p := strings.TrimSpace(*patch.SystemPrompt)
+			patch.SystemPrompt = &p
+		}
+		if patch.Tools != nil {
+			if err := s.validateTools(*patch.Tools); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		// 元数据修改不排队等会话锁，存储在一个原子操作里完成
+		c, err = s.Store.UpdateConversation(session.WithoutFence(r.Context()), convID, patch)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, c)
+
+	case http.MethodDelete:
+		if err := s.Store.DeleteConversation(r.Context(), convID); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "GET, PATCH or DELETE only", http.StatusMethodNotAllowed)
+	}
+}
+
+type messagesResp struct {
+	ConversationID string            `json:"conversation_id"`
+	Messages       []session.Message `json:"messages"`
+	// NextCursor 为空表示没有更多消息。
+	NextCursor string `json:"next_cursor,omitempty"`
+	// Pruned 是已被裁剪、无法再读回的消息数（MessageCount 减去仍保留的 user/assistant 消息数）。
+	Pruned int `json:"pruned"`
+}
+
+const (
+	defaultMessagesLimit = 50
+	maxMessagesLimit     = 200
+)
+
+// GET /conversations/{id}/messages?after={msgID}&limit={n}
+// 会话不存在返回 404，存在过但已过期返回 410；after 指向的消息已被裁剪同样返回 410。
+func (s *Server) conversationMessages(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, "GET, OPTIONS")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Store == nil {
+		http.Error(w, "server misconfig", http.StatusInternalServerError)
+		return
+	}
+
+	limit := defaultMessagesLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "bad limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxMessagesLimit)
+	}
+	after := r.URL.Query().Get("after")
+
+	convID := r.PathValue("id")
+	c, err := s.getOwnedConversation(r, convID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	msgs, err := s.Store.History(r.Context(), convID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	kept := 0
+	for _, m := range msgs {
+		if m.Role != "system" {
+			kept++
+		}
+	}
+
+	start := 0
+	if after != "" {
+		start = -1
+		for i, m := range msgs {
+			if m.ID == after {
+				start = i + 1
+				break
+			}
+		}
+		if start < 0 {
+			http.Error(w, "cursor message pruned or unknown", http.StatusGone)
+			return
+		}
+	}
+
+	end := min(start+limit, len(msgs))
+	resp := messagesResp{
+		ConversationID: convID,
+		Messages:       append([]session.Message{}, msgs[start:end]...),
+		Pruned:         max(c.MessageCount-kept, 0),
+	}
+	if end < len(msgs) && end > start {
+		resp.NextCursor = msgs[end-1].ID
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type messagePatch struct {
+	Pinned *bool `json:"pinned"`
+}
+
+// PATCH /conversations/{id}/messages/{msgID}
+// 目前只支持置顶：{"pinned": true}。置顶消息不会被 sliding / summarize 策略裁掉；
+// Redis / 内存后端里已经被裁掉的消息无法再置顶（404）。
+func (s *Server) conversationMessage(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, "PATCH, OPTIONS")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPatch {
+		http.Error(w, "PATCH only", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Store == nil {
+		http.Error(w, "server misconfig", http.StatusInternalServerError)
+		return
+	}
+
+	var patch messagePatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil || patch.Pinned == nil {
+		http.Error(w, "bad json or missing pinned", http.StatusBadRequest)
+		return
+	}
+
+	convID := r.PathValue("id")
+	if _, err := s.getOwnedConversation(r, convID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	m, err := s.Store.PinMessage(session.WithoutFence(r.Context()), convID, r.PathValue("msgID"), *patch.Pinned)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+// POST /conversations/{id}/fork?at={msgID}
+// 把当前路径截止到 at（含，不传则整条路径）的消息复制成一个新会话，返回新会话的元数据（201）。
+func (s *Server) forkConversation(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, "POST, OPTIONS")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Store == nil {
+		http.Error(w, "server misconfig", http.StatusInternalServerError)
+		return
+	}
+
+	convID := r.PathValue("id")
+	if _, err := s.getOwnedConversation(r, convID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	const maxRetry = 3
+	var (
+		c   *session.Conversation
+		err error
+	)
+	at := strings.TrimSpace(r.URL.Query().Get("at"))
+	for i := 0; i < maxRetry; i++ {
+		c, err = s.Store.Fork(r.Context(), convID, at, s.Store.NewConversationID())
+		if !errors.Is(err, session.ErrConflict) {
+			break
+		}
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, c)
+}
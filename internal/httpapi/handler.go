@@ -1,38 +1,63 @@
 package httpapi
 
 import (
-	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/JekYUlll/eino-mini/internal/llm"
+	"github.com/JekYUlll/eino-mini/internal/persona"
 	"github.com/JekYUlll/eino-mini/internal/session"
 )
 
 type Server struct {
-	LLM   *llm.Client
-	Store *session.Store
+	LLM   llm.Provider
+	Store session.Store
+	Agent *llm.Agent // 为 nil 时 /agent 返回 501
+	// Personas 是可选的人设，为 nil 时只能用默认或自定义的 system prompt
+	Personas *persona.Set
+
+	summarizing sync.Map // convID -> struct{}，正在后台生成摘要的会话
+	generations sync.Map // 幂等键 -> *generation，本进程里带 Idempotency-Key 正在生成的请求
 }
 
 type askReq struct {
 	ConversationID string `json:"conversation_id"`
 	Question       string `json:"question"`
+	Persona        string `json:"persona,omitempty"`       // 首轮选用的人设（见 GET /personas）
+	SystemPrompt   string `json:"system_prompt,omitempty"` // 首轮自定义 system prompt，优先于人设的
 }
 type askResp struct {
 	ConversationID string `json:"conversation_id"`
 	Answer         string `json:"answer"`
+	Title          string `json:"title,omitempty"` // 首轮自动生成的会话标题
 }
 
 func (s *Server) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/healthz", s.healthz)
 	mux.HandleFunc("/ask", s.ask)
 	mux.HandleFunc("/ask/stream", s.askStream)
+	mux.HandleFunc("/agent", s.agentAsk)
+	mux.HandleFunc("/agent/stream", s.agentStream)
+	mux.HandleFunc("/agent/tools", s.agentTools)
+	mux.HandleFunc("/personas", s.personas)
+	mux.HandleFunc("/conversations", s.conversations)
+	mux.HandleFunc("/conversations/{id}", s.conversation)
+	mux.HandleFunc("/conversations/{id}/messages", s.conversationMessages)
+	mux.HandleFunc("/conversations/{id}/messages/{msgID}", s.conversationMessage)
+	mux.HandleFunc("/conversations/{id}/messages/{msgID}/edit", s.editMessage)
+	mux.HandleFunc("/conversations/{id}/fork", s.forkConversation)
+	mux.HandleFunc("/conversations/{id}/regenerate", s.regenerate)
+	mux.HandleFunc("/conversations/{id}/regenerate/stream", s.regenerateStream)
+	mux.HandleFunc("/conversations/{id}/branches", s.conversationBranches)
+	mux.HandleFunc("/conversations/{id}/branches/{branchID}/switch", s.switchBranch)
+	mux.HandleFunc("/v1/chat/completions", s.chatCompletions)
+	mux.HandleFunc("/v1/models", s.models)
 }
 
 func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
@@ -41,10 +66,7 @@ func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) ask(w http.ResponseWriter, r *http.Request) {
-	// CORS headers
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	setCORS(w, "POST, OPTIONS")
 
 	if r.Method == http.MethodOptions {
 		w.WriteHeader(http.StatusOK)
@@ -71,81 +93,72 @@ func (s *Server) ask(w http.ResponseWriter, r *http.Request) {
 	if convID == "" {
 		convID = s.Store.NewConversationID()
 	}
-
-	wait := 8 * time.Second
-	if v := os.Getenv("CHAT_LOCK_WAIT"); v != "" {
-		if d, err := time.ParseDuration(v); err == nil && d > 0 {
-			wait = d
-		}
+	run, replay, ok := s.beginIdempotent(w, r, convID, req)
+	if !ok {
+		return
 	}
-	deadline := time.Now().Add(wait)
-
-	var token string
-	for {
-		t, ok, err := s.Store.AcquireLock(r.Context(), convID)
-		if err != nil {
-			http.Error(w, "redis lock error: "+err.Error(), http.StatusBadGateway)
-			return
-		}
-		if ok {
-			token = t
-			break
-		}
-
-		if time.Now().After(deadline) {
-			http.Error(w, "conversation is busy, try again", http.StatusTooManyRequests) // 429
-			return
-		}
-
-		time.Sleep(80 * time.Millisecond)
+	if replay != nil {
+		s.replayAsk(w, r, replay)
+		return
+	}
+	if run != nil {
+		defer run.close()
+		// 客户端断开也要生成完并落库，重试时才有结果可以回放
+		r = r.WithContext(run.ctx)
+	}
+	conv, ok := s.askConversation(w, r, convID, req)
+	if !ok {
+		return
 	}
 
-	defer func() { _ = s.Store.ReleaseLock(context.Background(), convID, token) }()
+	r, lease, ok := s.lockConversation(w, r, convID)
+	if !ok {
+		return
+	}
+	// 等标题时不需要占着会话锁，Release 可以提前调用
+	defer lease.Release()
 
 	// 2) Phase 1: 先把 user 原子写入 Redis，拿到快照和 userID
 	history, userID, err := s.Store.AppendUser(r.Context(), convID, req.Question)
 	if err != nil {
-		http.Error(w, "redis append user error: "+err.Error(), http.StatusBadGateway)
+		http.Error(w, "store append user error: "+err.Error(), http.StatusBadGateway)
 		return
 	}
+	run.started(userID)
 
 	// 3) 调 LLM（事务外）
-	answer, err := s.LLM.AskWithHistory(r.Context(), history)
+	resp, err := s.LLM.Generate(r.Context(), history, s.modelOptions(conv)...)
 	if err != nil {
+		run.fail("llm error: " + err.Error())
 		http.Error(w, "llm error: "+err.Error(), http.StatusBadGateway)
 		return
 	}
+	answer := resp.Content
 
 	// 4) Phase 2: 把 assistant 插回对应 user 后面（带重试）
-	const maxRetry = 3
-	for i := 0; i < maxRetry; i++ {
-		err = s.Store.InsertAssistant(r.Context(), convID, userID, answer)
-		if err == nil {
-			break
-		}
-		// 如果 user 在此期间被 prune 掉了，只能放弃落库（但仍返回答案）
-		if err == session.ErrUserPruned {
-			break
-		}
-		if !errors.Is(err, session.ErrConflict) {
-			break
-		}
-	}
+	// 如果 user 在此期间被 prune 掉了、或者锁已经丢了，只能放弃落库（但仍返回答案）
+	err = s.insertReply(r.Context(), lease, convID, userID, []session.Message{{Role: "assistant", Content: answer}})
 	// 不要因为落库失败就让请求失败（你也可以选择失败）
-	// 这里先走“用户优先”：返回 answer
+	// 这里先走“用户优先”：返回 answer，重试时回放的也是它（记录里标明没有落库）
+	var title string
+	if err == nil {
+		titleCh := s.startTitle(convID, conv, req.Question, answer)
+		lease.Release()
+		s.startSummary(convID, conv)
+		title = waitTitle(r.Context(), titleCh)
+	}
+	run.done(answer, title, err == nil)
 
 	w.Header().Set("content-type", "application/json; charset=utf-8")
 	_ = json.NewEncoder(w).Encode(askResp{
 		ConversationID: convID,
 		Answer:         answer,
+		Title:          title,
 	})
 }
 
 func (s *Server) askStream(w http.ResponseWriter, r *http.Request) {
-	// CORS headers
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	setCORS(w, "POST, OPTIONS")
 
 	if r.Method == http.MethodOptions {
 		w.WriteHeader(http.StatusOK)
@@ -172,81 +185,85 @@ func (s *Server) askStream(w http.ResponseWriter, r *http.Request) {
 	if convID == "" {
 		convID = s.Store.NewConversationID()
 	}
+	run, replay, ok := s.beginIdempotent(w, r, convID, req)
+	if !ok {
+		return
+	}
+	if replay != nil {
+		s.replayAskStream(w, r, replay)
+		return
+	}
+	if run != nil {
+		defer run.close()
+		// 客户端断开也要生成完并落库，重试时可以接上
+		r = r.WithContext(run.ctx)
+	}
+	conv, ok := s.askConversation(w, r, convID, req)
+	if !ok {
+		return
+	}
 
-	wait := 8 * time.Second
-	if v := os.Getenv("CHAT_LOCK_WAIT"); v != "" {
-		if d, err := time.ParseDuration(v); err == nil && d > 0 {
-			wait = d
-		}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
 	}
-	deadline := time.Now().Add(wait)
 
-	var token string
-	for {
-		t, ok, err := s.Store.AcquireLock(r.Context(), convID)
-		if err != nil {
-			http.Error(w, "redis lock error: "+err.Error(), http.StatusBadGateway)
+	// 需要排队时先开始推流，发 queued 事件报告位置；之后的错误只能走 error 事件
+	streaming := false
+	startStream := func() {
+		if streaming {
 			return
 		}
-		if ok {
-			token = t
-			break
-		}
-
-		if time.Now().After(deadline) {
-			http.Error(w, "conversation is busy, try again", http.StatusTooManyRequests) // 429
+		streaming = true
+		setSSEHeaders(w)
+	}
+	fail := func(status int, msg string) {
+		if !streaming {
+			http.Error(w, msg, status)
 			return
 		}
-
-		time.Sleep(80 * time.Millisecond)
+		_ = writeSSE(w, "error", map[string]string{"error": msg})
+		flusher.Flush()
 	}
-	defer func() { _ = s.Store.ReleaseLock(context.Background(), convID, token) }()
 
-	history, userID, err := s.Store.AppendUser(r.Context(), convID, req.Question)
+	r, lease, err := s.acquireConversation(r, convID, func(pos int) {
+		startStream()
+		_ = writeSSE(w, "queued", map[string]any{"conversation_id": convID, "position": pos})
+		flusher.Flush()
+	})
+	if errors.Is(err, errConversationBusy) {
+		fail(http.StatusTooManyRequests, err.Error())
+		return
+	}
 	if err != nil {
-		http.Error(w, "redis append user error: "+err.Error(), http.StatusBadGateway)
+		fail(http.StatusBadGateway, "store lock error: "+err.Error())
 		return
 	}
+	// 等标题时不需要占着会话锁，Release 可以提前调用
+	defer lease.Release()
 
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+	history, userID, err := s.Store.AppendUser(r.Context(), convID, req.Question)
+	if err != nil {
+		fail(http.StatusBadGateway, "store append user error: "+err.Error())
 		return
 	}
+	run.started(userID)
 
-	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("X-Accel-Buffering", "no")
-
+	startStream()
 	_ = writeSSE(w, "meta", map[string]string{"conversation_id": convID})
 	flusher.Flush()
 
-	stream, err := s.LLM.AskWithHistoryStream(r.Context(), history)
+	stream, err := s.LLM.Stream(r.Context(), history, s.modelOptions(conv)...)
 	if err != nil {
+		run.fail("llm error: " + err.Error())
 		_ = writeSSE(w, "error", map[string]string{"error": "llm error: " + err.Error()})
 		flusher.Flush()
 		return
 	}
 	defer stream.Close()
 
-	const flushEvery = 50 * time.Millisecond
-	lastFlush := time.Now()
-	var deltaBuilder strings.Builder
-
-	flushDelta := func(force bool) {
-		if deltaBuilder.Len() == 0 {
-			return
-		}
-		if !force && time.Since(lastFlush) < flushEvery {
-			return
-		}
-		_ = writeSSE(w, "delta", map[string]string{"delta": deltaBuilder.String()})
-		flusher.Flush()
-		deltaBuilder.Reset()
-		lastFlush = time.Now()
-	}
-
+	deltas := newDeltaWriter(w, flusher)
 	var answerBuilder strings.Builder
 	for {
 		msg, err := stream.Recv()
@@ -254,6 +271,7 @@ func (s *Server) askStream(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 		if err != nil {
+			run.fail("stream error: " + err.Error())
 			_ = writeSSE(w, "error", map[string]string{"error": "stream error: " + err.Error()})
 			flusher.Flush()
 			return
@@ -263,39 +281,88 @@ func (s *Server) askStream(w http.ResponseWriter, r *http.Request) {
 		}
 
 		answerBuilder.WriteString(msg.Content)
-		deltaBuilder.WriteString(msg.Content)
-		flushDelta(false)
+		run.delta(msg.Content)
+		deltas.write(msg.Content)
 	}
 
-	flushDelta(true)
+	deltas.flush(true)
 
 	answer := answerBuilder.String()
+	stored := false
 	if answer != "" {
-		const maxRetry = 3
-		for i := 0; i < maxRetry; i++ {
-			err = s.Store.InsertAssistant(r.Context(), convID, userID, answer)
-			if err == nil {
-				break
-			}
-			if err == session.ErrUserPruned {
-				break
-			}
-			if !errors.Is(err, session.ErrConflict) {
-				break
-			}
-		}
+		err = s.insertReply(r.Context(), lease, convID, userID, []session.Message{{Role: "assistant", Content: answer}})
 		if err != nil && err != session.ErrUserPruned {
-			_ = writeSSE(w, "error", map[string]string{"error": "redis insert error: " + err.Error()})
+			run.fail("store insert error: " + err.Error())
+			_ = writeSSE(w, "error", map[string]string{"error": "store insert error: " + err.Error()})
 			flusher.Flush()
 			return
 		}
+		stored = err == nil
 	}
+	run.done(answer, "", stored)
 
 	_ = writeSSE(w, "done", map[string]string{
 		"answer":          answer,
 		"conversation_id": convID,
 	})
 	flusher.Flush()
+
+	// 标题在 done 之后单独推送，客户端不用等它就能结束渲染
+	if stored {
+		titleCh := s.startTitle(convID, conv, req.Question, answer)
+		lease.Release()
+		s.startSummary(convID, conv)
+		if title := waitTitle(r.Context(), titleCh); title != "" {
+			run.titled(title)
+			_ = writeSSE(w, "title", map[string]string{
+				"title":           title,
+				"conversation_id": convID,
+			})
+			flusher.Flush()
+		}
+	}
+}
+
+// setSSEHeaders 设置 SSE 响应头，在第一次写入之前调用。
+func setSSEHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+}
+
+// deltaFlushEvery 是流式接口推 delta 事件的最小间隔：间隔内到达的增量合并成一个事件。
+const deltaFlushEvery = 50 * time.Millisecond
+
+// deltaWriter 合并模型吐出的增量，最多每 deltaFlushEvery 推一次 delta 事件并 flush。
+type deltaWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	buf     strings.Builder
+	last    time.Time
+}
+
+func newDeltaWriter(w http.ResponseWriter, flusher http.Flusher) *deltaWriter {
+	return &deltaWriter{w: w, flusher: flusher, last: time.Now()}
+}
+
+func (d *deltaWriter) write(delta string) {
+	d.buf.WriteString(delta)
+	d.flush(false)
+}
+
+// flush 推出攒下的增量；force 为 false 时距上次推送不到 deltaFlushEvery 就先攒着。流结束时要 flush(true)。
+func (d *deltaWriter) flush(force bool) {
+	if d.buf.Len() == 0 {
+		return
+	}
+	if !force && time.Since(d.last) < deltaFlushEvery {
+		return
+	}
+	_ = writeSSE(d.w, "delta", map[string]string{"delta": d.buf.String()})
+	d.flusher.Flush()
+	d.buf.Reset()
+	d.last = time.Now()
 }
 
 func writeSSE(w http.ResponseWriter, event string, data any) error {
@@ -0,0 +1,280 @@
+package httpapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/JekYUlll/eino-mini/internal/llm"
+	"github.com/JekYUlll/eino-mini/internal/session"
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+)
+
+// hookProvider 在调用 fake provider 之前先执行 before，用来观察或改动生成期间的存储。
+type hookProvider struct {
+	llm.Provider
+	before func(ctx context.Context, history []session.Message)
+}
+
+func (p *hookProvider) Generate(ctx context.Context, history []session.Message, opts ...model.Option) (*schema.Message, error) {
+	if p.before != nil {
+		p.before(ctx, history)
+	}
+	return p.Provider.Generate(ctx, history, opts...)
+}
+
+func (p *hookProvider) Stream(ctx context.Context, history []session.Message, opts ...model.Option) (*schema.StreamReader[*schema.Message], error) {
+	if p.before != nil {
+		p.before(ctx, history)
+	}
+	return p.Provider.Stream(ctx, history, opts...)
+}
+
+// newTestServer 用内存存储和 fake provider 起一个完整的 HTTP 服务，关掉自动标题，避免它消耗 fake 的回复。
+func newTestServer(t *testing.T, provider llm.Provider) (*httptest.Server, *Server) {
+	t.Helper()
+	t.Setenv("CHAT_AUTO_TITLE", "false")
+	store, err := session.NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{LLM: provider, Store: store}
+	mux := http.NewServeMux()
+	s.Register(mux)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts, s
+}
+
+// postJSON 发一个 JSON POST，返回响应（调用方负责关闭 Body）。
+func postJSON(t *testing.T, url string, body any, header ...string) *http.Response {
+	t.Helper()
+	raw, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func ask(t *testing.T, url string, req askReq, header ...string) askResp {
+	t.Helper()
+	resp := postJSON(t, url+"/ask", req, header...)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("ask: status %d", resp.StatusCode)
+	}
+	var out askResp
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+type sseEvent struct {
+	name string
+	data map[string]any
+}
+
+// readSSE 读完一个 SSE 响应里的全部事件。
+func readSSE(t *testing.T, resp *http.Response) []sseEvent {
+	t.Helper()
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Fatalf("content-type %q, status %d", ct, resp.StatusCode)
+	}
+	var (
+		out  []sseEvent
+		name string
+	)
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			var data map[string]any
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data); err != nil {
+				t.Fatalf("event %s: %v", name, err)
+			}
+			out = append(out, sseEvent{name: name, data: data})
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// roles 把消息压成 "role:content"。
+func roles(msgs []session.Message) []string {
+	out := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		out = append(out, m.Role+":"+m.Content)
+	}
+	return out
+}
+
+// 两阶段写入：调模型时 user 已经落库、回复还没有；回复插回之后挂在自己的 user 下面。
+func TestAskAppendsUserBeforeReply(t *testing.T) {
+	var (
+		s       *Server
+		convID  string
+		pending [][]string
+	)
+	provider := &hookProvider{
+		Provider: llm.NewFake(llm.FakeConfig{Replies: []string{"a1", "a2"}}),
+		before: func(ctx context.Context, history []session.Message) {
+			stored, err := s.Store.History(ctx, convID)
+			if err != nil {
+				t.Error(err)
+			}
+			pending = append(pending, roles(stored))
+		},
+	}
+	ts, srv := newTestServer(t, provider)
+	s = srv
+	convID = s.Store.NewConversationID()
+
+	for i, q := range []string{"q1", "q2"} {
+		out := ask(t, ts.URL, askReq{ConversationID: convID, Question: q})
+		if want := []string{"a1", "a2"}[i]; out.Answer != want || out.ConversationID != convID {
+			t.Fatalf("ask %s: got %+v, want answer %s", q, out, want)
+		}
+	}
+
+	want := [][]string{
+		{"user:q1"},
+		{"user:q1", "assistant:a1", "user:q2"},
+	}
+	for i, got := range pending {
+		if !slices.Equal(got[1:], want[i]) {
+			t.Errorf("history during generation %d = %v, want %v", i, got[1:], want[i])
+		}
+	}
+
+	msgs, err := s.Store.History(context.Background(), convID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := roles(msgs[1:]), []string{"user:q1", "assistant:a1", "user:q2", "assistant:a2"}; !slices.Equal(got, want) {
+		t.Fatalf("history = %v, want %v", got, want)
+	}
+	for i := 1; i < len(msgs); i++ {
+		if msgs[i].ParentID != msgs[i-1].ID {
+			t.Errorf("%s: parent %q, want %q", msgs[i].Content, msgs[i].ParentID, msgs[i-1].ID)
+		}
+	}
+}
+
+// 生成期间 user 被裁掉（不持锁的写入追加了新 user、窗口只留一轮）：答案照常返回，但不落库。
+func TestAskUserPrunedDuringGeneration(t *testing.T) {
+	t.Setenv("CHAT_PRUNE_POLICY", "turns")
+	t.Setenv("CHAT_MAX_TURNS", "1")
+
+	var (
+		s      *Server
+		convID string
+	)
+	provider := &hookProvider{
+		Provider: llm.NewFake(llm.FakeConfig{Replies: []string{"a1"}, ChunkSize: 1}),
+		before: func(ctx context.Context, _ []session.Message) {
+			if _, _, err := s.Store.AppendUser(session.WithoutFence(context.Background()), convID, "later"); err != nil {
+				t.Error(err)
+			}
+		},
+	}
+
+	for _, path := range []string{"/ask", "/ask/stream"} {
+		t.Run(path, func(t *testing.T) {
+			ts, srv := newTestServer(t, provider)
+			s = srv
+			convID = s.Store.NewConversationID()
+
+			resp := postJSON(t, ts.URL+path, askReq{ConversationID: convID, Question: "q1"})
+			var answer string
+			if path == "/ask" {
+				defer resp.Body.Close()
+				var out askResp
+				if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+					t.Fatal(err)
+				}
+				answer = out.Answer
+			} else {
+				events := readSSE(t, resp)
+				last := events[len(events)-1]
+				if last.name != "done" {
+					t.Fatalf("last event = %s %v, want done", last.name, last.data)
+				}
+				answer, _ = last.data["answer"].(string)
+			}
+			if answer != "a1" {
+				t.Fatalf("answer = %q, want a1", answer)
+			}
+
+			msgs, err := s.Store.History(context.Background(), convID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := roles(msgs), []string{"user:later"}; !slices.Equal(got[1:], want) {
+				t.Fatalf("history = %v, want system + %v", got, want)
+			}
+		})
+	}
+}
+
+// /ask/stream 的事件顺序：meta、若干 delta、done（done 里的答案是 delta 拼起来的），回复落库。
+func TestAskStreamEvents(t *testing.T) {
+	ts, s := newTestServer(t, llm.NewFake(llm.FakeConfig{Replies: []string{"hello, world"}, ChunkSize: 3}))
+
+	resp := postJSON(t, ts.URL+"/ask/stream", askReq{Question: "hi"})
+	events := readSSE(t, resp)
+	if len(events) < 3 {
+		t.Fatalf("events = %v", events)
+	}
+
+	first, last := events[0], events[len(events)-1]
+	convID, _ := first.data["conversation_id"].(string)
+	if first.name != "meta" || convID == "" {
+		t.Fatalf("first event = %s %v, want meta with conversation_id", first.name, first.data)
+	}
+	if last.name != "done" || last.data["conversation_id"] != convID {
+		t.Fatalf("last event = %s %v, want done for %s", last.name, last.data, convID)
+	}
+	var deltas strings.Builder
+	for _, ev := range events[1 : len(events)-1] {
+		if ev.name != "delta" {
+			t.Fatalf("unexpected event %s %v between meta and done", ev.name, ev.data)
+		}
+		deltas.WriteString(ev.data["delta"].(string))
+	}
+	if deltas.String() != "hello, world" || last.data["answer"] != "hello, world" {
+		t.Fatalf("deltas %q, done answer %v", deltas.String(), last.data["answer"])
+	}
+
+	msgs, err := s.Store.History(context.Background(), convID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := roles(msgs[1:]), []string{"user:hi", "assistant:hello, world"}; !slices.Equal(got, want) {
+		t.Fatalf("history = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,344 @@
+package httpapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JekYUlll/eino-mini/internal/session"
+)
+
+// /ask 和 /ask/stream 支持 Idempotency-Key 头：客户端网络抖动后带同一个键重试时，
+// 不再重复追加 user、重复调模型，而是回放第一次请求的结果；第一次请求还在生成的话，
+// 等它结束（流式请求在同一个进程里可以直接接上正在推的 delta）。
+// 带键的请求在客户端断开后会继续生成并落库，这样重试才有结果可拿；生成最多持续 CHAT_GENERATION_TIMEOUT。
+// 同一个键只能用于同一个请求：请求体（question / persona / system_prompt）的哈希跟记录里的不一致时返回 422。
+// 第一次请求在写入 user 之前就失败了（排队超时、参数错误等）时删掉记录，重试按新请求执行。
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	// idempotentReplayedHeader 标记这次响应是回放的
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	// idempotentPersistedHeader 在回放成功的结果时说明答案有没有写进会话
+	idempotentPersistedHeader = "Idempotent-Persisted"
+	maxIdempotencyKey         = 255
+	// idempotencyPoll 是等其他进程上的第一次请求结束时轮询存储的间隔
+	idempotencyPoll = 200 * time.Millisecond
+)
+
+var errIdempotencyAbandoned = errors.New("previous request with this Idempotency-Key did not complete, retry it")
+
+// idempotencyStoreKey 按 owner 隔离幂等键（带上 owner 长度，拼接后不会跟别的 owner 撞上）。
+func idempotencyStoreKey(r *http.Request, key string) string {
+	owner := ownerOf(r)
+	return fmt.Sprintf("%d:%s:%s", len(owner), owner, key)
+}
+
+// requestHash 是请求体里决定生成内容的字段的哈希。conversation_id 不算在内：
+// 不带它时每次都会分配新的，由 beginIdempotent 单独比较。
+func requestHash(req askReq) string {
+	b, _ := json.Marshal(struct {
+		Question     string `json:"question"`
+		Persona      string `json:"persona"`
+		SystemPrompt string `json:"system_prompt"`
+	}{req.Question, req.Persona, req.SystemPrompt})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// generation 是本进程里一次带幂等键、正在进行的生成，重试的流式请求可以接上它的输出。
+type generation struct {
+	mu      sync.Mutex
+	deltas  []string
+	done    bool
+	changed chan struct{} // 有新 delta 或结束时关闭，之后换一个新的
+	end     chan struct{}
+}
+
+func newGeneration() *generation {
+	return &generation{changed: make(chan struct{}), end: make(chan struct{})}
+}
+
+func (g *generation) append(delta string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.deltas = append(g.deltas, delta)
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+func (g *generation) finish() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.done {
+		return
+	}
+	g.done = true
+	close(g.changed)
+	close(g.end)
+}
+
+// read 返回从第 from 个开始的 delta、是否已经结束，以及下次变化时关闭的 channel。
+func (g *generation) read(from int) ([]string, bool, <-chan struct{}) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return slices.Clone(g.deltas[from:]), g.done, g.changed
+}
+
+// idempotentRun 是带幂等键、第一次执行的请求，负责把进度写回记录。
+// 方法在 nil 上调用是空操作，没带键的请求不用分支判断。
+type idempotentRun struct {
+	s      *Server
+	ctx    context.Context // 不随客户端断开取消，CHAT_GENERATION_TIMEOUT 后超时
+	cancel context.CancelFunc
+	rec    session.IdempotencyRecord
+	gen    *generation
+	end    bool
+}
+
+// save 写回记录。生成超时后也要能记下结果，所以不用 run.ctx 的取消。
+func (run *idempotentRun) save() {
+	_ = run.s.Store.SaveIdempotency(context.WithoutCancel(run.ctx), run.rec)
+}
+
+// started 在 user 写入之后记下 userID，之后失败的话按 failed 记录，重试不会再追加 user。
+func (run *idempotentRun) started(userID string) {
+	if run == nil {
+		return
+	}
+	run.rec.UserID = userID
+	run.save()
+}
+
+func (run *idempotentRun) delta(delta string) {
+	if run == nil {
+		return
+	}
+	run.gen.append(delta)
+}
+
+// done 记下答案和它有没有落库，之后的重试直接回放它；title 是首轮生成的标题，没有时为空。
+func (run *idempotentRun) done(answer, title string, persisted bool) {
+	if run == nil || run.end {
+		return
+	}
+	run.rec.Status = session.IdempotencyDone
+	run.rec.Answer = answer
+	run.rec.Title = title
+	run.rec.Persisted = persisted
+	run.rec.Error = ""
+	run.save()
+	run.finish()
+}
+
+// titled 在 done 之后补记标题：流式请求先推 done，标题之后才生成出来。
+func (run *idempotentRun) titled(title string) {
+	if run == nil || title == "" || run.rec.Status != session.IdempotencyDone {
+		return
+	}
+	run.rec.Title = title
+	run.save()
+}
+
+// fail 记下返回给客户端的错误，close 时写入记录。
+func (run *idempotentRun) fail(msg string) {
+	if run == nil {
+		return
+	}
+	run.rec.Error = msg
+}
+
+// close 在请求结束时调用（defer）：没有走到 done 的，user 还没写入就删掉记录让重试重新执行，
+// 已经写入就记为 failed。最后取消 run.ctx。
+func (run *idempotentRun) close() {
+	if run == nil {
+		return
+	}
+	defer run.cancel()
+	if run.end {
+		return
+	}
+	if run.rec.UserID == "" {
+		_ = run.s.Store.DeleteIdempotency(context.WithoutCancel(run.ctx), run.rec.Key)
+	} else {
+		run.rec.Status = session.IdempotencyFailed
+		if run.rec.Error == "" {
+			run.rec.Error = "request did not complete"
+		}
+		run.save()
+	}
+	run.finish()
+}
+
+func (run *idempotentRun) finish() {
+	run.end = true
+	run.gen.finish()
+	run.s.generations.Delete(run.rec.Key)
+}
+
+// beginIdempotent 按 Idempotency-Key 登记请求。没带键时返回 (nil, nil, true)；
+// 第一次出现时返回 run，调用方正常执行并 defer run.close()；已经出现过时返回已有记录，调用方回放。
+// 失败时已经写好错误响应，返回 ok=false。
+func (s *Server) beginIdempotent(w http.ResponseWriter, r *http.Request, convID string, req askReq) (run *idempotentRun, replay *session.IdempotencyRecord, ok bool) {
+	key := strings.TrimSpace(r.Header.Get(idempotencyHeader))
+	if key == "" {
+		return nil, nil, true
+	}
+	if len(key) > maxIdempotencyKey {
+		http.Error(w, fmt.Sprintf("%s longer than %d bytes", idempotencyHeader, maxIdempotencyKey), http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	rec := session.IdempotencyRecord{
+		Key:            idempotencyStoreKey(r, key),
+		ConversationID: convID,
+		RequestHash:    requestHash(req),
+		Status:         session.IdempotencyPending,
+	}
+	existing, created, err := s.Store.BeginIdempotency(r.Context(), rec)
+	if err != nil {
+		writeStoreError(w, err)
+		return nil, nil, false
+	}
+	if !created {
+		if req.ConversationID != "" && req.ConversationID != existing.ConversationID {
+			http.Error(w, idempotencyHeader+" was already used for another conversation", http.StatusUnprocessableEntity)
+			return nil, nil, false
+		}
+		if existing.RequestHash != rec.RequestHash {
+			http.Error(w, idempotencyHeader+" was already used for a different request", http.StatusUnprocessableEntity)
+			return nil, nil, false
+		}
+		return nil, existing, true
+	}
+
+	// 客户端断开也要生成完，但不能无限期地生成下去
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), getDurationEnv("CHAT_GENERATION_TIMEOUT", 5*time.Minute))
+	run = &idempotentRun{s: s, ctx: ctx, cancel: cancel, rec: rec, gen: newGeneration()}
+	s.generations.Store(rec.Key, run.gen)
+	return run, nil, true
+}
+
+// awaitIdempotent 等 pending 的记录结束：第一次请求在本进程里时等它的 generation，
+// 否则按 idempotencyPoll 轮询存储。记录不在了（第一次请求没写入就放弃了）时返回 errIdempotencyAbandoned。
+func (s *Server) awaitIdempotent(ctx context.Context, rec *session.IdempotencyRecord) (*session.IdempotencyRecord, error) {
+	for rec.Status == session.IdempotencyPending {
+		var wait <-chan struct{}
+		if g, ok := s.generations.Load(rec.Key); ok {
+			wait = g.(*generation).end
+		}
+		select {
+		case <-wait:
+		case <-time.After(idempotencyPoll):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		next, err := s.Store.GetIdempotency(ctx, rec.Key)
+		if errors.Is(err, session.ErrNotFound) {
+			return nil, errIdempotencyAbandoned
+		}
+		if err != nil {
+			return nil, err
+		}
+		rec = next
+	}
+	return rec, nil
+}
+
+// replayAsk 回放 /ask：返回第一次请求的答案或错误。
+func (s *Server) replayAsk(w http.ResponseWriter, r *http.Request, rec *session.IdempotencyRecord) {
+	rec, err := s.awaitIdempotent(r.Context(), rec)
+	if errors.Is(err, errIdempotencyAbandoned) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.Header().Set(idempotentReplayedHeader, "true")
+	if rec.Status == session.IdempotencyFailed {
+		http.Error(w, rec.Error, http.StatusBadGateway)
+		return
+	}
+	w.Header().Set(idempotentPersistedHeader, strconv.FormatBool(rec.Persisted))
+	writeJSON(w, http.StatusOK, askResp{
+		ConversationID: rec.ConversationID,
+		Answer:         rec.Answer,
+		Title:          rec.Title,
+	})
+}
+
+// replayAskStream 回放 /ask/stream：第一次请求在本进程里还在生成时，先补发已经推过的 delta 再接着推新的；
+// 否则等它结束后把整段答案作为一个 delta 发出。记录里有标题时在 done 之后推 title。
+func (s *Server) replayAskStream(w http.ResponseWriter, r *http.Request, rec *session.IdempotencyRecord) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(idempotentReplayedHeader, "true")
+	setSSEHeaders(w)
+
+	_ = writeSSE(w, "meta", map[string]string{"conversation_id": rec.ConversationID})
+	flusher.Flush()
+
+	sent := 0
+	if v, ok := s.generations.Load(rec.Key); ok {
+		g := v.(*generation)
+		for {
+			deltas, done, changed := g.read(sent)
+			if len(deltas) > 0 {
+				_ = writeSSE(w, "delta", map[string]string{"delta": strings.Join(deltas, "")})
+				flusher.Flush()
+				sent += len(deltas)
+			}
+			if done {
+				break
+			}
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	rec, err := s.awaitIdempotent(r.Context(), rec)
+	if err != nil {
+		if !errors.Is(err, errIdempotencyAbandoned) {
+			err = fmt.Errorf("store error: %w", err)
+		}
+		_ = writeSSE(w, "error", map[string]string{"error": err.Error()})
+		flusher.Flush()
+		return
+	}
+	if rec.Status == session.IdempotencyFailed {
+		_ = writeSSE(w, "error", map[string]string{"error": rec.Error})
+		flusher.Flush()
+		return
+	}
+	if sent == 0 && rec.Answer != "" {
+		_ = writeSSE(w, "delta", map[string]string{"delta": rec.Answer})
+	}
+	_ = writeSSE(w, "done", map[string]string{
+		"answer":          rec.Answer,
+		"conversation_id": rec.ConversationID,
+	})
+	if rec.Title != "" {
+		_ = writeSSE(w, "title", map[string]string{
+			"title":           rec.Title,
+			"conversation_id": rec.ConversationID,
+		})
+	}
+	flusher.Flush()
+}
@@ -0,0 +1,178 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/JekYUlll/eino-mini/internal/llm"
+	"github.com/JekYUlll/eino-mini/internal/session"
+)
+
+// 同一个键重试：回放第一次的答案，不再追加 user、不再调模型。
+func TestIdempotentReplay(t *testing.T) {
+	ts, s := newTestServer(t, llm.NewFake(llm.FakeConfig{Replies: []string{"a1", "a2"}}))
+	convID := s.Store.NewConversationID()
+	req := askReq{ConversationID: convID, Question: "q1"}
+
+	first := ask(t, ts.URL, req, idempotencyHeader, "k1")
+	resp := postJSON(t, ts.URL+"/ask", req, idempotencyHeader, "k1")
+	defer resp.Body.Close()
+	var again askResp
+	if err := json.NewDecoder(resp.Body).Decode(&again); err != nil {
+		t.Fatal(err)
+	}
+	if first.Answer != "a1" || again != first {
+		t.Fatalf("first %+v, replay %+v", first, again)
+	}
+	if resp.Header.Get(idempotentReplayedHeader) != "true" || resp.Header.Get(idempotentPersistedHeader) != "true" {
+		t.Fatalf("replay headers %v", resp.Header)
+	}
+
+	// 流式重试回放同一个答案
+	events := readSSE(t, postJSON(t, ts.URL+"/ask/stream", req, idempotencyHeader, "k1"))
+	var names []string
+	for _, ev := range events {
+		names = append(names, ev.name)
+	}
+	if want := []string{"meta", "delta", "done"}; !slices.Equal(names, want) || events[2].data["answer"] != "a1" {
+		t.Fatalf("stream replay = %v %v", names, events)
+	}
+
+	msgs, err := s.Store.History(context.Background(), convID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := roles(msgs[1:]), []string{"user:q1", "assistant:a1"}; !slices.Equal(got, want) {
+		t.Fatalf("history = %v, want %v", got, want)
+	}
+}
+
+// 同一个键换了请求内容（或换了会话）返回 422，没有哈希的记录也一样。
+func TestIdempotentDifferentRequest(t *testing.T) {
+	ts, s := newTestServer(t, llm.NewFake(llm.FakeConfig{Replies: []string{"a1"}}))
+	convID := s.Store.NewConversationID()
+	ask(t, ts.URL, askReq{ConversationID: convID, Question: "q1"}, idempotencyHeader, "k1")
+
+	// 没带 X-User-ID 的请求 owner 为空
+	_, _, err := s.Store.BeginIdempotency(context.Background(), session.IdempotencyRecord{
+		Key:            idempotencyStoreKey(httptest.NewRequest(http.MethodPost, "/ask", nil), "k2"),
+		ConversationID: convID,
+		Status:         session.IdempotencyDone,
+		Answer:         "old",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, c := range map[string]struct {
+		key string
+		req askReq
+	}{
+		"question":     {"k1", askReq{ConversationID: convID, Question: "q2"}},
+		"persona":      {"k1", askReq{ConversationID: convID, Question: "q1", Persona: "coder"}},
+		"system":       {"k1", askReq{ConversationID: convID, Question: "q1", SystemPrompt: "be brief"}},
+		"conversation": {"k1", askReq{ConversationID: s.Store.NewConversationID(), Question: "q1"}},
+		"hashless":     {"k2", askReq{ConversationID: convID, Question: "q1"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			resp := postJSON(t, ts.URL+"/ask", c.req, idempotencyHeader, c.key)
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusUnprocessableEntity {
+				t.Fatalf("status %d: %s", resp.StatusCode, body)
+			}
+		})
+	}
+}
+
+// 带键的请求最多生成 CHAT_GENERATION_TIMEOUT：超时后记为失败，重试回放同一个错误，不会再追加 user。
+func TestIdempotentGenerationTimeout(t *testing.T) {
+	t.Setenv("CHAT_GENERATION_TIMEOUT", "50ms")
+	ts, s := newTestServer(t, llm.NewFake(llm.FakeConfig{Replies: []string{"a1"}, ChunkDelay: time.Second}))
+	convID := s.Store.NewConversationID()
+	req := askReq{ConversationID: convID, Question: "q1"}
+
+	start := time.Now()
+	resp := postJSON(t, ts.URL+"/ask", req, idempotencyHeader, "k1")
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("status %d after %s: %s", resp.StatusCode, time.Since(start), body)
+	}
+
+	resp = postJSON(t, ts.URL+"/ask", req, idempotencyHeader, "k1")
+	replayed, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || resp.Header.Get(idempotentReplayedHeader) != "true" || string(replayed) != string(body) {
+		t.Fatalf("replay status %d %v: %s, want %s", resp.StatusCode, resp.Header, replayed, body)
+	}
+
+	msgs, err := s.Store.History(context.Background(), convID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := roles(msgs[1:]), []string{"user:q1"}; !slices.Equal(got, want) {
+		t.Fatalf("history = %v, want %v", got, want)
+	}
+}
+
+// 回放带上首轮生成的标题；user 在生成期间被裁掉时回放说明答案没有落库。
+func TestIdempotentReplayTitleAndPersisted(t *testing.T) {
+	t.Run("title", func(t *testing.T) {
+		ts, s := newTestServer(t, llm.NewFake(llm.FakeConfig{Replies: []string{"a1", "标题：Greeting"}}))
+		t.Setenv("CHAT_AUTO_TITLE", "true")
+		convID := s.Store.NewConversationID()
+		req := askReq{ConversationID: convID, Question: "q1"}
+
+		first := ask(t, ts.URL, req, idempotencyHeader, "k1")
+		if first.Title != "Greeting" {
+			t.Fatalf("first = %+v", first)
+		}
+		if again := ask(t, ts.URL, req, idempotencyHeader, "k1"); again != first {
+			t.Fatalf("replay %+v, want %+v", again, first)
+		}
+		events := readSSE(t, postJSON(t, ts.URL+"/ask/stream", req, idempotencyHeader, "k1"))
+		last := events[len(events)-1]
+		if last.name != "title" || last.data["title"] != "Greeting" {
+			t.Fatalf("stream replay ends with %s %v, want title", last.name, last.data)
+		}
+	})
+
+	t.Run("persisted", func(t *testing.T) {
+		t.Setenv("CHAT_PRUNE_POLICY", "turns")
+		t.Setenv("CHAT_MAX_TURNS", "1")
+		var (
+			s      *Server
+			convID string
+		)
+		provider := &hookProvider{
+			Provider: llm.NewFake(llm.FakeConfig{Replies: []string{"a1"}}),
+			before: func(ctx context.Context, _ []session.Message) {
+				if _, _, err := s.Store.AppendUser(session.WithoutFence(context.Background()), convID, "later"); err != nil {
+					t.Error(err)
+				}
+			},
+		}
+		ts, srv := newTestServer(t, provider)
+		s = srv
+		convID = s.Store.NewConversationID()
+		req := askReq{ConversationID: convID, Question: "q1"}
+
+		ask(t, ts.URL, req, idempotencyHeader, "k1")
+		resp := postJSON(t, ts.URL+"/ask", req, idempotencyHeader, "k1")
+		defer resp.Body.Close()
+		var again askResp
+		if err := json.NewDecoder(resp.Body).Decode(&again); err != nil {
+			t.Fatal(err)
+		}
+		if again.Answer != "a1" || resp.Header.Get(idempotentPersistedHeader) != "false" {
+			t.Fatalf("replay %+v, headers %v", again, resp.Header)
+		}
+	})
+}
@@ -0,0 +1,489 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/JekYUlll/eino-mini/internal/llm"
+	"github.com/JekYUlll/eino-mini/internal/session"
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+	"github.com/google/uuid"
+)
+
+// OpenAI Chat Completions 兼容层，方便已有的 OpenAI SDK / 工具直接接入。
+//
+// 默认是无状态的：请求里的 messages 原样交给模型。带上请求头 X-Conversation-ID（或 user 字段）时绑定到
+// 已存储的会话：只取请求里最后一条 user 消息，历史由 session.Store 注入，回复照常落库，
+// 和 /ask 走同一套加锁、两阶段写入和裁剪。
+
+// conversationHeader 绑定会话的请求头，优先于 user 字段。
+const conversationHeader = "X-Conversation-ID"
+
+type chatCompletionReq struct {
+	Model         string          `json:"model"`
+	Messages      []openaiMessage `json:"messages"`
+	Stream        bool            `json:"stream"`
+	StreamOptions *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options,omitempty"`
+	Temperature *float32 `json:"temperature,omitempty"`
+	TopP        *float32 `json:"top_p,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+	Stop        stopList `json:"stop,omitempty"`
+	User        string   `json:"user,omitempty"`
+}
+
+type openaiMessage struct {
+	Role       string           `json:"role"`
+	Content    openaiContent    `json:"content"`
+	Name       string           `json:"name,omitempty"`
+	ToolCalls  []openaiToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type openaiToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// openaiContent 兼容 content 的两种写法：字符串，或者 text / image_url / input_audio 片段数组。
+type openaiContent struct {
+	Text  string
+	Parts []session.ContentPart
+}
+
+func (c *openaiContent) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &c.Text)
+	}
+	var parts []struct {
+		Type     string `json:"type"`
+		Text     string `json:"text"`
+		ImageURL *struct {
+			URL    string `json:"url"`
+			Detail string `json:"detail"`
+		} `json:"image_url"`
+		InputAudio *struct {
+			Data   string `json:"data"`
+			Format string `json:"format"`
+		} `json:"input_audio"`
+	}
+	if err := json.Unmarshal(b, &parts); err != nil {
+		return errors.New("content must be a string or an array of parts")
+	}
+	for _, p := range parts {
+		switch {
+		case p.Type == "text":
+			c.Parts = append(c.Parts, session.ContentPart{Type: session.PartText, Text: p.Text})
+		case p.Type == "image_url" && p.ImageURL != nil:
+			c.Parts = append(c.Parts, imagePart(p.ImageURL.URL, p.ImageURL.Detail))
+		case p.Type == "input_audio" && p.InputAudio != nil:
+			c.Parts = append(c.Parts, session.ContentPart{
+				Type:     session.PartAudio,
+				Data:     p.InputAudio.Data,
+				MIMEType: "audio/" + p.InputAudio.Format,
+			})
+		default:
+			return fmt.Errorf("unsupported content part %q", p.Type)
+		}
+	}
+	return nil
+}
+
+// imagePart 把 data URL 拆成 base64 和 MIME 类型，其他 URL 原样保留。
+func imagePart(url, detail string) session.ContentPart {
+	p := session.ContentPart{Type: session.PartImage, URL: url, Detail: detail}
+	if rest, ok := strings.CutPrefix(url, "data:"); ok {
+		if meta, data, ok := strings.Cut(rest, ","); ok && strings.HasSuffix(meta, ";base64") {
+			p.URL = ""
+			p.Data = data
+			p.MIMEType = strings.TrimSuffix(meta, ";base64")
+		}
+	}
+	return p
+}
+
+// stopList 兼容 stop 的字符串和字符串数组两种写法。
+type stopList []string
+
+func (s *stopList) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*s = stopList{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return errors.New("stop must be a string or an array of strings")
+	}
+	*s = many
+	return nil
+}
+
+func (m openaiMessage) toSession() session.Message {
+	out := session.Message{
+		Role:       m.Role,
+		Content:    m.Content.Text,
+		Name:       m.Name,
+		Parts:      m.Content.Parts,
+		ToolCallID: m.ToolCallID,
+	}
+	for _, tc := range m.ToolCalls {
+		out.ToolCalls = append(out.ToolCalls, session.ToolCall{
+			ID:        tc.ID,
+			Type:      tc.Type,
+			Name:      tc.Function.Name,
+			Arguments: tc.Function.Arguments,
+		})
+	}
+	return out
+}
+
+type chatCompletionMessage struct {
+	Role      string           `json:"role,omitempty"`
+	Content   *string          `json:"content,omitempty"`
+	ToolCalls []openaiToolCall `json:"tool_calls,omitempty"`
+}
+
+type chatCompletionChoice struct {
+	Index        int                    `json:"index"`
+	Message      *chatCompletionMessage `json:"message,omitempty"`
+	Delta        *chatCompletionMessage `json:"delta,omitempty"`
+	FinishReason *string                `json:"finish_reason"`
+}
+
+type chatCompletionUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type chatCompletionResp struct {
+	ID      string                 `json:"id"`
+	Object  string                 `json:"object"`
+	Created int64                  `json:"created"`
+	Model   string                 `json:"model"`
+	Choices []chatCompletionChoice `json:"choices"`
+	Usage   *chatCompletionUsage   `json:"usage,omitempty"`
+}
+
+// writeOpenAIError 按 OpenAI 的错误格式返回，SDK 能直接解析出 message。
+func writeOpenAIError(w http.ResponseWriter, status int, typ, msg string) {
+	writeJSON(w, status, map[string]any{
+		"error": map[string]any{"message": msg, "type": typ, "code": nil},
+	})
+}
+
+func setOpenAICORS(w http.ResponseWriter, methods string) {
+	setCORS(w, methods)
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, "+ownerHeader+", "+conversationHeader)
+	w.Header().Set("Access-Control-Expose-Headers", conversationHeader)
+}
+
+// POST /v1/chat/completions
+func (s *Server) chatCompletions(w http.ResponseWriter, r *http.Request) {
+	setOpenAICORS(w, "POST, OPTIONS")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "POST only")
+		return
+	}
+	var req chatCompletionReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "bad json: "+err.Error())
+		return
+	}
+	if len(req.Messages) == 0 {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "messages is required")
+		return
+	}
+	// 无状态调用不碰存储，只有绑定会话时才需要 Store（见 completeConversation）
+	if s.LLM == nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "server_error", "server misconfig")
+		return
+	}
+
+	var opts []model.Option
+	if req.Temperature != nil {
+		opts = append(opts, model.WithTemperature(*req.Temperature))
+	}
+	if req.TopP != nil {
+		opts = append(opts, model.WithTopP(*req.TopP))
+	}
+	if req.MaxTokens != nil {
+		opts = append(opts, model.WithMaxTokens(*req.MaxTokens))
+	}
+	if len(req.Stop) > 0 {
+		opts = append(opts, model.WithStop(req.Stop))
+	}
+
+	convID := strings.TrimSpace(r.Header.Get(conversationHeader))
+	if convID == "" {
+		convID = strings.TrimSpace(req.User)
+	}
+	if convID == "" {
+		history := make([]session.Message, 0, len(req.Messages))
+		for _, m := range req.Messages {
+			history = append(history, m.toSession())
+		}
+		c := completer{s: s, w: w, r: r, req: &req, id: "chatcmpl-" + uuid.NewString(), opts: opts}
+		_, _ = c.run(history)
+		return
+	}
+	s.completeConversation(w, r, &req, convID, opts)
+}
+
+// completer 负责一次补全的模型调用和响应格式，落库由调用方决定。
+type completer struct {
+	s    *Server
+	w    http.ResponseWriter
+	r    *http.Request
+	req  *chatCompletionReq
+	id   string
+	opts []model.Option
+}
+
+func (s *Server) completeConversation(w http.ResponseWriter, r *http.Request, req *chatCompletionReq, convID string, opts []model.Option) {
+	if s.Store == nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "server_error", "server misconfig: no store for a bound conversation")
+		return
+	}
+	last := req.Messages[len(req.Messages)-1].toSession()
+	question := last.Text()
+	if last.Role != "user" || question == "" {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "the last message must be a non-empty user message when a conversation is bound")
+		return
+	}
+	conv, err := s.ensureConversation(r, convID)
+	if err != nil {
+		if errors.Is(err, session.ErrNotFound) {
+			writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "conversation not found")
+			return
+		}
+		writeOpenAIError(w, http.StatusBadGateway, "server_error", "store error: "+err.Error())
+		return
+	}
+
+	r, lease, ok := s.lockConversation(w, r, convID)
+	if !ok {
+		return
+	}
+	defer lease.Release()
+
+	history, userID, err := s.Store.AppendUser(r.Context(), convID, question)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadGateway, "server_error", "store append user error: "+err.Error())
+		return
+	}
+
+	w.Header().Set(conversationHeader, convID)
+	c := completer{s: s, w: w, r: r, req: req, id: "chatcmpl-" + uuid.NewString(), opts: opts}
+	resp, ok := c.run(history)
+	if !ok {
+		return
+	}
+	// 只有工具调用、没有文本的回复也要存下来，不然这轮 user 就没有回复了
+	// （工具结果不会回到会话里，下次调模型时这些调用按没有结果处理，见 llm.buildMessages）
+	reply := llm.FromSchema(resp)
+	reply.Role = "assistant"
+	if reply.Content == "" && len(reply.ToolCalls) == 0 {
+		return
+	}
+
+	// 和 /ask 一样用户优先：响应已经发出，落库失败只影响历史
+	err = s.insertReply(r.Context(), lease, convID, userID, []session.Message{reply})
+	if err == nil {
+		s.startTitle(convID, conv, question, reply.Content)
+		lease.Release()
+		s.startSummary(convID, conv)
+	}
+}
+
+// run 调模型并按 req.Stream 写出响应，返回完整的回复（文本和工具调用）；ok=false 表示出错且错误已写出。
+func (c *completer) run(history []session.Message) (resp *schema.Message, ok bool) {
+	if c.req.Stream {
+		return c.stream(history)
+	}
+	resp, err := c.s.LLM.Generate(c.r.Context(), history, c.opts...)
+	if err != nil {
+		writeOpenAIError(c.w, http.StatusBadGateway, "server_error", "llm error: "+err.Error())
+		return nil, false
+	}
+	msg := &chatCompletionMessage{Role: "assistant", Content: &resp.Content, ToolCalls: toolCallsOf(resp)}
+	finish := finishReason(resp)
+	writeJSON(c.w, http.StatusOK, chatCompletionResp{
+		ID:      c.id,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   c.s.LLM.Model(),
+		Choices: []chatCompletionChoice{{Index: 0, Message: msg, FinishReason: &finish}},
+		Usage:   usageOf(resp),
+	})
+	return resp, true
+}
+
+func (c *completer) stream(history []session.Message) (*schema.Message, bool) {
+	flusher, ok := c.w.(http.Flusher)
+	if !ok {
+		writeOpenAIError(c.w, http.StatusInternalServerError, "server_error", "streaming unsupported")
+		return nil, false
+	}
+	sr, err := c.s.LLM.Stream(c.r.Context(), history, c.opts...)
+	if err != nil {
+		writeOpenAIError(c.w, http.StatusBadGateway, "server_error", "llm error: "+err.Error())
+		return nil, false
+	}
+	defer sr.Close()
+
+	setSSEHeaders(c.w)
+
+	created := time.Now().Unix()
+	send := func(delta *chatCompletionMessage, finish *string, usage *chatCompletionUsage) {
+		chunk := chatCompletionResp{
+			ID:      c.id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   c.s.LLM.Model(),
+			Choices: []chatCompletionChoice{},
+			Usage:   usage,
+		}
+		if delta != nil {
+			chunk.Choices = append(chunk.Choices, chatCompletionChoice{Index: 0, Delta: delta, FinishReason: finish})
+		}
+		b, _ := json.Marshal(chunk)
+		_, _ = fmt.Fprintf(c.w, "data: %s\n\n", b)
+		flusher.Flush()
+	}
+
+	empty := ""
+	send(&chatCompletionMessage{Role: "assistant", Content: &empty}, nil, nil)
+
+	var (
+		answer strings.Builder
+		chunks []*schema.Message
+	)
+	for {
+		msg, err := sr.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// 响应头已经发出，只能在流里报错
+			b, _ := json.Marshal(map[string]any{"error": map[string]any{"message": "stream error: " + err.Error(), "type": "server_error"}})
+			_, _ = fmt.Fprintf(c.w, "data: %s\n\n", b)
+			flusher.Flush()
+			return nil, false
+		}
+		if msg == nil {
+			continue
+		}
+		chunks = append(chunks, msg)
+		if msg.Content == "" {
+			continue
+		}
+		answer.WriteString(msg.Content)
+		content := msg.Content
+		send(&chatCompletionMessage{Content: &content}, nil, nil)
+	}
+
+	full := &schema.Message{Role: schema.Assistant}
+	if len(chunks) > 0 {
+		if m, err := schema.ConcatMessages(chunks); err == nil {
+			full = m
+		}
+	}
+	finish := finishReason(full)
+	var last chatCompletionMessage
+	last.ToolCalls = toolCallsOf(full)
+	send(&last, &finish, nil)
+	if c.req.StreamOptions != nil && c.req.StreamOptions.IncludeUsage {
+		usage := usageOf(full)
+		if usage == nil {
+			usage = &chatCompletionUsage{}
+		}
+		send(nil, nil, usage)
+	}
+	_, _ = fmt.Fprint(c.w, "data: [DONE]\n\n")
+	flusher.Flush()
+	full.Content = answer.String()
+	return full, true
+}
+
+func toolCallsOf(m *schema.Message) []openaiToolCall {
+	var out []openaiToolCall
+	for _, tc := range m.ToolCalls {
+		var call openaiToolCall
+		call.ID = tc.ID
+		call.Type = "function"
+		call.Function.Name = tc.Function.Name
+		call.Function.Arguments = tc.Function.Arguments
+		out = append(out, call)
+	}
+	return out
+}
+
+func finishReason(m *schema.Message) string {
+	if m.ResponseMeta != nil && m.ResponseMeta.FinishReason != "" {
+		return m.ResponseMeta.FinishReason
+	}
+	if len(m.ToolCalls) > 0 {
+		return "tool_calls"
+	}
+	return "stop"
+}
+
+func usageOf(m *schema.Message) *chatCompletionUsage {
+	if m.ResponseMeta == nil || m.ResponseMeta.Usage == nil {
+		return nil
+	}
+	u := m.ResponseMeta.Usage
+	return &chatCompletionUsage{
+		PromptTokens:     u.PromptTokens,
+		CompletionTokens: u.CompletionTokens,
+		TotalTokens:      u.TotalTokens,
+	}
+}
+
+type modelInfo struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+// GET /v1/models：只有当前配置的一个模型；请求里的 model 字段不会切换后端。
+func (s *Server) models(w http.ResponseWriter, r *http.Request) {
+	setOpenAICORS(w, "GET, OPTIONS")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "GET only")
+		return
+	}
+	if s.LLM == nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "server_error", "server misconfig")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"object": "list",
+		"data":   []modelInfo{{ID: s.LLM.Model(), Object: "model", OwnedBy: "eino-mini"}},
+	})
+}
@@ -0,0 +1,95 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/JekYUlll/eino-mini/internal/llm"
+	"github.com/JekYUlll/eino-mini/internal/session"
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+)
+
+// toolCallProvider 总是只回一次工具调用，没有文本。
+type toolCallProvider struct{}
+
+func (toolCallProvider) reply() *schema.Message {
+	return schema.AssistantMessage("", []schema.ToolCall{{
+		ID:       "call_1",
+		Type:     "function",
+		Function: schema.FunctionCall{Name: "search", Arguments: `{"q":"go"}`},
+	}})
+}
+
+func (p toolCallProvider) Generate(context.Context, []session.Message, ...model.Option) (*schema.Message, error) {
+	return p.reply(), nil
+}
+
+func (p toolCallProvider) Stream(context.Context, []session.Message, ...model.Option) (*schema.StreamReader[*schema.Message], error) {
+	return schema.StreamReaderFromArray([]*schema.Message{p.reply()}), nil
+}
+
+func (toolCallProvider) Model() string { return "tools" }
+
+func completionBody(stream bool) map[string]any {
+	return map[string]any{
+		"model":    "any",
+		"stream":   stream,
+		"messages": []map[string]any{{"role": "user", "content": "hi"}},
+	}
+}
+
+// 无状态调用不需要存储；绑定会话时没有存储才报错。
+func TestChatCompletionsWithoutStore(t *testing.T) {
+	s := &Server{LLM: llm.NewFake(llm.FakeConfig{Replies: []string{"hello"}})}
+	mux := http.NewServeMux()
+	s.Register(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for _, stream := range []bool{false, true} {
+		resp := postJSON(t, ts.URL+"/v1/chat/completions", completionBody(stream))
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "hello") {
+			t.Fatalf("stateless (stream=%v): status %d: %s", stream, resp.StatusCode, body)
+		}
+	}
+
+	resp := postJSON(t, ts.URL+"/v1/chat/completions", completionBody(false), conversationHeader, "c1")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("bound without a store: status %d, want 500", resp.StatusCode)
+	}
+}
+
+// 绑定会话时只有工具调用的回复也落库，user 不会没有回复。
+func TestChatCompletionsToolCallsOnly(t *testing.T) {
+	ts, s := newTestServer(t, toolCallProvider{})
+	for _, stream := range []bool{false, true} {
+		convID := s.Store.NewConversationID()
+		resp := postJSON(t, ts.URL+"/v1/chat/completions", completionBody(stream), conversationHeader, convID)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "call_1") {
+			t.Fatalf("stream=%v: status %d: %s", stream, resp.StatusCode, body)
+		}
+
+		msgs, err := s.Store.History(context.Background(), convID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) != 3 || msgs[1].Role != "user" || msgs[2].Role != "assistant" {
+			t.Fatalf("stream=%v: history = %v", stream, roles(msgs))
+		}
+		calls, _ := json.Marshal(msgs[2].ToolCalls)
+		if len(msgs[2].ToolCalls) != 1 || msgs[2].ToolCalls[0].Name != "search" || msgs[2].ParentID != msgs[1].ID {
+			t.Fatalf("stream=%v: reply %+v, tool calls %s", stream, msgs[2], calls)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package httpapi
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/JekYUlll/eino-mini/internal/persona"
+	"github.com/JekYUlll/eino-mini/internal/session"
+	"github.com/cloudwego/eino/components/model"
+)
+
+// 人设只在会话创建时生效：system prompt、模型、工具写进会话元数据，之后按元数据走；
+// 温度不落库，每次调用模型时按会话记录的人设名查配置。
+
+// askConversation 按 askReq 创建（或读取）会话：首轮可以用 persona 选人设、用 system_prompt 自定义 system prompt
+// （两者都给时 system_prompt 覆盖人设的）。会话已经存在但还没有消息（比如先 POST 过 /conversations）时照样写进去；
+// 已经有消息后再传不同的值返回 409，之后改 system prompt 走 PATCH。
+// 失败时已经写好错误响应，返回 ok=false。
+func (s *Server) askConversation(w http.ResponseWriter, r *http.Request, convID string, req askReq) (*session.Conversation, bool) {
+	tmpl := session.Conversation{
+		ID:           convID,
+		Model:        s.LLM.Model(),
+		SystemPrompt: strings.TrimSpace(req.SystemPrompt),
+	}
+	if name := strings.TrimSpace(req.Persona); name != "" {
+		p, ok := s.Personas.Get(name)
+		if !ok {
+			http.Error(w, "unknown persona: "+name, http.StatusBadRequest)
+			return nil, false
+		}
+		tmpl.Persona = p.Name
+		if tmpl.SystemPrompt == "" {
+			tmpl.SystemPrompt = p.SystemPrompt
+		}
+		if p.Model != "" {
+			tmpl.Model = p.Model
+		}
+		tmpl.Tools = p.Tools
+	}
+
+	c, err := s.ensureConversationAs(r, tmpl)
+	if err != nil {
+		writeStoreError(w, err)
+		return nil, false
+	}
+
+	var patch session.ConversationPatch
+	if tmpl.Persona != "" && tmpl.Persona != c.Persona {
+		patch.Persona, patch.Model, patch.Tools = &tmpl.Persona, &tmpl.Model, &tmpl.Tools
+	}
+	if tmpl.SystemPrompt != "" && tmpl.SystemPrompt != c.SystemPrompt {
+		patch.SystemPrompt = &tmpl.SystemPrompt
+	}
+	if patch == (session.ConversationPatch{}) {
+		return c, true
+	}
+	const firstTurnOnly = "persona and system_prompt can only be set on the first turn"
+	if c.MessageCount > 0 {
+		http.Error(w, firstTurnOnly, http.StatusConflict)
+		return nil, false
+	}
+	// 只在还没有消息时改，跟写入第一条消息的请求竞争时由存储判定先后
+	patch.IfEmpty = true
+	c, err = s.Store.UpdateConversation(session.WithoutFence(r.Context()), convID, patch)
+	if errors.Is(err, session.ErrConflict) {
+		http.Error(w, firstTurnOnly, http.StatusConflict)
+		return nil, false
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return nil, false
+	}
+	return c, true
+}
+
+// modelOptions 返回调用模型时按会话附加的选项：人设指定的模型和温度。
+func (s *Server) modelOptions(c *session.Conversation) []model.Option {
+	if c == nil {
+		return nil
+	}
+	var opts []model.Option
+	if c.Model != "" && c.Model != s.LLM.Model() {
+		opts = append(opts, model.WithModel(c.Model))
+	}
+	if p, ok := s.Personas.Get(c.Persona); ok && p.Temperature != nil {
+		opts = append(opts, model.WithTemperature(*p.Temperature))
+	}
+	return opts
+}
+
+type personasResp struct {
+	Personas []persona.Persona `json:"personas"`
+}
+
+// GET /personas：列出可选的人设。
+func (s *Server) personas(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, "GET, OPTIONS")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	out := s.Personas.List()
+	if out == nil {
+		out = []persona.Persona{}
+	}
+	writeJSON(w, http.StatusOK, personasResp{Personas: out})
+}
@@ -0,0 +1,64 @@
+package httpapi
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/JekYUlll/eino-mini/internal/llm"
+	"github.com/JekYUlll/eino-mini/internal/persona"
+	"github.com/JekYUlll/eino-mini/internal/session"
+)
+
+// 会话已经存在但还没有消息时，首轮的 persona / system_prompt 照样生效；有消息之后再换返回 409。
+func TestAskPersonaOnEmptyConversation(t *testing.T) {
+	dir := t.TempDir()
+	spec := `{"system_prompt": "You write Go.", "model": "coder-model", "tools": ["search"]}`
+	if err := os.WriteFile(filepath.Join(dir, "coder.json"), []byte(spec), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	personas, err := persona.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, s := newTestServer(t, llm.NewFake(llm.FakeConfig{Replies: []string{"ok"}}))
+	s.Personas = personas
+
+	ctx := context.Background()
+	convID := s.Store.NewConversationID()
+	if _, err := s.Store.EnsureConversation(ctx, session.Conversation{ID: convID, Model: "fake"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ask(t, ts.URL, askReq{ConversationID: convID, Question: "q1", Persona: "coder"})
+	c, err := s.Store.GetConversation(ctx, convID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Persona != "coder" || c.Model != "coder-model" || c.SystemPrompt != "You write Go." || !slices.Equal(c.Tools, []string{"search"}) {
+		t.Fatalf("conversation = %+v, want the coder persona", c)
+	}
+	msgs, err := s.Store.History(ctx, convID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs[0].Role != "system" || msgs[0].Content != "You write Go." {
+		t.Fatalf("root = %s:%s, want the persona's system prompt", msgs[0].Role, msgs[0].Content)
+	}
+
+	for _, req := range []askReq{
+		{ConversationID: convID, Question: "q2", SystemPrompt: "You write Rust."},
+		{ConversationID: convID, Question: "q2", Persona: "coder", SystemPrompt: "You write Rust."},
+	} {
+		resp := postJSON(t, ts.URL+"/ask", req)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusConflict {
+			t.Fatalf("%+v after the first turn: status %d, want 409", req, resp.StatusCode)
+		}
+	}
+	// 跟首轮一样的值不算修改
+	ask(t, ts.URL, askReq{ConversationID: convID, Question: "q2", Persona: "coder"})
+}
@@ -0,0 +1,273 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/JekYUlll/eino-mini/internal/session"
+)
+
+// 重新生成：对某条 user 消息之前（含）的上下文重新调一次模型，新回复挂在同一个 user 下面、成为当前路径，
+// 旧回复连同之后的轮次留在树上成为分支（GET /conversations/{id}/branches 可以查到，可以切回去）。
+
+type regenerateReq struct {
+	// MessageID 是要重新回答的 user 消息，也可以是某条回复（沿路径往前找到它的 user）；
+	// 为空时取当前路径上最后一条 user 消息。
+	MessageID string `json:"message_id"`
+}
+
+type regenerateResp struct {
+	ConversationID string `json:"conversation_id"`
+	MessageID      string `json:"message_id"` // 被重新回答的 user 消息
+	Answer         string `json:"answer"`
+	BranchID       string `json:"branch_id,omitempty"` // 旧回复所在的分支（旧回复的 ID），之前没有回复时为空
+}
+
+// regenerateTarget 在送给模型的上下文里找到要重新回答的 user 消息，返回截止到它（含）的上下文。
+// 失败时已经写好错误响应，返回 ok=false。
+func (s *Server) regenerateTarget(w http.ResponseWriter, r *http.Request, convID, msgID string) ([]session.Message, string, bool) {
+	msgs, err := s.Store.Load(r.Context(), convID)
+	if err != nil {
+		writeStoreError(w, err)
+		return nil, "", false
+	}
+
+	idx := -1
+	if msgID == "" {
+		for i := len(msgs) - 1; i >= 0; i-- {
+			if msgs[i].Role == "user" {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			http.Error(w, "no user message to regenerate", http.StatusConflict)
+			return nil, "", false
+		}
+		return msgs[:idx+1], msgs[idx].ID, true
+	}
+
+	for i, m := range msgs {
+		if m.ID == msgID {
+			idx = i
+			break
+		}
+	}
+	// 回复是一条链（工具调用、工具结果、最终回复），往前找到它的 user
+	for idx > 0 && msgs[idx].Role != "user" && msgs[idx].Role != "system" {
+		idx--
+	}
+	if idx >= 0 && msgs[idx].Role == "user" {
+		return msgs[:idx+1], msgs[idx].ID, true
+	}
+
+	// 不在上下文里：区分已被裁剪和根本不存在
+	history, err := s.Store.History(r.Context(), convID)
+	if err != nil {
+		writeStoreError(w, err)
+		return nil, "", false
+	}
+	for _, m := range history {
+		if m.ID == msgID {
+			http.Error(w, "message is not a user message or no longer in context", http.StatusConflict)
+			return nil, "", false
+		}
+	}
+	writeStoreError(w, session.ErrMessageNotFound)
+	return nil, "", false
+}
+
+// replaceReply 替换 userID 的回复，冲突时重试；租约已经丢了时不再写，返回 session.ErrLeaseLost。
+func (s *Server) replaceReply(r *http.Request, lease *session.Lease, convID, userID, answer string) (*session.Branch, error) {
+	const maxRetry = 3
+	var (
+		b   *session.Branch
+		err error
+	)
+	for i := 0; i < maxRetry; i++ {
+		if err := lease.Err(); err != nil {
+			return nil, err
+		}
+		b, err = s.Store.ReplaceReply(r.Context(), convID, userID, []session.Message{{Role: "assistant", Content: answer}})
+		if !errors.Is(err, session.ErrConflict) {
+			break
+		}
+	}
+	return b, err
+}
+
+func decodeRegenerateReq(w http.ResponseWriter, r *http.Request) (regenerateReq, bool) {
+	var req regenerateReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return req, false
+	}
+	req.MessageID = strings.TrimSpace(req.MessageID)
+	return req, true
+}
+
+// POST /conversations/{id}/regenerate
+func (s *Server) regenerate(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, "POST, OPTIONS")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	req, ok := decodeRegenerateReq(w, r)
+	if !ok {
+		return
+	}
+	if s.Store == nil || s.LLM == nil {
+		http.Error(w, "server misconfig", http.StatusInternalServerError)
+		return
+	}
+
+	convID := r.PathValue("id")
+	conv, err := s.getOwnedConversation(r, convID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	r, lease, ok := s.lockConversation(w, r, convID)
+	if !ok {
+		return
+	}
+	defer lease.Release()
+
+	history, userID, ok := s.regenerateTarget(w, r, convID, req.MessageID)
+	if !ok {
+		return
+	}
+	resp, err := s.LLM.Generate(r.Context(), history, s.modelOptions(conv)...)
+	if err != nil {
+		http.Error(w, "llm error: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	out := regenerateResp{ConversationID: convID, MessageID: userID, Answer: resp.Content}
+	if resp.Content == "" {
+		// 和流式接口一样，空回答不写，旧回复保持原样
+		writeJSON(w, http.StatusOK, out)
+		return
+	}
+	b, err := s.replaceReply(r, lease, convID, userID, resp.Content)
+	if errors.Is(err, session.ErrUserPruned) {
+		http.Error(w, "message no longer in context", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, session.ErrLeaseLost) || errors.Is(err, session.ErrFenced) {
+		writeStoreError(w, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, "store replace reply error: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	if b != nil {
+		out.BranchID = b.ID
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// POST /conversations/{id}/regenerate/stream：事件与 /ask/stream 相同（meta / delta / done / error），
+// meta 和 done 额外带 message_id，done 带 branch_id。
+func (s *Server) regenerateStream(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, "POST, OPTIONS")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	req, ok := decodeRegenerateReq(w, r)
+	if !ok {
+		return
+	}
+	if s.Store == nil || s.LLM == nil {
+		http.Error(w, "server misconfig", http.StatusInternalServerError)
+		return
+	}
+
+	convID := r.PathValue("id")
+	conv, err := s.getOwnedConversation(r, convID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	r, lease, ok := s.lockConversation(w, r, convID)
+	if !ok {
+		return
+	}
+	defer lease.Release()
+
+	history, userID, ok := s.regenerateTarget(w, r, convID, req.MessageID)
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	setSSEHeaders(w)
+
+	send := func(event string, data any) {
+		_ = writeSSE(w, event, data)
+		flusher.Flush()
+	}
+	send("meta", map[string]string{"conversation_id": convID, "message_id": userID})
+
+	stream, err := s.LLM.Stream(r.Context(), history, s.modelOptions(conv)...)
+	if err != nil {
+		send("error", map[string]string{"error": "llm error: " + err.Error()})
+		return
+	}
+	defer stream.Close()
+
+	deltas := newDeltaWriter(w, flusher)
+	var answer strings.Builder
+	for {
+		msg, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			deltas.flush(true)
+			send("error", map[string]string{"error": "stream error: " + err.Error()})
+			return
+		}
+		if msg == nil || msg.Content == "" {
+			continue
+		}
+		answer.WriteString(msg.Content)
+		deltas.write(msg.Content)
+	}
+	deltas.flush(true)
+
+	// 模型什么都没说时不写空回复，旧回复保持原样
+	done := map[string]string{
+		"answer":          answer.String(),
+		"conversation_id": convID,
+		"message_id":      userID,
+	}
+	if answer.Len() > 0 {
+		b, err := s.replaceReply(r, lease, convID, userID, answer.String())
+		if err != nil {
+			send("error", map[string]string{"error": "store replace reply error: " + err.Error()})
+			return
+		}
+		if b != nil {
+			done["branch_id"] = b.ID
+		}
+	}
+	send("done", done)
+}
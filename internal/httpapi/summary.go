@@ -0,0 +1,58 @@
+package httpapi
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/JekYUlll/eino-mini/internal/llm"
+	"github.com/JekYUlll/eino-mini/internal/session"
+)
+
+// maxSummaryBatch 是一次并入摘要的最多消息数，积压更多时分批处理，避免单次 prompt 过长。
+const maxSummaryBatch = 20
+
+// startSummary 在会话锁释放后异步把被裁剪的消息并入滚动摘要（只针对 summarize 策略的会话）。
+// 同一会话在本进程内同时只跑一个；跨进程的并发由 SaveSummary 的 CAS 兜底，冲突的一方下轮再试。
+func (s *Server) startSummary(convID string, conv *session.Conversation) {
+	if conv == nil || !session.Summarizes(conv.PrunePolicy) {
+		return
+	}
+	if _, busy := s.summarizing.LoadOrStore(convID, struct{}{}); busy {
+		return
+	}
+
+	go func() {
+		defer s.summarizing.Delete(convID)
+		ctx, cancel := context.WithTimeout(context.Background(), getDurationEnv("CHAT_SUMMARY_TIMEOUT", 60*time.Second))
+		defer cancel()
+
+		for {
+			prev, pending, err := s.Store.PendingSummary(ctx, convID)
+			if err != nil {
+				log.Printf("load pending summary for %s failed: %v", convID, err)
+				return
+			}
+			if len(pending) == 0 {
+				return
+			}
+			batch := pending[:min(len(pending), maxSummaryBatch)]
+
+			summary, err := llm.Summarize(ctx, s.LLM, prev, batch)
+			if err != nil || summary == "" {
+				if err != nil {
+					log.Printf("summarize %s failed: %v", convID, err)
+				}
+				return
+			}
+			// 不持会话锁：SaveSummary 自己按 prev 做 CAS
+			if err := s.Store.SaveSummary(session.WithoutFence(ctx), convID, prev, summary, batch); err != nil {
+				if !errors.Is(err, session.ErrConflict) {
+					log.Printf("save summary for %s failed: %v", convID, err)
+				}
+				return
+			}
+		}
+	}()
+}
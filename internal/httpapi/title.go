@@ -0,0 +1,84 @@
+package httpapi
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/JekYUlll/eino-mini/internal/llm"
+	"github.com/JekYUlll/eino-mini/internal/session"
+)
+
+func getDurationEnv(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return def
+	}
+	return d
+}
+
+func autoTitleEnabled() bool {
+	switch strings.ToLower(os.Getenv("CHAT_AUTO_TITLE")) {
+	case "0", "false", "off", "no":
+		return false
+	}
+	return true
+}
+
+// startTitle 在 assistant 落库后异步生成会话标题（只针对还没有标题的会话）。
+// 生成不依赖请求的 context，请求结束后也会继续写回元数据；
+// 返回的 channel 在成功时收到标题，失败或无需生成时直接关闭。
+func (s *Server) startTitle(convID string, conv *session.Conversation, question, answer string) <-chan string {
+	ch := make(chan string, 1)
+	if conv == nil || conv.Title != "" || !autoTitleEnabled() {
+		close(ch)
+		return ch
+	}
+
+	go func() {
+		defer close(ch)
+		ctx, cancel := context.WithTimeout(context.Background(), getDurationEnv("CHAT_TITLE_TIMEOUT", 15*time.Second))
+		defer cancel()
+
+		title, err := llm.GenerateTitle(ctx, s.LLM, question, answer)
+		if err != nil || title == "" {
+			if err != nil {
+				log.Printf("title generation for %s failed: %v", convID, err)
+			}
+			return
+		}
+
+		// 生成期间用户可能已经手动改过标题，不要覆盖
+		cur, err := s.Store.GetConversation(ctx, convID)
+		if err != nil || cur.Title != "" {
+			return
+		}
+		// 不持会话锁，标题只改元数据里的一个字段
+		if _, err := s.Store.UpdateConversation(session.WithoutFence(ctx), convID, session.ConversationPatch{Title: &title}); err != nil {
+			log.Printf("save title for %s failed: %v", convID, err)
+			return
+		}
+		ch <- title
+	}()
+	return ch
+}
+
+// waitTitle 最多等 CHAT_TITLE_WAIT（默认 5s）拿标题，超时返回空串（标题仍会在后台写回）。
+func waitTitle(ctx context.Context, ch <-chan string) string {
+	t := time.NewTimer(getDurationEnv("CHAT_TITLE_WAIT", 5*time.Second))
+	defer t.Stop()
+	select {
+	case title := <-ch:
+		return title
+	case <-t.C:
+		return ""
+	case <-ctx.Done():
+		return ""
+	}
+}
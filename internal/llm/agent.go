@@ -1,3 +1,264 @@
 package llm
 
-// TODO:
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/JekYUlll/eino-mini/internal/session"
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/components/tool"
+	"github.com/cloudwego/eino/schema"
+	"github.com/google/uuid"
+)
+
+// maxToolOutputRunes 是单次工具结果写回上下文的上限，超出部分截断。
+const maxToolOutputRunes = 8000
+
+// Agent 是 ReAct 风格的工具调用循环：模型返回 tool_calls 时依次执行工具，
+// 把结果作为 tool 消息喂回去，直到模型给出最终回复；超过 maxSteps 步后禁止再调用工具，逼模型作答。
+// 工具通过 model.WithTools 按次传给模型，Provider 本身不需要绑定工具。
+type Agent struct {
+	provider Provider
+	tools    map[string]tool.InvokableTool
+	infos    []*schema.ToolInfo
+	maxSteps int
+	opts     []model.Option // 每次调用模型都带上的选项（模型名、温度等）
+}
+
+// AgentResult 是一次运行的结果。
+type AgentResult struct {
+	// Messages 是本轮新增的消息（带 tool_calls 的 assistant、tool 结果、最终回复），
+	// 按顺序排列，可以直接交给 Store.InsertReply。
+	Messages []session.Message
+	Answer   string
+	Steps    int
+}
+
+// AgentEvents 是 Stream 过程中的回调，全部可选，在调用 Stream 的 goroutine 里同步执行。
+type AgentEvents struct {
+	OnStep       func(step int)                        // 每次调用模型之前
+	OnDelta      func(delta string)                    // 模型输出的文本增量
+	OnToolCall   func(step int, call session.ToolCall) // 执行工具之前
+	OnToolResult func(step int, result ToolResult)     // 工具执行完之后
+}
+
+// ToolResult 是一次工具调用的结果；Output 已按 maxToolOutputRunes 截断，出错时是 "error: ..."。
+type ToolResult struct {
+	Call     session.ToolCall
+	Output   string
+	Failed   bool
+	Duration time.Duration
+}
+
+// NewAgent 构造 Agent；步数上限取 CHAT_AGENT_MAX_STEPS（默认 5）。
+func NewAgent(ctx context.Context, p Provider, tools []tool.InvokableTool) (*Agent, error) {
+	a := &Agent{
+		provider: p,
+		tools:    make(map[string]tool.InvokableTool, len(tools)),
+		maxSteps: 5,
+	}
+	if n, err := strconv.Atoi(os.Getenv("CHAT_AGENT_MAX_STEPS")); err == nil && n > 0 {
+		a.maxSteps = n
+	}
+	for _, t := range tools {
+		info, err := t.Info(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := a.tools[info.Name]; dup {
+			return nil, fmt.Errorf("duplicate tool %q", info.Name)
+		}
+		a.tools[info.Name] = t
+		a.infos = append(a.infos, info)
+	}
+	return a, nil
+}
+
+// Tools 返回可用工具的描述。
+func (a *Agent) Tools() []*schema.ToolInfo {
+	return a.infos
+}
+
+// Filter 返回只保留 allow 里工具的 Agent（共享工具实例）；allow 为空时返回 a 本身。
+// allow 的每一项是工具名或 path.Match 通配（如 "fs__*"）。
+func (a *Agent) Filter(allow []string) *Agent {
+	if len(allow) == 0 {
+		return a
+	}
+	out := &Agent{provider: a.provider, tools: make(map[string]tool.InvokableTool), maxSteps: a.maxSteps, opts: a.opts}
+	for _, info := range a.infos {
+		if MatchTool(allow, info.Name) {
+			out.tools[info.Name] = a.tools[info.Name]
+			out.infos = append(out.infos, info)
+		}
+	}
+	return out
+}
+
+// WithOptions 返回每次调用模型都额外带上 opts 的 Agent（共享工具实例）；opts 为空时返回 a 本身。
+func (a *Agent) WithOptions(opts ...model.Option) *Agent {
+	if len(opts) == 0 {
+		return a
+	}
+	out := *a
+	out.opts = append(slices.Clone(a.opts), opts...)
+	return &out
+}
+
+// MatchTool 报告 name 是否匹配 patterns 中的任意一项。
+func MatchTool(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Run 用 Generate 驱动工具循环。
+func (a *Agent) Run(ctx context.Context, history []session.Message) (*AgentResult, error) {
+	return a.run(ctx, history, AgentEvents{}, func(ctx context.Context, h []session.Message, opts []model.Option) (*schema.Message, error) {
+		return a.provider.Generate(ctx, h, opts...)
+	})
+}
+
+// Stream 用 Stream 驱动工具循环，进度（步数、文本增量、工具调用和结果）通过 ev 回调。
+func (a *Agent) Stream(ctx context.Context, history []session.Message, ev AgentEvents) (*AgentResult, error) {
+	return a.run(ctx, history, ev, func(ctx context.Context, h []session.Message, opts []model.Option) (*schema.Message, error) {
+		sr, err := a.provider.Stream(ctx, h, opts...)
+		if err != nil {
+			return nil, err
+		}
+		defer sr.Close()
+
+		var chunks []*schema.Message
+		for {
+			chunk, err := sr.Recv()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if chunk == nil {
+				continue
+			}
+			if chunk.Content != "" && ev.OnDelta != nil {
+				ev.OnDelta(chunk.Content)
+			}
+			chunks = append(chunks, chunk)
+		}
+		if len(chunks) == 0 {
+			return schema.AssistantMessage("", nil), nil
+		}
+		return schema.ConcatMessages(chunks)
+	})
+}
+
+type stepFunc func(ctx context.Context, history []session.Message, opts []model.Option) (*schema.Message, error)
+
+func (a *Agent) run(ctx context.Context, history []session.Message, ev AgentEvents, step stepFunc) (*AgentResult, error) {
+	history = append([]session.Message(nil), history...)
+	res := &AgentResult{}
+
+	for {
+		res.Steps++
+		if ev.OnStep != nil {
+			ev.OnStep(res.Steps)
+		}
+		// 一个工具都没有时不传 tools：openai 不接受空数组
+		opts := slices.Clone(a.opts)
+		if len(a.infos) > 0 {
+			opts = append(opts, model.WithTools(a.infos))
+			if res.Steps > a.maxSteps {
+				opts = append(opts, model.WithToolChoice(schema.ToolChoiceForbidden))
+			}
+		}
+
+		resp, err := step(ctx, history, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		msg := FromSchema(resp)
+		msg.Role = "assistant"
+		if res.Steps > a.maxSteps {
+			msg.ToolCalls = nil
+		}
+		for i := range msg.ToolCalls {
+			if msg.ToolCalls[i].ID == "" {
+				msg.ToolCalls[i].ID = "call_" + uuid.NewString()
+			}
+		}
+		history = append(history, msg)
+		res.Messages = append(res.Messages, msg)
+
+		if len(msg.ToolCalls) == 0 {
+			res.Answer = msg.Text()
+			return res, nil
+		}
+
+		for _, tc := range msg.ToolCalls {
+			if ev.OnToolCall != nil {
+				ev.OnToolCall(res.Steps, tc)
+			}
+			r := a.invoke(ctx, tc)
+			if ev.OnToolResult != nil {
+				ev.OnToolResult(res.Steps, r)
+			}
+			toolMsg := session.Message{Role: "tool", Content: r.Output, ToolCallID: tc.ID, ToolName: tc.Name}
+			history = append(history, toolMsg)
+			res.Messages = append(res.Messages, toolMsg)
+		}
+	}
+}
+
+// invoke 执行一次工具调用。出错时把错误作为结果返回给模型，让它自己决定重试还是换个说法。
+func (a *Agent) invoke(ctx context.Context, tc session.ToolCall) ToolResult {
+	res := ToolResult{Call: tc}
+	t, ok := a.tools[tc.Name]
+	if !ok {
+		res.Output, res.Failed = fmt.Sprintf("error: unknown tool %q", tc.Name), true
+		return res
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, toolTimeout())
+	defer cancel()
+
+	args := tc.Arguments
+	if args == "" {
+		args = "{}"
+	}
+	start := time.Now()
+	out, err := t.InvokableRun(ctx, args)
+	res.Duration = time.Since(start)
+	if err != nil {
+		res.Output, res.Failed = "error: "+err.Error(), true
+		return res
+	}
+	res.Output, _ = TruncateRunes(out, maxToolOutputRunes)
+	return res
+}
+
+// TruncateRunes 按字符截断到 n 个，截断时在末尾加标记并返回 true。
+func TruncateRunes(s string, n int) (string, bool) {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n]) + "...(truncated)", true
+	}
+	return s, false
+}
+
+// toolTimeout 是单次工具调用的超时，CHAT_TOOL_TIMEOUT（默认 30s）。
+func toolTimeout() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("CHAT_TOOL_TIMEOUT")); err == nil && d > 0 {
+		return d
+	}
+	return 30 * time.Second
+}
@@ -2,81 +2,59 @@ package llm
 
 import (
 	"context"
-	"fmt"
 	"os"
 	"strings"
 
 	"github.com/JekYUlll/eino-mini/internal/session"
-	"github.com/cloudwego/eino-ext/components/model/openai"
+	"github.com/cloudwego/eino/components/model"
 	"github.com/cloudwego/eino/schema"
 )
 
 func float32Ptr(v float32) *float32 { return &v }
 
+// Client 包装一个 Provider，本身也实现 Provider。
 type Client struct {
-	model *openai.ChatModel
+	provider Provider
 }
 
+// New 按 LLM_PROVIDER 选择后端（默认 openai）。
 func New(ctx context.Context) (*Client, error) {
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	baseURL := os.Getenv("OPENAI_BASE_URL")
-	model := os.Getenv("OPENAI_MODEL")
-	if apiKey == "" || baseURL == "" || model == "" {
-		return nil, fmt.Errorf("missing env: OPENAI_API_KEY / OPENAI_BASE_URL / OPENAI_MODEL")
+	name := strings.TrimSpace(os.Getenv("LLM_PROVIDER"))
+	if name == "" {
+		name = "openai"
 	}
-
-	cm, err := openai.NewChatModel(ctx, &openai.ChatModelConfig{
-		APIKey:      apiKey,
-		BaseURL:     baseURL,
-		Model:       model,
-		Temperature: float32Ptr(0.2),
-	})
+	p, err := NewProvider(ctx, name)
 	if err != nil {
 		return nil, err
 	}
+	return NewClient(p), nil
+}
 
-	return &Client{model: cm}, nil
+// NewClient 用给定的 Provider 构造 Client（测试或自定义后端）。
+func NewClient(p Provider) *Client {
+	return &Client{provider: p}
 }
 
 func (c *Client) Ask(ctx context.Context, question string) (string, error) {
-	msgs := []*schema.Message{
-		{Role: schema.System, Content: "You are a helpful backend assistant. Answer concisely."},
-		{Role: schema.User, Content: question},
+	history := []session.Message{
+		{Role: "system", Content: "You are a helpful backend assistant. Answer concisely."},
+		{Role: "user", Content: question},
 	}
-	resp, err := c.model.Generate(ctx, msgs)
+	resp, err := c.provider.Generate(ctx, history)
 	if err != nil {
 		return "", err
 	}
 	return resp.Content, nil
 }
 
-func (c *Client) AskWithHistory(ctx context.Context, history []session.Message) (string, error) {
-	msgs := buildMessages(history)
-
-	resp, err := c.model.Generate(ctx, msgs)
-	if err != nil {
-		return "", err
-	}
-	return resp.Content, nil
+func (c *Client) Model() string {
+	return c.provider.Model()
 }
 
-func (c *Client) AskWithHistoryStream(ctx context.Context, history []session.Message) (*schema.StreamReader[*schema.Message], error) {
-	msgs := buildMessages(history)
-	return c.model.Stream(ctx, msgs)
+func (c *Client) Generate(ctx context.Context, history []session.Message, opts ...model.Option) (*schema.Message, error) {
+	return c.provider.Generate(ctx, history, opts...)
 }
 
-func buildMessages(history []session.Message) []*schema.Message {
-	msgs := make([]*schema.Message, 0, len(history))
-	for _, m := range history {
-		role := strings.ToLower(m.Role)
-		if role != string(schema.System) && role != string(schema.User) &&
-			role != string(schema.Assistant) && role != string(schema.Tool) {
-			role = string(schema.User)
-		}
-		msgs = append(msgs, &schema.Message{
-			Role:    schema.RoleType(role),
-			Content: m.Content,
-		})
-	}
-	return msgs
+func (c *Client) Stream(ctx context.Context, history []session.Message, opts ...model.Option) (*schema.StreamReader[*schema.Message], error) {
+	return c.provider.Stream(ctx, history, opts...)
 }
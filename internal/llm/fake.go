@@ -0,0 +1,186 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+)
+
+func init() {
+	Register("fake", func(ctx context.Context) (Provider, error) {
+		return NewFake(fakeConfigFromEnv()), nil
+	})
+}
+
+// FakeConfig 描述 fake 模型的脚本，全部字段可选。
+type FakeConfig struct {
+	// Replies 为空时回显最后一条 user 消息；否则按调用顺序循环返回。
+	// 形如 `call:<tool> <json 参数>` 的回复在请求带了工具时变成一次工具调用，用来离线演示 agent。
+	Replies []string
+	// ChunkSize 是流式输出每个分片的字符数（按 rune 计），<=0 表示整段一次返回。
+	ChunkSize int
+	// ChunkDelay 是每个分片之前的等待时间，用来模拟首包/逐字延迟。
+	ChunkDelay time.Duration
+	// ErrorAfter > 0 时，流式输出在发送这么多分片后注入 Err；
+	// Generate 在 ErrorAfter > 0 时直接返回 Err。
+	ErrorAfter int
+	Err        error
+}
+
+// NewFake 构造一个确定性的、不联网的 Provider，用于离线测试和演示。
+func NewFake(cfg FakeConfig) Provider {
+	if cfg.ErrorAfter > 0 && cfg.Err == nil {
+		cfg.Err = errors.New("fake: injected error")
+	}
+	return newChatProvider(&fakeModel{cfg: cfg}, "fake")
+}
+
+// fakeConfigFromEnv 读取：
+// FAKE_REPLIES（用 "||" 分隔）/ FAKE_CHUNK_SIZE / FAKE_CHUNK_DELAY / FAKE_ERROR_AFTER / FAKE_ERROR
+func fakeConfigFromEnv() FakeConfig {
+	cfg := FakeConfig{ChunkSize: 4}
+	if v := os.Getenv("FAKE_REPLIES"); v != "" {
+		cfg.Replies = strings.Split(v, "||")
+	}
+	if n, err := strconv.Atoi(os.Getenv("FAKE_CHUNK_SIZE")); err == nil {
+		cfg.ChunkSize = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("FAKE_CHUNK_DELAY")); err == nil && d > 0 {
+		cfg.ChunkDelay = d
+	}
+	if n, err := strconv.Atoi(os.Getenv("FAKE_ERROR_AFTER")); err == nil && n > 0 {
+		cfg.ErrorAfter = n
+	}
+	if v := os.Getenv("FAKE_ERROR"); v != "" {
+		cfg.Err = errors.New(v)
+	}
+	return cfg
+}
+
+// fakeModel 实现 BaseChatModel：
+// 没有脚本时原样回显最后一条 user 消息，有脚本时按顺序循环返回。
+type fakeModel struct {
+	cfg FakeConfig
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (m *fakeModel) reply(input []*schema.Message) string {
+	if len(m.cfg.Replies) > 0 {
+		m.mu.Lock()
+		r := m.cfg.Replies[m.calls%len(m.cfg.Replies)]
+		m.calls++
+		m.mu.Unlock()
+		return r
+	}
+	for i := len(input) - 1; i >= 0; i-- {
+		if input[i].Role == schema.User {
+			return input[i].Content
+		}
+	}
+	return ""
+}
+
+// toolCall 把 `call:<tool> <json 参数>` 形式的回复解析成工具调用；请求没带工具或禁止调用时返回 nil。
+func (m *fakeModel) toolCall(reply string, opts []model.Option) *schema.Message {
+	spec, ok := strings.CutPrefix(reply, "call:")
+	if !ok {
+		return nil
+	}
+	co := model.GetCommonOptions(nil, opts...)
+	if len(co.Tools) == 0 || (co.ToolChoice != nil && *co.ToolChoice == schema.ToolChoiceForbidden) {
+		return nil
+	}
+	name, args, _ := strings.Cut(strings.TrimSpace(spec), " ")
+	if args = strings.TrimSpace(args); args == "" {
+		args = "{}"
+	}
+	m.mu.Lock()
+	id := "call_fake_" + strconv.Itoa(m.calls)
+	m.mu.Unlock()
+	return schema.AssistantMessage("", []schema.ToolCall{{
+		Index:    new(int),
+		ID:       id,
+		Type:     "function",
+		Function: schema.FunctionCall{Name: name, Arguments: args},
+	}})
+}
+
+func (m *fakeModel) Generate(ctx context.Context, input []*schema.Message, opts ...model.Option) (*schema.Message, error) {
+	if m.cfg.ErrorAfter > 0 {
+		return nil, m.cfg.Err
+	}
+	if err := sleepCtx(ctx, m.cfg.ChunkDelay); err != nil {
+		return nil, err
+	}
+	reply := m.reply(input)
+	if msg := m.toolCall(reply, opts); msg != nil {
+		return msg, nil
+	}
+	return schema.AssistantMessage(reply, nil), nil
+}
+
+func (m *fakeModel) Stream(ctx context.Context, input []*schema.Message, opts ...model.Option) (*schema.StreamReader[*schema.Message], error) {
+	reply := m.reply(input)
+	if msg := m.toolCall(reply, opts); msg != nil {
+		return schema.StreamReaderFromArray([]*schema.Message{msg}), nil
+	}
+	chunks := splitRunes(reply, m.cfg.ChunkSize)
+
+	sr, sw := schema.Pipe[*schema.Message](0)
+	go func() {
+		defer sw.Close()
+		for i, c := range chunks {
+			if m.cfg.ErrorAfter > 0 && i >= m.cfg.ErrorAfter {
+				sw.Send(nil, m.cfg.Err)
+				return
+			}
+			if err := sleepCtx(ctx, m.cfg.ChunkDelay); err != nil {
+				sw.Send(nil, err)
+				return
+			}
+			if closed := sw.Send(schema.AssistantMessage(c, nil), nil); closed {
+				return
+			}
+		}
+		if m.cfg.ErrorAfter > 0 && len(chunks) <= m.cfg.ErrorAfter {
+			sw.Send(nil, m.cfg.Err)
+		}
+	}()
+	return sr, nil
+}
+
+func splitRunes(s string, size int) []string {
+	r := []rune(s)
+	if size <= 0 || len(r) <= size {
+		return []string{s}
+	}
+	out := make([]string, 0, (len(r)+size-1)/size)
+	for i := 0; i < len(r); i += size {
+		end := min(i+size, len(r))
+		out = append(out, string(r[i:end]))
+	}
+	return out
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,206 @@
+package llm
+
+import (
+	"strings"
+
+	"github.com/JekYUlll/eino-mini/internal/session"
+	"github.com/cloudwego/eino/schema"
+)
+
+// session.Message 和 schema.Message 的互相转换。
+// 多模态内容按角色放到 eino 对应的字段：user → UserInputMultiContent，assistant → AssistantGenMultiContent，
+// 其余角色走（已废弃但仍被支持的）MultiContent。有 Parts 时不再填 Content，openai 不允许两者同时出现。
+
+// buildMessages 转换整段历史。后面没有跟着工具结果的工具调用（比如绑定会话的 /v1/chat/completions
+// 只存下了调用，结果在客户端那边）去掉调用只留文本，模型接口会拒绝没有结果的调用。
+func buildMessages(history []session.Message) []*schema.Message {
+	msgs := make([]*schema.Message, 0, len(history))
+	for i, m := range history {
+		if len(m.ToolCalls) > 0 && (i+1 == len(history) || history[i+1].Role != string(schema.Tool)) {
+			m.ToolCalls = nil
+		}
+		msgs = append(msgs, toSchema(m))
+	}
+	return msgs
+}
+
+func toSchema(m session.Message) *schema.Message {
+	role := strings.ToLower(m.Role)
+	if role != string(schema.System) && role != string(schema.User) &&
+		role != string(schema.Assistant) && role != string(schema.Tool) {
+		role = string(schema.User)
+	}
+	msg := &schema.Message{
+		Role:       schema.RoleType(role),
+		Content:    m.Content,
+		Name:       m.Name,
+		ToolCallID: m.ToolCallID,
+		ToolName:   m.ToolName,
+	}
+	for _, tc := range m.ToolCalls {
+		typ := tc.Type
+		if typ == "" {
+			typ = "function"
+		}
+		msg.ToolCalls = append(msg.ToolCalls, schema.ToolCall{
+			ID:       tc.ID,
+			Type:     typ,
+			Function: schema.FunctionCall{Name: tc.Name, Arguments: tc.Arguments},
+		})
+	}
+	if len(m.Parts) == 0 {
+		return msg
+	}
+
+	msg.Content = ""
+	switch msg.Role {
+	case schema.User:
+		for _, p := range m.Parts {
+			msg.UserInputMultiContent = append(msg.UserInputMultiContent, inputPart(p))
+		}
+	case schema.Assistant:
+		for _, p := range m.Parts {
+			msg.AssistantGenMultiContent = append(msg.AssistantGenMultiContent, outputPart(p))
+		}
+	default:
+		for _, p := range m.Parts {
+			msg.MultiContent = append(msg.MultiContent, legacyPart(p))
+		}
+	}
+	return msg
+}
+
+func partCommon(p session.ContentPart) schema.MessagePartCommon {
+	var c schema.MessagePartCommon
+	if p.URL != "" {
+		c.URL = &p.URL
+	}
+	if p.Data != "" {
+		c.Base64Data = &p.Data
+	}
+	c.MIMEType = p.MIMEType
+	return c
+}
+
+func inputPart(p session.ContentPart) schema.MessageInputPart {
+	out := schema.MessageInputPart{Type: schema.ChatMessagePartType(p.Type), Text: p.Text}
+	switch p.Type {
+	case session.PartImage:
+		out.Image = &schema.MessageInputImage{MessagePartCommon: partCommon(p), Detail: schema.ImageURLDetail(p.Detail)}
+	case session.PartAudio:
+		out.Audio = &schema.MessageInputAudio{MessagePartCommon: partCommon(p)}
+	case session.PartVideo:
+		out.Video = &schema.MessageInputVideo{MessagePartCommon: partCommon(p)}
+	case session.PartFile:
+		out.File = &schema.MessageInputFile{MessagePartCommon: partCommon(p)}
+	}
+	return out
+}
+
+func outputPart(p session.ContentPart) schema.MessageOutputPart {
+	out := schema.MessageOutputPart{Type: schema.ChatMessagePartType(p.Type), Text: p.Text}
+	switch p.Type {
+	case session.PartImage:
+		out.Image = &schema.MessageOutputImage{MessagePartCommon: partCommon(p)}
+	case session.PartAudio:
+		out.Audio = &schema.MessageOutputAudio{MessagePartCommon: partCommon(p)}
+	case session.PartVideo:
+		out.Video = &schema.MessageOutputVideo{MessagePartCommon: partCommon(p)}
+	}
+	return out
+}
+
+// legacyPart 只能表达 URL；base64 数据按 data URL 拼进去。
+func legacyPart(p session.ContentPart) schema.ChatMessagePart {
+	out := schema.ChatMessagePart{Type: schema.ChatMessagePartType(p.Type), Text: p.Text}
+	url := p.URL
+	if url == "" && p.Data != "" {
+		url = "data:" + p.MIMEType + ";base64," + p.Data
+	}
+	switch p.Type {
+	case session.PartImage:
+		out.ImageURL = &schema.ChatMessageImageURL{URL: url, Detail: schema.ImageURLDetail(p.Detail), MIMEType: p.MIMEType}
+	case session.PartAudio:
+		out.AudioURL = &schema.ChatMessageAudioURL{URL: url, MIMEType: p.MIMEType}
+	case session.PartVideo:
+		out.VideoURL = &schema.ChatMessageVideoURL{URL: url, MIMEType: p.MIMEType}
+	case session.PartFile:
+		out.FileURL = &schema.ChatMessageFileURL{URL: url, MIMEType: p.MIMEType}
+	}
+	return out
+}
+
+// FromSchema 把模型返回的消息转成可持久化的 session.Message（不含 ID / ParentID / CreatedAt）。
+func FromSchema(msg *schema.Message) session.Message {
+	m := session.Message{
+		Role:       string(msg.Role),
+		Content:    msg.Content,
+		Name:       msg.Name,
+		ToolCallID: msg.ToolCallID,
+		ToolName:   msg.ToolName,
+	}
+	for _, tc := range msg.ToolCalls {
+		m.ToolCalls = append(m.ToolCalls, session.ToolCall{
+			ID:        tc.ID,
+			Type:      tc.Type,
+			Name:      tc.Function.Name,
+			Arguments: tc.Function.Arguments,
+		})
+	}
+	for _, p := range msg.UserInputMultiContent {
+		cp := session.ContentPart{Type: string(p.Type), Text: p.Text}
+		switch {
+		case p.Image != nil:
+			fillPart(&cp, p.Image.MessagePartCommon)
+			cp.Detail = string(p.Image.Detail)
+		case p.Audio != nil:
+			fillPart(&cp, p.Audio.MessagePartCommon)
+		case p.Video != nil:
+			fillPart(&cp, p.Video.MessagePartCommon)
+		case p.File != nil:
+			fillPart(&cp, p.File.MessagePartCommon)
+		}
+		m.Parts = append(m.Parts, cp)
+	}
+	for _, p := range msg.AssistantGenMultiContent {
+		cp := session.ContentPart{Type: string(p.Type), Text: p.Text}
+		switch {
+		case p.Image != nil:
+			fillPart(&cp, p.Image.MessagePartCommon)
+		case p.Audio != nil:
+			fillPart(&cp, p.Audio.MessagePartCommon)
+		case p.Video != nil:
+			fillPart(&cp, p.Video.MessagePartCommon)
+		}
+		m.Parts = append(m.Parts, cp)
+	}
+	for _, p := range msg.MultiContent {
+		cp := session.ContentPart{Type: string(p.Type), Text: p.Text}
+		switch {
+		case p.ImageURL != nil:
+			cp.URL, cp.MIMEType, cp.Detail = p.ImageURL.URL, p.ImageURL.MIMEType, string(p.ImageURL.Detail)
+		case p.AudioURL != nil:
+			cp.URL, cp.MIMEType = p.AudioURL.URL, p.AudioURL.MIMEType
+		case p.VideoURL != nil:
+			cp.URL, cp.MIMEType = p.VideoURL.URL, p.VideoURL.MIMEType
+		case p.FileURL != nil:
+			cp.URL, cp.MIMEType = p.FileURL.URL, p.FileURL.MIMEType
+		}
+		m.Parts = append(m.Parts, cp)
+	}
+	// 有多模态内容时 Content 存文本部分的拼接，列表展示和 token 估算不用再解析 Parts
+	if len(m.Parts) > 0 && m.Content == "" {
+		m.Content = m.Text()
+	}
+	return m
+}
+
+func fillPart(cp *session.ContentPart, c schema.MessagePartCommon) {
+	if c.URL != nil {
+		cp.URL = *c.URL
+	}
+	if c.Base64Data != nil {
+		cp.Data = *c.Base64Data
+	}
+	cp.MIMEType = c.MIMEType
+}
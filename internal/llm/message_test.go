@@ -0,0 +1,34 @@
+package llm
+
+import (
+	"testing"
+
+	"github.com/JekYUlll/eino-mini/internal/session"
+)
+
+// 后面跟着工具结果的调用原样保留，没有结果的调用去掉。
+func TestBuildMessagesToolCalls(t *testing.T) {
+	call := []session.ToolCall{{ID: "call_1", Name: "search", Arguments: "{}"}}
+	history := []session.Message{
+		{Role: "user", Content: "q1"},
+		{Role: "assistant", ToolCalls: call},
+		{Role: "tool", Content: "r1", ToolCallID: "call_1", ToolName: "search"},
+		{Role: "assistant", Content: "a1"},
+		{Role: "user", Content: "q2"},
+		{Role: "assistant", Content: "let me look", ToolCalls: call},
+		{Role: "user", Content: "q3"},
+		{Role: "assistant", ToolCalls: call},
+	}
+	msgs := buildMessages(history)
+	for i, want := range []int{0, 1, 0, 0, 0, 0, 0, 0} {
+		if got := len(msgs[i].ToolCalls); got != want {
+			t.Errorf("message %d: %d tool calls, want %d", i, got, want)
+		}
+	}
+	if msgs[5].Content != "let me look" {
+		t.Errorf("dropping the calls lost the text: %q", msgs[5].Content)
+	}
+	if len(history[5].ToolCalls) != 1 {
+		t.Error("buildMessages modified the history")
+	}
+}
@@ -0,0 +1,308 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+)
+
+func init() {
+	Register("ollama", newOllamaProvider)
+}
+
+// newOllamaProvider 走本地 Ollama 风格的 HTTP 接口（POST /api/chat，流式为 NDJSON）。
+func newOllamaProvider(ctx context.Context) (Provider, error) {
+	baseURL := strings.TrimRight(os.Getenv("OLLAMA_BASE_URL"), "/")
+	if baseURL == "" {
+		baseURL = "http://127.0.0.1:11434"
+	}
+	modelName := os.Getenv("OLLAMA_MODEL")
+	if modelName == "" {
+		return nil, fmt.Errorf("missing env: OLLAMA_MODEL")
+	}
+	return newChatProvider(&ollamaModel{
+		baseURL:     baseURL,
+		model:       modelName,
+		temperature: 0.2,
+		hc:          http.DefaultClient,
+	}, modelName), nil
+}
+
+type ollamaModel struct {
+	baseURL     string
+	model       string
+	temperature float32
+	hc          *http.Client
+}
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Images    []string         `json:"images,omitempty"` // base64，不带 data URL 前缀
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+	// 工具结果对应的调用；Ollama 按 tool_name 认，tool_call_id 给兼容 OpenAI 字段的实现
+	ToolName   string `json:"tool_name,omitempty"`
+	ToolCallID string `json:"tool_call_id,omitempty"`
+}
+
+// Ollama 的工具调用没有 ID，参数是 JSON 对象而不是字符串。
+type ollamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+type ollamaTool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string `json:"name"`
+		Description string `json:"description,omitempty"`
+		Parameters  any    `json:"parameters,omitempty"`
+	} `json:"function"`
+}
+
+type ollamaChatReq struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Tools    []ollamaTool    `json:"tools,omitempty"`
+	Stream   bool            `json:"stream"`
+	Options  map[string]any  `json:"options,omitempty"`
+}
+
+type ollamaChatResp struct {
+	Message ollamaMessage `json:"message"`
+	Done    bool          `json:"done"`
+	Error   string        `json:"error,omitempty"`
+}
+
+func (m *ollamaModel) Generate(ctx context.Context, input []*schema.Message, opts ...model.Option) (*schema.Message, error) {
+	resp, err := m.do(ctx, input, false, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var out ollamaChatResp
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	if out.Error != "" {
+		return nil, fmt.Errorf("ollama: %s", out.Error)
+	}
+	return out.Message.toSchema(), nil
+}
+
+func (m ollamaMessage) toSchema() *schema.Message {
+	var calls []schema.ToolCall
+	for i, tc := range m.ToolCalls {
+		args := string(tc.Function.Arguments)
+		if args == "" || args == "null" {
+			args = "{}"
+		}
+		calls = append(calls, schema.ToolCall{
+			Index:    &i,
+			Type:     "function",
+			Function: schema.FunctionCall{Name: tc.Function.Name, Arguments: args},
+		})
+	}
+	return schema.AssistantMessage(m.Content, calls)
+}
+
+// setParts 把多模态片段放进 Ollama 的字段：文本拼进 content，图片放进 images。
+// Ollama 只收 base64 的图片，图片 URL（data URL 除外）和音频、视频、文件片段直接报错，不悄悄丢掉。
+func (om *ollamaMessage) setParts(msg *schema.Message) error {
+	var texts []string
+	if om.Content != "" {
+		texts = append(texts, om.Content)
+	}
+	add := func(typ schema.ChatMessagePartType, text string, img *schema.MessagePartCommon) error {
+		switch typ {
+		case schema.ChatMessagePartTypeText:
+			if text != "" {
+				texts = append(texts, text)
+			}
+			return nil
+		case schema.ChatMessagePartTypeImageURL:
+			data, err := ollamaImage(img)
+			if err != nil {
+				return err
+			}
+			om.Images = append(om.Images, data)
+			return nil
+		default:
+			return fmt.Errorf("ollama: unsupported content part %q", typ)
+		}
+	}
+
+	for _, p := range msg.UserInputMultiContent {
+		var img *schema.MessagePartCommon
+		if p.Image != nil {
+			img = &p.Image.MessagePartCommon
+		}
+		if err := add(p.Type, p.Text, img); err != nil {
+			return err
+		}
+	}
+	for _, p := range msg.AssistantGenMultiContent {
+		var img *schema.MessagePartCommon
+		if p.Image != nil {
+			img = &p.Image.MessagePartCommon
+		}
+		if err := add(p.Type, p.Text, img); err != nil {
+			return err
+		}
+	}
+	for _, p := range msg.MultiContent {
+		var img *schema.MessagePartCommon
+		if p.ImageURL != nil {
+			img = &schema.MessagePartCommon{URL: &p.ImageURL.URL}
+		}
+		if err := add(p.Type, p.Text, img); err != nil {
+			return err
+		}
+	}
+	om.Content = strings.Join(texts, "\n")
+	return nil
+}
+
+// ollamaImage 取图片片段的 base64 数据：Base64Data，或者 data:<mime>;base64,<数据> 形式的 URL。
+func ollamaImage(c *schema.MessagePartCommon) (string, error) {
+	if c == nil {
+		return "", errors.New("ollama: image part without data")
+	}
+	if c.Base64Data != nil && *c.Base64Data != "" {
+		return *c.Base64Data, nil
+	}
+	var url string
+	if c.URL != nil {
+		url = *c.URL
+	}
+	if rest, ok := strings.CutPrefix(url, "data:"); ok {
+		if meta, data, ok := strings.Cut(rest, ","); ok && strings.HasSuffix(meta, ";base64") {
+			return data, nil
+		}
+	}
+	return "", fmt.Errorf("ollama: image parts must be base64 data, got url %q", url)
+}
+
+func (m *ollamaModel) Stream(ctx context.Context, input []*schema.Message, opts ...model.Option) (*schema.StreamReader[*schema.Message], error) {
+	resp, err := m.do(ctx, input, true, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	sr, sw := schema.Pipe[*schema.Message](8)
+	go func() {
+		defer resp.Body.Close()
+		defer sw.Close()
+
+		sc := bufio.NewScanner(resp.Body)
+		sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for sc.Scan() {
+			line := bytes.TrimSpace(sc.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			var chunk ollamaChatResp
+			if err := json.Unmarshal(line, &chunk); err != nil {
+				sw.Send(nil, err)
+				return
+			}
+			if chunk.Error != "" {
+				sw.Send(nil, fmt.Errorf("ollama: %s", chunk.Error))
+				return
+			}
+			if chunk.Message.Content != "" || len(chunk.Message.ToolCalls) > 0 {
+				if closed := sw.Send(chunk.Message.toSchema(), nil); closed {
+					return
+				}
+			}
+			if chunk.Done {
+				return
+			}
+		}
+		if err := sc.Err(); err != nil {
+			sw.Send(nil, err)
+		}
+	}()
+	return sr, nil
+}
+
+func (m *ollamaModel) do(ctx context.Context, input []*schema.Message, stream bool, opts []model.Option) (*http.Response, error) {
+	co := model.GetCommonOptions(&model.Options{
+		Model:       &m.model,
+		Temperature: &m.temperature,
+	}, opts...)
+
+	req := ollamaChatReq{
+		Model:    *co.Model,
+		Messages: make([]ollamaMessage, 0, len(input)),
+		Stream:   stream,
+		Options:  map[string]any{"temperature": *co.Temperature},
+	}
+	// Ollama 没有 tool_choice，禁止调用工具时干脆不传
+	if co.ToolChoice == nil || *co.ToolChoice != schema.ToolChoiceForbidden {
+		for _, info := range co.Tools {
+			var t ollamaTool
+			t.Type = "function"
+			t.Function.Name = info.Name
+			t.Function.Description = info.Desc
+			if info.ParamsOneOf != nil {
+				params, err := info.ParamsOneOf.ToJSONSchema()
+				if err != nil {
+					return nil, err
+				}
+				t.Function.Parameters = params
+			}
+			req.Tools = append(req.Tools, t)
+		}
+	}
+	for _, msg := range input {
+		om := ollamaMessage{Role: string(msg.Role), Content: msg.Content, ToolName: msg.ToolName, ToolCallID: msg.ToolCallID}
+		if err := om.setParts(msg); err != nil {
+			return nil, err
+		}
+		for _, tc := range msg.ToolCalls {
+			var otc ollamaToolCall
+			otc.Function.Name = tc.Function.Name
+			otc.Function.Arguments = json.RawMessage("{}")
+			if json.Valid([]byte(tc.Function.Arguments)) {
+				otc.Function.Arguments = json.RawMessage(tc.Function.Arguments)
+			}
+			om.ToolCalls = append(om.ToolCalls, otc)
+		}
+		req.Messages = append(req.Messages, om)
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, m.baseURL+"/api/chat", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.hc.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("ollama: status %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	return resp, nil
+}
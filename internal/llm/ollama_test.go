@@ -0,0 +1,77 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/JekYUlll/eino-mini/internal/session"
+)
+
+// newTestOllama 起一个假的 /api/chat，记下收到的请求，回复固定的 "ok"。
+func newTestOllama(t *testing.T) (Provider, *[]ollamaChatReq) {
+	t.Helper()
+	var got []ollamaChatReq
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ollamaChatReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		got = append(got, req)
+		_ = json.NewEncoder(w).Encode(ollamaChatResp{Message: ollamaMessage{Role: "assistant", Content: "ok"}, Done: true})
+	}))
+	t.Cleanup(srv.Close)
+	return newChatProvider(&ollamaModel{baseURL: srv.URL, model: "llava", hc: srv.Client()}, "llava"), &got
+}
+
+func TestOllamaParts(t *testing.T) {
+	p, got := newTestOllama(t)
+	history := []session.Message{
+		{Role: "system", Content: "sys"},
+		{Role: "user", Parts: []session.ContentPart{
+			{Type: session.PartText, Text: "what is this"},
+			{Type: session.PartImage, Data: "AAAA", MIMEType: "image/png"},
+			{Type: session.PartImage, URL: "data:image/jpeg;base64,BBBB"},
+		}},
+		{Role: "assistant", ToolCalls: []session.ToolCall{{ID: "call_1", Name: "search", Arguments: `{"q":"cat"}`}}},
+		{Role: "tool", Content: "a cat", ToolCallID: "call_1", ToolName: "search"},
+	}
+	if _, err := p.Generate(context.Background(), history); err != nil {
+		t.Fatal(err)
+	}
+	if len(*got) != 1 {
+		t.Fatalf("%d requests", len(*got))
+	}
+	msgs := (*got)[0].Messages
+	if user := msgs[1]; user.Content != "what is this" || !slices.Equal(user.Images, []string{"AAAA", "BBBB"}) {
+		t.Errorf("user = %+v", user)
+	}
+	if call := msgs[2].ToolCalls; len(call) != 1 || call[0].Function.Name != "search" || string(call[0].Function.Arguments) != `{"q":"cat"}` {
+		t.Errorf("tool calls = %+v", call)
+	}
+	if tool := msgs[3]; tool.Content != "a cat" || tool.ToolName != "search" || tool.ToolCallID != "call_1" {
+		t.Errorf("tool result = %+v", tool)
+	}
+}
+
+// Ollama 表达不了的片段直接报错，不发请求。
+func TestOllamaUnsupportedParts(t *testing.T) {
+	p, got := newTestOllama(t)
+	for name, part := range map[string]session.ContentPart{
+		"image url": {Type: session.PartImage, URL: "https://example.com/cat.png"},
+		"audio":     {Type: session.PartAudio, Data: "AAAA", MIMEType: "audio/wav"},
+		"file":      {Type: session.PartFile, URL: "https://example.com/a.pdf"},
+	} {
+		history := []session.Message{{Role: "user", Parts: []session.ContentPart{{Type: session.PartText, Text: "hi"}, part}}}
+		if _, err := p.Generate(context.Background(), history); err == nil || !strings.HasPrefix(err.Error(), "ollama:") {
+			t.Errorf("%s: err = %v, want an ollama error", name, err)
+		}
+	}
+	if len(*got) != 0 {
+		t.Fatalf("sent %d requests for unsupported parts", len(*got))
+	}
+}
@@ -0,0 +1,34 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/cloudwego/eino-ext/components/model/openai"
+)
+
+func init() {
+	Register("openai", newOpenAIProvider)
+}
+
+// newOpenAIProvider 使用 OpenAI 兼容接口（OpenAI / DeepSeek / vLLM 等）。
+func newOpenAIProvider(ctx context.Context) (Provider, error) {
+	apiKey := os.Getenv("OPENAI_API_KEY")
+	baseURL := os.Getenv("OPENAI_BASE_URL")
+	model := os.Getenv("OPENAI_MODEL")
+	if apiKey == "" || baseURL == "" || model == "" {
+		return nil, fmt.Errorf("missing env: OPENAI_API_KEY / OPENAI_BASE_URL / OPENAI_MODEL")
+	}
+
+	cm, err := openai.NewChatModel(ctx, &openai.ChatModelConfig{
+		APIKey:      apiKey,
+		BaseURL:     baseURL,
+		Model:       model,
+		Temperature: float32Ptr(0.2),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newChatProvider(cm, model), nil
+}
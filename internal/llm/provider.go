@@ -0,0 +1,83 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/JekYUlll/eino-mini/internal/session"
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+)
+
+// Provider 是对话后端的统一抽象：输入会话历史，输出模型回复。
+// httpapi 只依赖这个接口，具体走 OpenAI 兼容接口、本地 Ollama 还是 fake 由配置决定。
+type Provider interface {
+	Generate(ctx context.Context, history []session.Message, opts ...model.Option) (*schema.Message, error)
+	Stream(ctx context.Context, history []session.Message, opts ...model.Option) (*schema.StreamReader[*schema.Message], error)
+	// Model 返回默认模型名，用于会话元数据。
+	Model() string
+}
+
+// Factory 根据环境变量构造一个 Provider。
+type Factory func(ctx context.Context) (Provider, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register 注册一个 provider 工厂，name 大小写不敏感；重复注册会覆盖旧值。
+func Register(name string, f Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[strings.ToLower(name)] = f
+}
+
+// Providers 返回已注册的 provider 名称（排序后）。
+func Providers() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewProvider 按名称构造 provider。
+func NewProvider(ctx context.Context, name string) (Provider, error) {
+	registryMu.RLock()
+	f, ok := registry[strings.ToLower(name)]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown llm provider %q (available: %s)", name, strings.Join(Providers(), ", "))
+	}
+	return f(ctx)
+}
+
+// chatProvider 把一个 Eino BaseChatModel 适配成 Provider：
+// 负责 session.Message -> schema.Message 的转换，各个后端只需要实现 BaseChatModel。
+type chatProvider struct {
+	model model.BaseChatModel
+	name  string
+}
+
+func newChatProvider(cm model.BaseChatModel, name string) *chatProvider {
+	return &chatProvider{model: cm, name: name}
+}
+
+func (p *chatProvider) Model() string {
+	return p.name
+}
+
+func (p *chatProvider) Generate(ctx context.Context, history []session.Message, opts ...model.Option) (*schema.Message, error) {
+	return p.model.Generate(ctx, buildMessages(history), opts...)
+}
+
+func (p *chatProvider) Stream(ctx context.Context, history []session.Message, opts ...model.Option) (*schema.StreamReader[*schema.Message], error) {
+	return p.model.Stream(ctx, buildMessages(history), opts...)
+}
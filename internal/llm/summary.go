@@ -0,0 +1,45 @@
+package llm
+
+import (
+	"context"
+	"strings"
+
+	"github.com/JekYUlll/eino-mini/internal/session"
+)
+
+const summaryPrompt = "你负责维护一段长对话的滚动摘要。根据已有摘要和刚移出上下文的对话，输出更新后的完整摘要：" +
+	"保留用户的目标、约束、已确认的结论和关键事实（名称、数字、代码标识符），删去寒暄和重复内容，" +
+	"不超过 300 字，只输出摘要本身。"
+
+// Summarize 把 msgs 增量合并进已有摘要 prev，返回新的完整摘要。
+func Summarize(ctx context.Context, p Provider, prev string, msgs []session.Message) (string, error) {
+	var b strings.Builder
+	if prev != "" {
+		b.WriteString("已有摘要：\n")
+		b.WriteString(prev)
+		b.WriteString("\n\n")
+	}
+	b.WriteString("新移出上下文的对话：\n")
+	for _, m := range msgs {
+		switch m.Role {
+		case "user":
+			b.WriteString("用户：")
+		case "assistant":
+			b.WriteString("助手：")
+		default:
+			continue
+		}
+		b.WriteString(m.Text())
+		b.WriteString("\n")
+	}
+
+	history := []session.Message{
+		{Role: "system", Content: summaryPrompt},
+		{Role: "user", Content: b.String()},
+	}
+	resp, err := p.Generate(ctx, history)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(resp.Content), nil
+}
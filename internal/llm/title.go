@@ -0,0 +1,41 @@
+package llm
+
+import (
+	"context"
+	"strings"
+
+	"github.com/JekYUlll/eino-mini/internal/session"
+)
+
+const titlePrompt = "根据下面的一轮对话，为整段对话起一个简短的标题（不超过 20 个字），只输出标题本身，不要引号、不要句末标点。"
+
+// maxTitleRunes 是标题的硬上限，防止模型不听话输出一整段。
+const maxTitleRunes = 40
+
+// GenerateTitle 让模型根据首轮问答生成会话标题。
+func GenerateTitle(ctx context.Context, p Provider, question, answer string) (string, error) {
+	history := []session.Message{
+		{Role: "system", Content: titlePrompt},
+		{Role: "user", Content: "用户：" + question + "\n\n助手：" + answer},
+	}
+	resp, err := p.Generate(ctx, history)
+	if err != nil {
+		return "", err
+	}
+	return cleanTitle(resp.Content), nil
+}
+
+func cleanTitle(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.TrimPrefix(strings.TrimSpace(s), "标题：")
+	s = strings.TrimRight(s, "。.！!？?，,")
+	s = strings.Trim(s, " \t\"'“”‘’「」《》#*")
+	s = strings.TrimRight(s, "。.！!？?，,")
+	if r := []rune(s); len(r) > maxTitleRunes {
+		s = string(r[:maxTitleRunes])
+	}
+	return s
+}
@@ -0,0 +1,132 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudwego/eino/components/tool"
+	"github.com/cloudwego/eino/components/tool/utils"
+)
+
+// 内置工具：参数用 Go struct 描述，InferTool 按 json / jsonschema tag 推导出 JSON Schema。
+
+type currentTimeArgs struct {
+	Timezone string `json:"timezone,omitempty" jsonschema:"description=IANA 时区名，如 Asia/Shanghai，默认 UTC"`
+}
+
+type currentTimeResult struct {
+	Time     string `json:"time"`
+	Timezone string `json:"timezone"`
+	Weekday  string `json:"weekday"`
+}
+
+func currentTime(ctx context.Context, args currentTimeArgs) (currentTimeResult, error) {
+	name := strings.TrimSpace(args.Timezone)
+	if name == "" {
+		name = "UTC"
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return currentTimeResult{}, fmt.Errorf("unknown timezone %q", name)
+	}
+	now := time.Now().In(loc)
+	return currentTimeResult{
+		Time:     now.Format(time.RFC3339),
+		Timezone: name,
+		Weekday:  now.Weekday().String(),
+	}, nil
+}
+
+type calculatorArgs struct {
+	Expression string `json:"expression" jsonschema:"description=算术表达式，支持 + - * / % 和括号，如 (1+2)*3.5"`
+}
+
+type calculatorResult struct {
+	Result string `json:"result"`
+}
+
+// calculate 用 go/parser 解析表达式，再用 go/constant 按任意精度求值（不执行任何代码）。
+// 数字一律按浮点（精确有理数）处理，避免 1/3 得到 0 这种整数除法的反直觉结果。
+func calculate(ctx context.Context, args calculatorArgs) (calculatorResult, error) {
+	expr, err := parser.ParseExpr(strings.TrimSpace(args.Expression))
+	if err != nil {
+		return calculatorResult{}, fmt.Errorf("bad expression: %v", err)
+	}
+	v, err := evalConst(expr)
+	if err != nil {
+		return calculatorResult{}, err
+	}
+	if i := constant.ToInt(v); i.Kind() == constant.Int {
+		return calculatorResult{Result: i.ExactString()}, nil
+	}
+	f, _ := constant.Float64Val(v)
+	return calculatorResult{Result: strconv.FormatFloat(f, 'g', -1, 64)}, nil
+}
+
+func evalConst(e ast.Expr) (constant.Value, error) {
+	switch e := e.(type) {
+	case *ast.BasicLit:
+		if e.Kind != token.INT && e.Kind != token.FLOAT {
+			return nil, fmt.Errorf("unsupported literal %s", e.Value)
+		}
+		return constant.ToFloat(constant.MakeFromLiteral(e.Value, e.Kind, 0)), nil
+	case *ast.ParenExpr:
+		return evalConst(e.X)
+	case *ast.UnaryExpr:
+		if e.Op != token.ADD && e.Op != token.SUB {
+			return nil, fmt.Errorf("unsupported operator %s", e.Op)
+		}
+		x, err := evalConst(e.X)
+		if err != nil {
+			return nil, err
+		}
+		return constant.UnaryOp(e.Op, x, 0), nil
+	case *ast.BinaryExpr:
+		x, err := evalConst(e.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := evalConst(e.Y)
+		if err != nil {
+			return nil, err
+		}
+		switch e.Op {
+		case token.ADD, token.SUB, token.MUL:
+			return constant.BinaryOp(x, e.Op, y), nil
+		case token.QUO, token.REM:
+			if constant.Sign(y) == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			if e.Op == token.QUO {
+				return constant.BinaryOp(x, token.QUO, y), nil
+			}
+			xi, yi := constant.ToInt(x), constant.ToInt(y)
+			if xi.Kind() != constant.Int || yi.Kind() != constant.Int {
+				return nil, fmt.Errorf("%% needs integer operands")
+			}
+			return constant.ToFloat(constant.BinaryOp(xi, token.REM, yi)), nil
+		}
+		return nil, fmt.Errorf("unsupported operator %s", e.Op)
+	}
+	return nil, fmt.Errorf("unsupported expression")
+}
+
+// DefaultTools 返回内置工具（current_time、calculator）。
+func DefaultTools() ([]tool.InvokableTool, error) {
+	timeTool, err := utils.InferTool("current_time", "获取当前时间（可指定时区）", currentTime)
+	if err != nil {
+		return nil, err
+	}
+	calcTool, err := utils.InferTool("calculator", "计算算术表达式的精确结果", calculate)
+	if err != nil {
+		return nil, err
+	}
+	return []tool.InvokableTool{timeTool, calcTool}, nil
+}
@@ -0,0 +1,232 @@
+// Package mcp 对接 Model Context Protocol：把外部 MCP server 的工具接进 agent，也可以把 eino-mini 自己作为 MCP server 提供出去。
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cloudwego/eino/components/tool"
+	"github.com/cloudwego/eino/schema"
+	"github.com/eino-contrib/jsonschema"
+	sdk "github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// ToolSeparator 连接 server 名和工具名，拼出暴露给模型的工具名（如 fs__read_file），避免不同 server 的工具重名。
+const ToolSeparator = "__"
+
+// 模型接口要求工具名匹配 ^[a-zA-Z0-9_-]{1,64}$。
+var invalidToolChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// ToolName 返回 server 上名为 name 的工具暴露给模型时的名字。
+func ToolName(server, name string) string {
+	n := invalidToolChars.ReplaceAllString(server+ToolSeparator+name, "_")
+	if len(n) > 64 {
+		n = n[:64]
+	}
+	return n
+}
+
+// Client 持有到各个 MCP server 的会话。
+type Client struct {
+	sessions map[string]*sdk.ClientSession
+	tools    []tool.InvokableTool
+}
+
+// Connect 连接 cfg 里所有未禁用的 server 并列出工具。单个 server 连不上只打日志跳过，不影响启动；
+// 每个 server 的握手和列工具受 MCP_CONNECT_TIMEOUT（默认 10s）限制。
+func Connect(ctx context.Context, cfg *Config) (*Client, error) {
+	c := &Client{sessions: make(map[string]*sdk.ClientSession)}
+	if cfg == nil {
+		return c, nil
+	}
+	impl := &sdk.Implementation{Name: "eino-mini", Version: "0.1.0"}
+	for _, sc := range cfg.Items {
+		if sc.Disabled {
+			continue
+		}
+		if err := c.connect(ctx, impl, sc); err != nil {
+			log.Printf("mcp: skip server %s: %v", sc.Name, err)
+		}
+	}
+	return c, nil
+}
+
+func (c *Client) connect(ctx context.Context, impl *sdk.Implementation, sc ServerConfig) error {
+	ctx, cancel := context.WithTimeout(ctx, connectTimeout())
+	defer cancel()
+
+	transport, err := newTransport(sc)
+	if err != nil {
+		return err
+	}
+	// ctx 只约束握手；stdio 子进程不是用 ctx 启动的，超时后会话仍然可用
+	cs, err := sdk.NewClient(impl, nil).Connect(ctx, transport, nil)
+	if err != nil {
+		return err
+	}
+
+	var tools []tool.InvokableTool
+	for t, err := range cs.Tools(ctx, nil) {
+		if err != nil {
+			_ = cs.Close()
+			return fmt.Errorf("list tools: %w", err)
+		}
+		rt, err := newRemoteTool(cs, sc.Name, t)
+		if err != nil {
+			_ = cs.Close()
+			return err
+		}
+		tools = append(tools, rt)
+	}
+	c.sessions[sc.Name] = cs
+	c.tools = append(c.tools, tools...)
+	log.Printf("mcp: connected %s (%s), %d tools", sc.Name, sc.Transport(), len(tools))
+	return nil
+}
+
+func newTransport(sc ServerConfig) (sdk.Transport, error) {
+	switch sc.Transport() {
+	case TransportStdio:
+		cmd := exec.Command(sc.Command, sc.Args...)
+		cmd.Dir = sc.Cwd
+		cmd.Env = os.Environ()
+		for k, v := range sc.Env {
+			cmd.Env = append(cmd.Env, k+"="+v)
+		}
+		cmd.Stderr = os.Stderr
+		return &sdk.CommandTransport{Command: cmd}, nil
+	case TransportStreamable:
+		return &sdk.StreamableClientTransport{Endpoint: sc.URL, HTTPClient: httpClient(sc.Headers)}, nil
+	case TransportSSE:
+		return &sdk.SSEClientTransport{Endpoint: sc.URL, HTTPClient: httpClient(sc.Headers)}, nil
+	}
+	return nil, fmt.Errorf("unknown transport %q", sc.Transport())
+}
+
+// httpClient 给每个请求带上配置里的固定请求头（如 Authorization）。
+func httpClient(headers map[string]string) *http.Client {
+	if len(headers) == 0 {
+		return nil
+	}
+	return &http.Client{Transport: headerTransport{base: http.DefaultTransport, headers: headers}}
+}
+
+type headerTransport struct {
+	base    http.RoundTripper
+	headers map[string]string
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// Tools 返回所有已连接 server 的工具。
+func (c *Client) Tools() []tool.InvokableTool {
+	return c.tools
+}
+
+// Close 断开所有会话（stdio server 的子进程随之退出）。
+func (c *Client) Close() error {
+	var errs []error
+	for _, cs := range c.sessions {
+		errs = append(errs, cs.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// remoteTool 把 MCP server 上的一个工具适配成 eino 的 InvokableTool。
+type remoteTool struct {
+	session *sdk.ClientSession
+	remote  string // server 上的原名
+	info    *schema.ToolInfo
+}
+
+func newRemoteTool(cs *sdk.ClientSession, server string, t *sdk.Tool) (*remoteTool, error) {
+	info := &schema.ToolInfo{
+		Name: ToolName(server, t.Name),
+		Desc: t.Description,
+	}
+	if t.InputSchema != nil {
+		b, err := json.Marshal(t.InputSchema)
+		if err != nil {
+			return nil, fmt.Errorf("tool %s: %w", t.Name, err)
+		}
+		var js jsonschema.Schema
+		if err := json.Unmarshal(b, &js); err != nil {
+			return nil, fmt.Errorf("tool %s: bad input schema: %w", t.Name, err)
+		}
+		info.ParamsOneOf = schema.NewParamsOneOfByJSONSchema(&js)
+	}
+	return &remoteTool{session: cs, remote: t.Name, info: info}, nil
+}
+
+func (t *remoteTool) Info(ctx context.Context) (*schema.ToolInfo, error) {
+	return t.info, nil
+}
+
+func (t *remoteTool) InvokableRun(ctx context.Context, argumentsInJSON string, _ ...tool.Option) (string, error) {
+	var args map[string]any
+	if s := strings.TrimSpace(argumentsInJSON); s != "" {
+		if err := json.Unmarshal([]byte(s), &args); err != nil {
+			return "", fmt.Errorf("bad arguments: %w", err)
+		}
+	}
+	res, err := t.session.CallTool(ctx, &sdk.CallToolParams{Name: t.remote, Arguments: args})
+	if err != nil {
+		return "", err
+	}
+	out := resultText(res)
+	if res.IsError {
+		return "", errors.New(out)
+	}
+	return out, nil
+}
+
+// resultText 把工具结果压成文本：文本原样拼接，二进制内容只留一个占位说明。
+func resultText(res *sdk.CallToolResult) string {
+	var parts []string
+	for _, c := range res.Content {
+		switch c := c.(type) {
+		case *sdk.TextContent:
+			parts = append(parts, c.Text)
+		case *sdk.ImageContent:
+			parts = append(parts, fmt.Sprintf("[image %s, %d bytes]", c.MIMEType, len(c.Data)))
+		case *sdk.AudioContent:
+			parts = append(parts, fmt.Sprintf("[audio %s, %d bytes]", c.MIMEType, len(c.Data)))
+		case *sdk.ResourceLink:
+			parts = append(parts, fmt.Sprintf("[resource %s]", c.URI))
+		case *sdk.EmbeddedResource:
+			if c.Resource != nil && c.Resource.Text != "" {
+				parts = append(parts, c.Resource.Text)
+			} else if c.Resource != nil {
+				parts = append(parts, fmt.Sprintf("[resource %s]", c.Resource.URI))
+			}
+		}
+	}
+	if len(parts) == 0 && res.StructuredContent != nil {
+		if b, err := json.Marshal(res.StructuredContent); err == nil {
+			return string(b)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+func connectTimeout() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("MCP_CONNECT_TIMEOUT")); err == nil && d > 0 {
+		return d
+	}
+	return 10 * time.Second
+}
@@ -0,0 +1,233 @@
+package mcp
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/JekYUlll/eino-mini/internal/llm"
+	"github.com/cloudwego/eino/components/tool"
+	sdk "github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// helperEnv 设置时测试二进制不跑测试，而是作为 stdio MCP server 运行（见 serveHelper）。
+const helperEnv = "EINO_MCP_TEST_SERVER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(helperEnv) == "1" {
+		if err := serveHelper(); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+type echoIn struct {
+	Text string `json:"text"`
+}
+
+type addIn struct {
+	A int `json:"a"`
+	B int `json:"b"`
+}
+
+type addOut struct {
+	Sum int `json:"sum"`
+}
+
+// serveHelper 是测试用的 MCP server：echo 原样返回文本，math.add 只返回结构化结果，fail 总是出错。
+func serveHelper() error {
+	srv := sdk.NewServer(&sdk.Implementation{Name: "helper", Version: "0.0.1"}, nil)
+	sdk.AddTool(srv, &sdk.Tool{Name: "echo", Description: "echo text"},
+		func(ctx context.Context, _ *sdk.CallToolRequest, in echoIn) (*sdk.CallToolResult, any, error) {
+			return &sdk.CallToolResult{Content: []sdk.Content{&sdk.TextContent{Text: in.Text}}}, nil, nil
+		})
+	sdk.AddTool(srv, &sdk.Tool{Name: "math.add", Description: "add two numbers"},
+		func(ctx context.Context, _ *sdk.CallToolRequest, in addIn) (*sdk.CallToolResult, addOut, error) {
+			return nil, addOut{Sum: in.A + in.B}, nil
+		})
+	sdk.AddTool(srv, &sdk.Tool{Name: "fail", Description: "always fails"},
+		func(ctx context.Context, _ *sdk.CallToolRequest, _ struct{}) (*sdk.CallToolResult, any, error) {
+			return nil, nil, errors.New("boom")
+		})
+	return srv.Run(context.Background(), &sdk.StdioTransport{})
+}
+
+// helperConfig 返回用测试二进制自己启动 helper server 的配置。
+func helperConfig(name string) ServerConfig {
+	return ServerConfig{
+		Name:    name,
+		Command: os.Args[0],
+		Args:    []string{"-test.run=^$"},
+		Env:     map[string]string{helperEnv: "1"},
+	}
+}
+
+func connectHelper(t *testing.T, cfg *Config) *Client {
+	t.Helper()
+	c, err := Connect(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func toolNames(t *testing.T, tools []tool.InvokableTool) []string {
+	t.Helper()
+	var names []string
+	for _, tl := range tools {
+		info, err := tl.Info(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, info.Name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func findTool(t *testing.T, tools []tool.InvokableTool, name string) tool.InvokableTool {
+	t.Helper()
+	for _, tl := range tools {
+		if info, _ := tl.Info(context.Background()); info.Name == name {
+			return tl
+		}
+	}
+	t.Fatalf("tool %s not found", name)
+	return nil
+}
+
+func writeConfig(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "connection.json")
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `{"items":[
+		{"name":"fs","command":"mcp-fs","args":["/tmp"]},
+		{"name":"web","connectionType":"STREAMABLE-HTTP","url":"http://127.0.0.1:1/mcp","headers":{"Authorization":"Bearer x"}},
+		{"name":"old","type":"sse","url":"http://127.0.0.1:1/sse","disabled":true}
+	]}`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, it := range cfg.Items {
+		got = append(got, it.Name+":"+it.Transport())
+	}
+	want := []string{"fs:stdio", "web:streamable_http", "old:sse"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("transports = %v, want %v", got, want)
+	}
+	if !cfg.Items[2].Disabled || cfg.Items[1].Headers["Authorization"] != "Bearer x" {
+		t.Fatalf("fields not decoded: %+v", cfg.Items)
+	}
+
+	// 没传 path 时取 MCP_CONFIG
+	t.Setenv("MCP_CONFIG", path)
+	if cfg, err := LoadConfig(""); err != nil || len(cfg.Items) != 3 {
+		t.Fatalf("MCP_CONFIG: %v, %+v", err, cfg)
+	}
+
+	// 文件不存在不是错误
+	cfg, err = LoadConfig(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil || len(cfg.Items) != 0 {
+		t.Fatalf("missing file: %v, %+v", err, cfg)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	for name, body := range map[string]string{
+		"bad json":          `{"items":`,
+		"no name":           `{"items":[{"command":"x"}]}`,
+		"stdio no command":  `{"items":[{"name":"a","type":"stdio"}]}`,
+		"http no url":       `{"items":[{"name":"a","type":"sse"}]}`,
+		"unknown transport": `{"items":[{"name":"a","type":"ws","url":"ws://x"}]}`,
+		"duplicate":         `{"items":[{"name":"a","command":"x"},{"name":"a","command":"y"}]}`,
+	} {
+		if _, err := LoadConfig(writeConfig(t, body)); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+}
+
+func TestToolName(t *testing.T) {
+	if got := ToolName("my server", "math.add"); got != "my_server__math_add" {
+		t.Fatalf("ToolName = %q", got)
+	}
+	if got := ToolName("s", strings.Repeat("x", 100)); len(got) != 64 {
+		t.Fatalf("ToolName not truncated: %d", len(got))
+	}
+}
+
+func TestConnectStdio(t *testing.T) {
+	disabled := helperConfig("off")
+	disabled.Disabled = true
+	c := connectHelper(t, &Config{Items: []ServerConfig{
+		helperConfig("test"),
+		disabled,
+		// 连不上的 server 只跳过，不影响其他 server
+		{Name: "broken", Command: filepath.Join(t.TempDir(), "no-such-binary")},
+	}})
+
+	want := []string{"test__echo", "test__fail", "test__math_add"}
+	if got := toolNames(t, c.Tools()); !slices.Equal(got, want) {
+		t.Fatalf("tools = %v, want %v", got, want)
+	}
+
+	ctx := context.Background()
+	out, err := findTool(t, c.Tools(), "test__echo").InvokableRun(ctx, `{"text":"hello"}`)
+	if err != nil || out != "hello" {
+		t.Fatalf("echo = %q, %v", out, err)
+	}
+	// 没有文本内容时退回结构化结果
+	out, err = findTool(t, c.Tools(), "test__math_add").InvokableRun(ctx, `{"a":2,"b":3}`)
+	if err != nil || out != `{"sum":5}` {
+		t.Fatalf("math.add = %q, %v", out, err)
+	}
+	if _, err := findTool(t, c.Tools(), "test__fail").InvokableRun(ctx, ""); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("fail: want boom error, got %v", err)
+	}
+	if _, err := findTool(t, c.Tools(), "test__echo").InvokableRun(ctx, `{not json`); err == nil {
+		t.Fatal("bad arguments: want error")
+	}
+}
+
+func TestConnectAllowlist(t *testing.T) {
+	c := connectHelper(t, &Config{Items: []ServerConfig{helperConfig("a"), helperConfig("b")}})
+	agent, err := llm.NewAgent(context.Background(), nil, c.Tools())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(a *llm.Agent) []string {
+		var out []string
+		for _, info := range a.Tools() {
+			out = append(out, info.Name)
+		}
+		slices.Sort(out)
+		return out
+	}
+	if got := names(agent); len(got) != 6 {
+		t.Fatalf("unfiltered tools = %v", got)
+	}
+	// 会话的 tools 列表：精确名字加通配
+	got := names(agent.Filter([]string{"a__echo", "b__math_*"}))
+	if want := []string{"a__echo", "b__math_add"}; !slices.Equal(got, want) {
+		t.Fatalf("filtered tools = %v, want %v", got, want)
+	}
+	if got := names(agent.Filter([]string{"c__*"})); len(got) != 0 {
+		t.Fatalf("no match should leave no tools, got %v", got)
+	}
+}
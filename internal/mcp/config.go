@@ -0,0 +1,109 @@
+package mcp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// DefaultConfigPath 是 MCP 连接配置的默认位置（与 OpenMCP 插件的 .openmcp/connection.json 格式兼容）。
+const DefaultConfigPath = ".openmcp/connection.json"
+
+// 传输方式。
+const (
+	TransportStdio      = "stdio"
+	TransportStreamable = "streamable_http"
+	TransportSSE        = "sse"
+)
+
+// Config 是 connection.json 的内容。
+type Config struct {
+	Items []ServerConfig `json:"items"`
+}
+
+// ServerConfig 描述一个 MCP server。stdio 方式用 Command/Args/Env/Cwd 启动子进程，
+// HTTP 方式（streamable_http / sse）连接 URL，可附带请求头。
+type ServerConfig struct {
+	Name           string            `json:"name"`
+	Type           string            `json:"type,omitempty"`
+	ConnectionType string            `json:"connectionType,omitempty"` // OpenMCP 的写法，等价于 type
+	Command        string            `json:"command,omitempty"`
+	Args           []string          `json:"args,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+	Cwd            string            `json:"cwd,omitempty"`
+	URL            string            `json:"url,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	Disabled       bool              `json:"disabled,omitempty"`
+}
+
+// Transport 返回规范化后的传输方式：没写时有 command 就是 stdio，有 url 就是 streamable_http。
+func (c ServerConfig) Transport() string {
+	t := c.Type
+	if t == "" {
+		t = c.ConnectionType
+	}
+	t = strings.ReplaceAll(strings.ToLower(strings.TrimSpace(t)), "-", "_")
+	switch t {
+	case "":
+		if c.Command != "" {
+			return TransportStdio
+		}
+		return TransportStreamable
+	case "http", "streamable", "streamablehttp":
+		return TransportStreamable
+	}
+	return t
+}
+
+func (c ServerConfig) validate() error {
+	if c.Name == "" {
+		return errors.New("mcp server without name")
+	}
+	switch c.Transport() {
+	case TransportStdio:
+		if c.Command == "" {
+			return fmt.Errorf("mcp server %q: stdio needs command", c.Name)
+		}
+	case TransportStreamable, TransportSSE:
+		if c.URL == "" {
+			return fmt.Errorf("mcp server %q: %s needs url", c.Name, c.Transport())
+		}
+	default:
+		return fmt.Errorf("mcp server %q: unknown transport %q", c.Name, c.Transport())
+	}
+	return nil
+}
+
+// LoadConfig 读取 path（为空时取 MCP_CONFIG，再退回 DefaultConfigPath）。文件不存在不是错误，返回空配置。
+func LoadConfig(path string) (*Config, error) {
+	if path == "" {
+		path = os.Getenv("MCP_CONFIG")
+	}
+	if path == "" {
+		path = DefaultConfigPath
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	seen := make(map[string]bool, len(cfg.Items))
+	for _, it := range cfg.Items {
+		if err := it.validate(); err != nil {
+			return nil, err
+		}
+		if seen[it.Name] {
+			return nil, fmt.Errorf("duplicate mcp server %q", it.Name)
+		}
+		seen[it.Name] = true
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,230 @@
+package mcp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/JekYUlll/eino-mini/internal/llm"
+	"github.com/JekYUlll/eino-mini/internal/session"
+	sdk "github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// Server 把聊天后端暴露成 MCP server，供其他 agent 把会话记忆当工具用：
+// ask 在会话里提问（与 /ask 走同一套加锁、两阶段写入），list_conversations / get_history 读取会话。
+// 会话归属与 HTTP API 一致：streamable HTTP 取请求头 X-User-ID，stdio 用构造时给的 owner。
+type Server struct {
+	LLM   llm.Provider
+	Store session.Store
+}
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+type askIn struct {
+	Question       string `json:"question" jsonschema:"要问的问题"`
+	ConversationID string `json:"conversation_id,omitempty" jsonschema:"已有会话的 ID，不填则新建会话"`
+}
+
+type askOut struct {
+	ConversationID string `json:"conversation_id"`
+	Answer         string `json:"answer"`
+}
+
+type listIn struct{}
+
+type conversationOut struct {
+	ID           string `json:"id"`
+	Title        string `json:"title"`
+	UpdatedAt    string `json:"updated_at"`
+	MessageCount int    `json:"message_count"`
+}
+
+type listOut struct {
+	Conversations []conversationOut `json:"conversations"`
+}
+
+type historyIn struct {
+	ConversationID string `json:"conversation_id" jsonschema:"会话 ID"`
+	After          string `json:"after,omitempty" jsonschema:"分页游标：上一页返回的 next_cursor"`
+	Limit          int    `json:"limit,omitempty" jsonschema:"每页条数，默认 50，最大 200"`
+}
+
+type messageOut struct {
+	ID        string `json:"id"`
+	Role      string `json:"role"`
+	Content   string `json:"content"`
+	CreatedAt string `json:"created_at,omitempty"`
+}
+
+type historyOut struct {
+	ConversationID string       `json:"conversation_id"`
+	Messages       []messageOut `json:"messages"`
+	NextCursor     string       `json:"next_cursor,omitempty"`
+}
+
+// NewServer 构造以 owner 身份访问会话的 MCP server。
+func (s *Server) NewServer(owner string) *sdk.Server {
+	srv := sdk.NewServer(&sdk.Implementation{Name: "eino-mini", Version: "0.1.0"}, nil)
+	sdk.AddTool(srv, &sdk.Tool{
+		Name:        "ask",
+		Description: "在 eino-mini 的会话里提问并返回回答；带上 conversation_id 可以延续之前的上下文",
+	}, func(ctx context.Context, _ *sdk.CallToolRequest, in askIn) (*sdk.CallToolResult, askOut, error) {
+		out, err := s.ask(ctx, owner, in)
+		return nil, out, err
+	})
+	sdk.AddTool(srv, &sdk.Tool{
+		Name:        "list_conversations",
+		Description: "列出当前用户的会话，按最近更新时间倒序",
+	}, func(ctx context.Context, _ *sdk.CallToolRequest, _ listIn) (*sdk.CallToolResult, listOut, error) {
+		out, err := s.listConversations(ctx, owner)
+		return nil, out, err
+	})
+	sdk.AddTool(srv, &sdk.Tool{
+		Name:        "get_history",
+		Description: "按游标分页读取会话的历史消息（不含 system 消息）",
+	}, func(ctx context.Context, _ *sdk.CallToolRequest, in historyIn) (*sdk.CallToolResult, historyOut, error) {
+		out, err := s.getHistory(ctx, owner, in)
+		return nil, out, err
+	})
+	return srv
+}
+
+// ServeStdio 在标准输入输出上提供服务，直到对端断开或 ctx 结束。
+func (s *Server) ServeStdio(ctx context.Context, owner string) error {
+	return s.NewServer(owner).Run(ctx, &sdk.StdioTransport{})
+}
+
+// Handler 返回 streamable HTTP 的 handler，每个 MCP 会话按建立时的 X-User-ID 确定 owner。
+func (s *Server) Handler() http.Handler {
+	return sdk.NewStreamableHTTPHandler(func(r *http.Request) *sdk.Server {
+		return s.NewServer(r.Header.Get("X-User-ID"))
+	}, nil)
+}
+
+func (s *Server) ask(ctx context.Context, owner string, in askIn) (askOut, error) {
+	if in.Question == "" {
+		return askOut{}, errors.New("empty question")
+	}
+	convID := in.ConversationID
+	if convID == "" {
+		convID = s.Store.NewConversationID()
+	}
+	c, err := s.Store.EnsureConversation(ctx, session.Conversation{ID: convID, Owner: owner, Model: s.LLM.Model()})
+	if err != nil {
+		return askOut{}, err
+	}
+	if c.Owner != owner {
+		return askOut{}, session.ErrNotFound
+	}
+
+	lease, err := s.lock(ctx, convID)
+	if err != nil {
+		return askOut{}, err
+	}
+	defer lease.Release()
+	ctx = session.WithFence(ctx, lease.Fence())
+
+	history, userID, err := s.Store.AppendUser(ctx, convID, in.Question)
+	if err != nil {
+		return askOut{}, err
+	}
+	resp, err := s.LLM.Generate(ctx, history)
+	if err != nil {
+		return askOut{}, err
+	}
+	// 和 /ask 一样用户优先：落库失败（包括锁已经丢了）也返回答案
+	for i := 0; i < 3 && lease.Err() == nil; i++ {
+		if err := s.Store.InsertAssistant(ctx, convID, userID, resp.Content); !errors.Is(err, session.ErrConflict) {
+			break
+		}
+	}
+	return askOut{ConversationID: convID, Answer: resp.Content}, nil
+}
+
+// lock 在 CHAT_LOCK_WAIT（默认 8s）内排队等会话锁。
+func (s *Server) lock(ctx context.Context, convID string) (*session.Lease, error) {
+	wait := 8 * time.Second
+	if d, err := time.ParseDuration(os.Getenv("CHAT_LOCK_WAIT")); err == nil && d > 0 {
+		wait = d
+	}
+	lease, ok, err := s.Store.AcquireLock(ctx, convID, wait, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("conversation is busy, try again")
+	}
+	return lease, nil
+}
+
+func (s *Server) listConversations(ctx context.Context, owner string) (listOut, error) {
+	list, err := s.Store.ListConversations(ctx, owner)
+	if err != nil {
+		return listOut{}, err
+	}
+	out := listOut{Conversations: make([]conversationOut, 0, len(list))}
+	for _, c := range list {
+		out.Conversations = append(out.Conversations, conversationOut{
+			ID:           c.ID,
+			Title:        c.Title,
+			UpdatedAt:    c.UpdatedAt.UTC().Format(time.RFC3339),
+			MessageCount: c.MessageCount,
+		})
+	}
+	return out, nil
+}
+
+func (s *Server) getHistory(ctx context.Context, owner string, in historyIn) (historyOut, error) {
+	c, err := s.Store.GetConversation(ctx, in.ConversationID)
+	if err != nil {
+		return historyOut{}, err
+	}
+	if c.Owner != owner {
+		return historyOut{}, session.ErrNotFound
+	}
+	msgs, err := s.Store.History(ctx, in.ConversationID)
+	if err != nil {
+		return historyOut{}, err
+	}
+
+	start := 0
+	if in.After != "" {
+		start = -1
+		for i, m := range msgs {
+			if m.ID == in.After {
+				start = i + 1
+				break
+			}
+		}
+		if start < 0 {
+			return historyOut{}, errors.New("cursor message pruned or unknown")
+		}
+	}
+	limit := defaultHistoryLimit
+	if in.Limit > 0 {
+		limit = min(in.Limit, maxHistoryLimit)
+	}
+
+	out := historyOut{ConversationID: in.ConversationID, Messages: []messageOut{}}
+	i := start
+	for ; i < len(msgs) && len(out.Messages) < limit; i++ {
+		m := msgs[i]
+		if m.Role == "system" {
+			continue
+		}
+		mo := messageOut{ID: m.ID, Role: m.Role, Content: m.Text()}
+		if !m.CreatedAt.IsZero() {
+			mo.CreatedAt = m.CreatedAt.UTC().Format(time.RFC3339)
+		}
+		out.Messages = append(out.Messages, mo)
+	}
+	if i < len(msgs) && i > start {
+		out.NextCursor = msgs[i-1].ID
+	}
+	return out, nil
+}
@@ -0,0 +1,94 @@
+package persona
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultDir 是人设配置目录的默认位置，每个人设一个 JSON 文件。
+const DefaultDir = "personas"
+
+// Persona 是一个命名的人设：新会话可以选用，决定 system prompt、模型、温度和可用工具。
+// Model / Temperature / Tools 为空表示沿用全局配置。
+type Persona struct {
+	Name         string   `json:"name"` // 不写时取文件名（去掉 .json）
+	Description  string   `json:"description,omitempty"`
+	SystemPrompt string   `json:"system_prompt"`
+	Model        string   `json:"model,omitempty"`
+	Temperature  *float32 `json:"temperature,omitempty"`
+	Tools        []string `json:"tools,omitempty"` // 工具名或 path.Match 通配，同 Conversation.Tools
+}
+
+// Set 是加载好的人设，按名字查找；nil 的 Set 等价于空集合。
+type Set struct {
+	byName map[string]Persona
+	names  []string
+}
+
+// Load 读取 dir（为空时取 CHAT_PERSONA_DIR，再退回 DefaultDir）下的 *.json。目录不存在不是错误，返回空集合。
+func Load(dir string) (*Set, error) {
+	if dir == "" {
+		dir = os.Getenv("CHAT_PERSONA_DIR")
+	}
+	if dir == "" {
+		dir = DefaultDir
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	set := &Set{byName: make(map[string]Persona, len(files))}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var p Persona
+		if err := json.Unmarshal(b, &p); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", f, err)
+		}
+		p.Name = strings.TrimSpace(p.Name)
+		if p.Name == "" {
+			p.Name = strings.TrimSuffix(filepath.Base(f), ".json")
+		}
+		if strings.TrimSpace(p.SystemPrompt) == "" {
+			return nil, fmt.Errorf("persona %q: empty system_prompt", p.Name)
+		}
+		if _, dup := set.byName[p.Name]; dup {
+			return nil, fmt.Errorf("duplicate persona %q", p.Name)
+		}
+		set.byName[p.Name] = p
+		set.names = append(set.names, p.Name)
+	}
+	sort.Strings(set.names)
+	return set, nil
+}
+
+// Get 按名字查找人设。
+func (s *Set) Get(name string) (Persona, bool) {
+	if s == nil {
+		return Persona{}, false
+	}
+	p, ok := s.byName[name]
+	return p, ok
+}
+
+// List 返回全部人设，按名字排序。
+func (s *Set) List() []Persona {
+	if s == nil {
+		return nil
+	}
+	out := make([]Persona, 0, len(s.names))
+	for _, name := range s.names {
+		out = append(out, s.byName[name])
+	}
+	return out
+}
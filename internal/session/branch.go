@@ -0,0 +1,362 @@
+package session
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"time"
+)
+
+// 分支：一个会话的消息是一棵树。每条消息用 ParentID 指向父节点：system 是根，user 挂在它前面那条消息下面，
+// 一组回复（工具调用、工具结果、最终回复）依次挂成一条链，第一条挂在 user 下面。
+// 会话记着当前激活的叶子（head），Load / History 从 head 沿 ParentID 走回根，得到的就是送给模型的那条路径。
+//
+// 重新生成是在 user 下面再挂一组回复，编辑是在原 user 的父节点下面再挂一个 user，新节点成为 head；
+// 旧版本原样留在树上，是新节点的兄弟，随时可以切回去（SwitchBranch 传分支里任意一条消息的 ID）。
+// 分叉点之前的公共前缀只存一份，置顶、已摘要这些状态记在节点上，切换分支不会丢。
+//
+// 裁剪只看当前路径：SQLite 保留全部节点，读取时按路径裁剪；Redis / 内存在写入时删掉路径上被裁掉的节点，
+// 它们的子节点（包括别的分支）改挂到最近一个保留下来的祖先下面（见 tree.prune），
+// 分叉点被裁掉之后分支仍然挂在树上、可以切回去，只是和当前路径一样看不到被裁掉的消息。
+
+var ErrBranchNotFound = errors.New("branch not found")
+
+// Branch 是树上不在当前路径上的一个分支：从分叉点 ParentID 下面的 ID 那条消息开始，
+// 沿最新的子节点一直走到叶子。SwitchBranch(ID) 切到这个分支。
+type Branch struct {
+	ID        string    `json:"id"`        // 分支第一条消息的 ID
+	ParentID  string    `json:"parent_id"` // 分叉点，为空表示从根分叉
+	Messages  []Message `json:"messages"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// messageIndex 返回 msgs 里 ID 为 id 的消息下标，没有时返回 -1。
+func messageIndex(msgs []Message, id string) int {
+	return slices.IndexFunc(msgs, func(m Message) bool { return m.ID == id })
+}
+
+// tree 是一个会话的全部消息（所有分支），nodes 按写入顺序，head 是当前激活的叶子。
+// 各个后端把树整棵读出来交给下面的方法修改，再把 added / moved / removed 记下的改动写回去。
+type tree struct {
+	nodes []Message
+	head  string
+
+	index map[string]int
+	kids  map[string][]string // 父节点 -> 子节点 ID，按写入顺序；为 nil 时按需重建
+
+	added   map[string]bool // 新增的节点
+	moved   map[string]bool // 改挂了 ParentID 的已有节点
+	removed []Message       // 裁剪删掉的节点
+}
+
+func newTree(nodes []Message, head string) *tree {
+	t := &tree{
+		nodes: slices.Clone(nodes),
+		head:  head,
+		added: map[string]bool{},
+		moved: map[string]bool{},
+	}
+	t.reindex()
+	return t
+}
+
+// linearTree 把一条路径存成一棵只有一个分支的树：ParentID 依次串起来，head 是最后一条。
+func linearTree(msgs []Message) *tree {
+	t := newTree(nil, "")
+	for _, m := range msgs {
+		m.ParentID = t.head
+		t.add(m)
+		t.head = m.ID
+	}
+	return t
+}
+
+func (t *tree) reindex() {
+	t.index = make(map[string]int, len(t.nodes))
+	for i, m := range t.nodes {
+		t.index[m.ID] = i
+	}
+	t.kids = nil
+}
+
+func (t *tree) get(id string) (Message, bool) {
+	i, ok := t.index[id]
+	if !ok {
+		return Message{}, false
+	}
+	return t.nodes[i], true
+}
+
+func (t *tree) add(m Message) {
+	t.index[m.ID] = len(t.nodes)
+	t.nodes = append(t.nodes, m)
+	t.added[m.ID] = true
+	t.kids = nil
+}
+
+func (t *tree) reparent(id, parent string) {
+	t.nodes[t.index[id]].ParentID = parent
+	if !t.added[id] {
+		t.moved[id] = true
+	}
+	t.kids = nil
+}
+
+// changed 返回新增和改挂过的节点，按写入顺序。
+func (t *tree) changed() []Message {
+	var out []Message
+	for _, m := range t.nodes {
+		if t.added[m.ID] || t.moved[m.ID] {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// children 返回 id 的子节点 ID，按写入顺序。
+func (t *tree) children(id string) []string {
+	if t.kids == nil {
+		t.kids = map[string][]string{}
+		for _, m := range t.nodes {
+			t.kids[m.ParentID] = append(t.kids[m.ParentID], m.ID)
+		}
+	}
+	return t.kids[id]
+}
+
+// pathTo 返回从根到 id 的消息；id 为空或不在树上时返回空。
+func (t *tree) pathTo(id string) []Message {
+	var out []Message
+	for seen := map[string]bool{}; id != "" && !seen[id]; {
+		m, ok := t.get(id)
+		if !ok {
+			break
+		}
+		seen[id] = true
+		out = append(out, m)
+		id = m.ParentID
+	}
+	slices.Reverse(out)
+	return out
+}
+
+// path 是当前路径：从根到 head。
+func (t *tree) path() []Message {
+	return t.pathTo(t.head)
+}
+
+// onPath 返回当前路径上的消息 ID。
+func (t *tree) onPath() map[string]bool {
+	on := map[string]bool{}
+	for _, m := range t.path() {
+		on[m.ID] = true
+	}
+	return on
+}
+
+// leaf 返回 id 下面最新的叶子：每一层都走最后写入的子节点。
+func (t *tree) leaf(id string) string {
+	for {
+		kids := t.children(id)
+		if len(kids) == 0 {
+			return id
+		}
+		id = kids[len(kids)-1]
+	}
+}
+
+// branchAt 返回从 id 开始的分支：id 在当前路径上时沿当前路径走到 head，否则走到它下面最新的叶子。
+func (t *tree) branchAt(id string) Branch {
+	m, _ := t.get(id)
+	end := t.head
+	if !t.onPath()[id] {
+		end = t.leaf(id)
+	}
+	msgs := t.pathTo(end)
+	return Branch{
+		ID:        id,
+		ParentID:  m.ParentID,
+		Messages:  slices.Clone(msgs[messageIndex(msgs, id):]),
+		CreatedAt: m.CreatedAt,
+	}
+}
+
+// branches 返回所有不在当前路径上的分支：分叉点（有多个子节点的消息）下面每个不在路径上的子节点各是一个，
+// 按创建时间排序。分支里面再分叉的也单独列出来。
+func (t *tree) branches() []Branch {
+	on := t.onPath()
+	var out []Branch
+	for _, m := range t.nodes {
+		if !on[m.ID] && len(t.children(m.ParentID)) > 1 {
+			out = append(out, t.branchAt(m.ID))
+		}
+	}
+	sortBranches(out)
+	return out
+}
+
+// replyTo 返回 userID 下面的回复（第一条）：有多个版本时取当前路径上的那个，都不在路径上时取最新的。
+func (t *tree) replyTo(userID string) string {
+	on := t.onPath()
+	latest := ""
+	for _, id := range t.children(userID) {
+		m, _ := t.get(id)
+		if m.Role == "user" {
+			continue
+		}
+		if on[id] {
+			return id
+		}
+		latest = id
+	}
+	return latest
+}
+
+// appendUser 在 head 下面追加一条 user 并让它成为 head；树为空时先写入 system 作为根，
+// prompt 是会话自己的 system prompt。
+func (t *tree) appendUser(prompt, content string) Message {
+	ts := nowUTC()
+	if t.head == "" {
+		sys := Message{ID: newID(), Role: "system", Content: systemPrompt(prompt), CreatedAt: ts}
+		t.add(sys)
+		t.head = sys.ID
+	}
+	user := Message{ID: newID(), ParentID: t.head, Role: "user", Content: content, CreatedAt: ts}
+	t.add(user)
+	t.head = user.ID
+	return user
+}
+
+// insertReply 把一组回复按顺序挂到 userID 下面（两阶段写入的 Phase 2）。
+// 回复插回来之前追加的 user（并发的两阶段写入）已经挂在 userID 下面，改挂到最后一条回复下面，
+// 这样回复在路径上紧跟着自己的 user；head 是 userID 时换成最后一条回复。
+// user 不在树上返回 ErrUserPruned，已经有回复返回 errNoWrite（按 userID 幂等）。
+func (t *tree) insertReply(userID string, reply []Message) error {
+	if u, ok := t.get(userID); !ok || u.Role != "user" {
+		return ErrUserPruned
+	}
+	if t.replyTo(userID) != "" {
+		return errNoWrite
+	}
+	reply = stampReply(userID, reply)
+	last := reply[len(reply)-1].ID
+	for _, id := range slices.Clone(t.children(userID)) {
+		t.reparent(id, last)
+	}
+	for _, m := range reply {
+		t.add(m)
+	}
+	if t.head == userID {
+		t.head = last
+	}
+	return nil
+}
+
+// replaceReply 给 userID 再挂一组回复，成为新的 head；原来的回复（连同之后的轮次）留在树上，
+// 作为分支返回。user 还没有回复时和 insertReply 一样，返回 nil。
+func (t *tree) replaceReply(userID string, reply []Message) (*Branch, error) {
+	if u, ok := t.get(userID); !ok || u.Role != "user" {
+		return nil, ErrUserPruned
+	}
+	prev := t.replyTo(userID)
+	if prev == "" {
+		return nil, t.insertReply(userID, reply)
+	}
+	b := t.branchAt(prev)
+	reply = stampReply(userID, reply)
+	for _, m := range reply {
+		t.add(m)
+	}
+	t.head = reply[len(reply)-1].ID
+	return &b, nil
+}
+
+// editUser 在 msgID（一条 user）的父节点下面挂一个内容为 content 的新 user，成为新的 head；
+// 原来的 user（连同之后的轮次）作为分支返回。不是 user 或不在树上时返回 ErrMessageNotFound。
+func (t *tree) editUser(msgID, content string) (Message, *Branch, error) {
+	old, ok := t.get(msgID)
+	if !ok || old.Role != "user" {
+		return Message{}, nil, ErrMessageNotFound
+	}
+	b := t.branchAt(msgID)
+	user := Message{ID: newID(), ParentID: old.ParentID, Role: "user", Content: content, CreatedAt: nowUTC()}
+	t.add(user)
+	t.head = user.ID
+	return user, &b, nil
+}
+
+// switchTo 把 head 换成 id 下面最新的叶子，返回换下来的分支（当前路径在分叉点之后的部分）。
+// id 已经在当前路径上时什么都不做，返回 nil；不在树上时返回 ErrBranchNotFound。
+func (t *tree) switchTo(id string) (*Branch, error) {
+	if _, ok := t.get(id); !ok {
+		return nil, ErrBranchNotFound
+	}
+	if t.onPath()[id] {
+		return nil, nil
+	}
+	leaf := t.leaf(id)
+	next := map[string]bool{}
+	for _, m := range t.pathTo(leaf) {
+		next[m.ID] = true
+	}
+	var out *Branch
+	for _, m := range t.path() {
+		if !next[m.ID] {
+			b := t.branchAt(m.ID)
+			out = &b
+			break
+		}
+	}
+	t.head = leaf
+	return out, nil
+}
+
+// prune 按 plan 删掉当前路径上被裁掉的节点（Redis / 内存在写入时裁剪）：
+// 其余节点里父节点被删掉的，改挂到最近一个保留下来的祖先下面，不在当前路径上的分支也跟着挂过去。
+// 返回删掉的节点，按路径顺序。
+func (t *tree) prune(plan PrunePlan) []Message {
+	dropped := plan.Dropped(t.path())
+	if len(dropped) == 0 {
+		return nil
+	}
+	gone := make(map[string]bool, len(dropped))
+	for _, m := range dropped {
+		gone[m.ID] = true
+	}
+	kept := make([]Message, 0, len(t.nodes)-len(dropped))
+	for _, m := range t.nodes {
+		if gone[m.ID] {
+			continue
+		}
+		parent := m.ParentID
+		for gone[parent] {
+			p, _ := t.get(parent)
+			parent = p.ParentID
+		}
+		if parent != m.ParentID {
+			m.ParentID = parent
+			if !t.added[m.ID] {
+				t.moved[m.ID] = true
+			}
+		}
+		kept = append(kept, m)
+	}
+	for gone[t.head] {
+		h, _ := t.get(t.head)
+		t.head = h.ParentID
+	}
+	for _, m := range dropped {
+		delete(t.added, m.ID)
+		delete(t.moved, m.ID)
+	}
+	t.nodes = kept
+	t.reindex()
+	t.removed = append(t.removed, dropped...)
+	return dropped
+}
+
+func sortBranches(list []Branch) {
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+}
@@ -0,0 +1,107 @@
+package session
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/JekYUlll/eino-mini/internal/tokenizer"
+)
+
+// 每条消息除了内容本身还有 role / 分隔符等固定开销（OpenAI 的经验值是 3~4 个 token）。
+const messageOverheadTokens = 4
+
+// 图片等非文本片段的实际开销取决于模型和分辨率，这里按 OpenAI 低清图的 85 个 token 粗估。
+const mediaPartTokens = 85
+
+// Budget 是某个模型留给历史消息的 token 预算。
+type Budget struct {
+	Window    int // 模型上下文窗口
+	Reserve   int // 预留给回复的 token
+	Max       int // CHAT_MAX_TOKENS：额外的历史上限（控制成本），0 表示不限
+	Fixed     int // 会话摘要等固定注入的上下文已占用的 token
+	Tokenizer tokenizer.Tokenizer
+}
+
+// 常见模型的上下文窗口，按前缀匹配（越具体越靠前）。
+var knownWindows = []struct {
+	prefix string
+	window int
+}{
+	{"gpt-4.1", 1047576},
+	{"gpt-4o", 128000},
+	{"gpt-4-turbo", 128000},
+	{"gpt-4", 8192},
+	{"gpt-3.5-turbo", 16385},
+	{"gpt-5", 400000},
+	{"o1", 200000},
+	{"o3", 200000},
+	{"o4", 200000},
+	{"deepseek", 65536},
+	{"qwen", 32768},
+	{"glm", 128000},
+	{"moonshot", 128000},
+	{"kimi", 128000},
+	{"claude", 200000},
+	{"llama3", 8192},
+}
+
+// BudgetFor 返回模型的 token 预算。优先级：
+// CHAT_MODEL_BUDGETS（如 "deepseek-chat=65536/4096,qwen2.5:7b=32768"）>
+// 内置窗口表 > CHAT_CONTEXT_TOKENS（默认 8192）；
+// 预留默认取 CHAT_RESERVE_TOKENS（默认 1024）。
+func BudgetFor(model string) Budget {
+	b := Budget{
+		Window:    getIntEnv("CHAT_CONTEXT_TOKENS", 8192),
+		Reserve:   getIntEnv("CHAT_RESERVE_TOKENS", 1024),
+		Max:       getIntEnv("CHAT_MAX_TOKENS", 0),
+		Tokenizer: tokenizer.ForModel(model),
+	}
+
+	lower := strings.ToLower(model)
+	for _, k := range knownWindows {
+		if strings.HasPrefix(lower, k.prefix) {
+			b.Window = k.window
+			break
+		}
+	}
+
+	for _, item := range strings.Split(os.Getenv("CHAT_MODEL_BUDGETS"), ",") {
+		name, spec, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), model) {
+			continue
+		}
+		window, reserve, _ := strings.Cut(spec, "/")
+		if n, err := strconv.Atoi(strings.TrimSpace(window)); err == nil && n > 0 {
+			b.Window = n
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(reserve)); err == nil && n >= 0 {
+			b.Reserve = n
+		}
+		break
+	}
+	return b
+}
+
+// Limit 是历史消息（含 system）可用的 token 数。
+func (b Budget) Limit() int {
+	limit := b.Window - b.Reserve
+	if b.Max > 0 && b.Max < limit {
+		limit = b.Max
+	}
+	return max(limit-b.Fixed, 0)
+}
+
+// Count 估算一条消息占用的 token 数（工具调用的函数名和参数也算在内，非文本片段按固定值估算）。
+func (b Budget) Count(m Message) int {
+	n := b.Tokenizer.Count(m.Text()) + messageOverheadTokens
+	for _, p := range m.Parts {
+		if p.Type != PartText {
+			n += mediaPartTokens
+		}
+	}
+	for _, tc := range m.ToolCalls {
+		n += b.Tokenizer.Count(tc.Name) + b.Tokenizer.Count(tc.Arguments) + messageOverheadTokens
+	}
+	return n
+}
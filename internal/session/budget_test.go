@@ -0,0 +1,91 @@
+package session
+
+import (
+	"testing"
+
+	"github.com/JekYUlll/eino-mini/internal/tokenizer"
+)
+
+func TestBudgetCount(t *testing.T) {
+	b := Budget{Tokenizer: tokenizer.Get(tokenizer.Heuristic)}
+	cases := []struct {
+		name string
+		msg  Message
+		want int
+	}{
+		{"empty", Message{Role: "user"}, messageOverheadTokens},
+		{"text", Message{Role: "user", Content: "abcdefgh"}, 2 + messageOverheadTokens},
+		{"cjk", Message{Role: "user", Content: "你好世界"}, 4 + messageOverheadTokens},
+		{"parts", Message{Role: "user", Content: "ignored", Parts: []ContentPart{
+			{Type: PartText, Text: "abcd"},
+			{Type: PartImage, URL: "https://example.com/a.png"},
+		}}, 1 + messageOverheadTokens + mediaPartTokens},
+		{"tool calls", Message{Role: "assistant", ToolCalls: []ToolCall{
+			{Name: "search", Arguments: `{"q":"go"}`},
+		}}, messageOverheadTokens + 2 + 3 + messageOverheadTokens},
+	}
+	for _, c := range cases {
+		if got := b.Count(c.msg); got != c.want {
+			t.Errorf("%s: Count = %d, want %d", c.name, got, c.want)
+		}
+	}
+
+	// BPE 编码按真实 token 计数
+	bpe := Budget{Tokenizer: tokenizer.Get("cl100k_base")}
+	if got := bpe.Count(Message{Role: "user", Content: "hello world"}); got != 2+messageOverheadTokens {
+		t.Errorf("cl100k_base: Count = %d, want %d", got, 2+messageOverheadTokens)
+	}
+}
+
+func TestBudgetLimit(t *testing.T) {
+	cases := []struct {
+		name   string
+		budget Budget
+		want   int
+	}{
+		{"window minus reserve", Budget{Window: 8192, Reserve: 1024}, 7168},
+		{"max caps", Budget{Window: 8192, Reserve: 1024, Max: 2000}, 2000},
+		{"max above window", Budget{Window: 8192, Reserve: 1024, Max: 100000}, 7168},
+		{"fixed", Budget{Window: 8192, Reserve: 1024, Max: 2000, Fixed: 500}, 1500},
+		{"never negative", Budget{Window: 100, Reserve: 50, Fixed: 500}, 0},
+	}
+	for _, c := range cases {
+		if got := c.budget.Limit(); got != c.want {
+			t.Errorf("%s: Limit = %d, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+func TestBudgetFor(t *testing.T) {
+	t.Setenv("CHAT_CONTEXT_TOKENS", "")
+	t.Setenv("CHAT_RESERVE_TOKENS", "")
+	t.Setenv("CHAT_MAX_TOKENS", "")
+	t.Setenv("CHAT_TOKENIZER", "")
+	t.Setenv("CHAT_MODEL_BUDGETS", "qwen2.5:7b=16384/512, my-model = 4096")
+
+	cases := []struct {
+		model           string
+		window, reserve int
+		tokenizer       string
+	}{
+		{"gpt-4o-mini", 128000, 1024, "o200k_base"},
+		{"gpt-4", 8192, 1024, "cl100k_base"},
+		{"deepseek-chat", 65536, 1024, tokenizer.Heuristic},
+		{"qwen2.5:7b", 16384, 512, tokenizer.Heuristic},
+		{"my-model", 4096, 1024, tokenizer.Heuristic},
+		{"unknown", 8192, 1024, tokenizer.Heuristic},
+	}
+	for _, c := range cases {
+		b := BudgetFor(c.model)
+		if b.Window != c.window || b.Reserve != c.reserve || b.Tokenizer.Name() != c.tokenizer {
+			t.Errorf("%s: window %d reserve %d tokenizer %s, want %d %d %s",
+				c.model, b.Window, b.Reserve, b.Tokenizer.Name(), c.window, c.reserve, c.tokenizer)
+		}
+	}
+
+	t.Setenv("CHAT_CONTEXT_TOKENS", "2048")
+	t.Setenv("CHAT_MAX_TOKENS", "1000")
+	if b := BudgetFor("unknown"); b.Window != 2048 || b.Limit() != 1000 {
+		t.Errorf("env overrides: window %d limit %d", b.Window, b.Limit())
+	}
+}
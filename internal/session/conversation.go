@@ -0,0 +1,78 @@
+package session
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"time"
+)
+
+var (
+	ErrNotFound        = errors.New("conversation not found")
+	ErrExpired         = errors.New("conversation expired")
+	ErrMessageNotFound = errors.New("message not found")
+)
+
+// Conversation 是会话的元数据，由 Store 在写消息时顺带维护。
+// MessageCount 统计写入过的 user/assistant/tool 消息数（不含 system），不会因为裁剪而减少。
+type Conversation struct {
+	ID           string    `json:"id"`
+	Title        string    `json:"title"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	MessageCount int       `json:"message_count"`
+	Owner        string    `json:"owner,omitempty"`
+	Model        string    `json:"model,omitempty"`
+	Summary      string    `json:"summary,omitempty"`       // 滚动摘要（summarize 策略），概括已被裁剪的早期对话
+	PrunePolicy  string    `json:"prune_policy,omitempty"`  // 裁剪策略，空表示默认（CHAT_PRUNE_POLICY）
+	Tools        []string  `json:"tools,omitempty"`         // agent 可用的工具（名字或 path.Match 通配），空表示全部
+	ForkedFrom   string    `json:"forked_from,omitempty"`   // 从哪个会话 fork 出来的
+	Persona      string    `json:"persona,omitempty"`       // 创建时选用的人设
+	SystemPrompt string    `json:"system_prompt,omitempty"` // 会话自己的 system prompt，空表示默认（CHAT_SYSTEM_PROMPT）
+}
+
+// ConversationPatch 描述 UpdateConversation 可修改的字段，nil 表示不改。
+type ConversationPatch struct {
+	Title       *string   `json:"title,omitempty"`
+	PrunePolicy *string   `json:"prune_policy,omitempty"`
+	Tools       *[]string `json:"tools,omitempty"` // 空列表表示恢复为全部工具
+	// SystemPrompt 同时改写当前路径上的 system 消息，空串表示恢复默认
+	SystemPrompt *string `json:"system_prompt,omitempty"`
+
+	// 下面几个只在首轮选用人设时由服务端设置，PATCH 接口不开放。
+	Persona *string `json:"-"`
+	Model   *string `json:"-"`
+	// IfEmpty 为 true 时只在会话还没有写入过消息时修改，否则返回 ErrConflict，什么都不改。
+	IfEmpty bool `json:"-"`
+}
+
+func (p ConversationPatch) apply(c *Conversation) {
+	if p.Title != nil {
+		c.Title = *p.Title
+	}
+	if p.PrunePolicy != nil {
+		c.PrunePolicy = *p.PrunePolicy
+	}
+	if p.Tools != nil {
+		c.Tools = slices.Clone(*p.Tools)
+		if len(c.Tools) == 0 {
+			c.Tools = nil
+		}
+	}
+	if p.SystemPrompt != nil {
+		c.SystemPrompt = *p.SystemPrompt
+	}
+	if p.Persona != nil {
+		c.Persona = *p.Persona
+	}
+	if p.Model != nil {
+		c.Model = *p.Model
+	}
+}
+
+// sortConversations 按最近更新时间倒序。
+func sortConversations(list []Conversation) {
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].UpdatedAt.After(list[j].UpdatedAt)
+	})
+}
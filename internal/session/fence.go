@@ -0,0 +1,98 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// fencing：每次抢到会话锁都从一个只增不减的计数器取一个新号（Lease.Fence），
+// 持锁期间的写操作（追加 user、插入回复、裁剪、改写当前路径、改元数据、置顶、写摘要）都带着这个号，
+// 存储在同一个原子操作里确认计数器还是这个号才落盘。
+// 锁过期后被别人抢到、或者会话被删掉（计数器跟着删）时，旧持有者手里的号就对不上了，
+// 写入会被拒绝（ErrFenced），即使它还没发现租约已经丢了。
+// 计数器不存在时从当前毫秒时间戳开始取号，删掉重建的会话不会发出跟旧持有者相同的号。
+//
+// 写操作必须带号：没有用 WithFence 带号、也没有用 WithoutFence 声明不持锁的写入返回 ErrNoFence，
+// 忘了带号的调用方不会悄悄绕过校验。
+
+// ErrFenced 表示写入方持有的 fencing 号已经被更新的锁持有者取代。
+var ErrFenced = errors.New("conversation lock superseded by a newer holder")
+
+// ErrNoFence 表示写操作的 ctx 既没有 fencing 号，也没有用 WithoutFence 声明不持锁。
+var ErrNoFence = errors.New("conversation write without a fencing token")
+
+type fenceCtxKey struct{}
+
+// unfenced 是 WithoutFence 放进 ctx 的号，脚本里按“不校验”处理。
+const unfenced int64 = -1
+
+// WithFence 把 fencing 号带进 ctx，用这个 ctx 调用的写操作都会校验它。
+func WithFence(ctx context.Context, fence int64) context.Context {
+	return context.WithValue(ctx, fenceCtxKey{}, fence)
+}
+
+// WithoutFence 声明这次写入不持会话锁（元数据修改、后台标题和摘要、置顶），不做 fencing 校验。
+// 这些写入各自在一个原子操作里完成，不会跟持锁方的写入互相覆盖。
+func WithoutFence(ctx context.Context) context.Context {
+	return context.WithValue(ctx, fenceCtxKey{}, unfenced)
+}
+
+// fenceFrom 取 ctx 里的 fencing 号，WithoutFence 时返回 unfenced，都没有时返回 ErrNoFence。
+func fenceFrom(ctx context.Context) (int64, error) {
+	fence, _ := ctx.Value(fenceCtxKey{}).(int64)
+	if fence == 0 {
+		return 0, ErrNoFence
+	}
+	return fence, nil
+}
+
+// fenced 判断写入方的号 fence 是否还是计数器当前值 cur（unfenced 不校验）。
+func fenced(fence, cur int64) bool {
+	return fence != unfenced && fence != cur
+}
+
+// fenceSeed 是计数器不存在时的起始值。
+func fenceSeed() int64 {
+	return time.Now().UnixMilli()
+}
+
+func (s *RedisStore) fenceKey(convID string) string {
+	return "chat:fence:" + convID
+}
+
+// fenceCheck 是写脚本的公共开头：KEYS[1] 是 fencing 计数器，ARGV[1] 是写入方的号（-1 表示不校验）。
+const fenceCheck = `
+local fence = tonumber(ARGV[1])
+if fence ~= -1 and tonumber(redis.call("GET", KEYS[1]) or "0") ~= fence then
+  return redis.error_reply("FENCED")
+end
+`
+
+// fencedErr 把脚本返回的 FENCED 错误换成 ErrFenced（有的实现会在前面加上 ERR）。
+func fencedErr(err error) error {
+	if err != nil && strings.Contains(err.Error(), "FENCED") {
+		return ErrFenced
+	}
+	return err
+}
+
+// checkFence 在 WATCH 事务里校验 fencing 号，调用方要同时 WATCH fenceKey，
+// 这样校验之后有人抢到锁会让 EXEC 失败。
+func (s *RedisStore) checkFence(ctx context.Context, tx *redis.Tx, convID string) error {
+	fence, err := fenceFrom(ctx)
+	if err != nil || fence == unfenced {
+		return err
+	}
+	cur, err := tx.Get(ctx, s.fenceKey(convID)).Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+	if fenced(fence, cur) {
+		return ErrFenced
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// fencedWrites 是持锁方会做的写操作，setup 写好的会话里 q0 已经有回复 a0，还有一个 a1 的分支可以切。
+var fencedWrites = map[string]func(ctx context.Context, s Store, convID string, ids map[string]string) error{
+	"AppendUser": func(ctx context.Context, s Store, convID string, _ map[string]string) error {
+		_, _, err := s.AppendUser(ctx, convID, "q1")
+		return err
+	},
+	"InsertReply": func(ctx context.Context, s Store, convID string, ids map[string]string) error {
+		return s.InsertReply(ctx, convID, ids["pending"], []Message{{Role: "assistant", Content: "late"}})
+	},
+	"ReplaceReply": func(ctx context.Context, s Store, convID string, ids map[string]string) error {
+		_, err := s.ReplaceReply(ctx, convID, ids["q0"], []Message{{Role: "assistant", Content: "a2"}})
+		return err
+	},
+	"EditUser": func(ctx context.Context, s Store, convID string, ids map[string]string) error {
+		_, _, _, err := s.EditUser(ctx, convID, ids["q0"], "q0'")
+		return err
+	},
+	"SwitchBranch": func(ctx context.Context, s Store, convID string, ids map[string]string) error {
+		_, err := s.SwitchBranch(ctx, convID, ids["a0"])
+		return err
+	},
+	"Update": func(ctx context.Context, s Store, convID string, _ map[string]string) error {
+		_, err := s.Update(ctx, convID, func(cur []Message) ([]Message, error) { return cur[:1], nil })
+		return err
+	},
+	"UpdateConversation": func(ctx context.Context, s Store, convID string, _ map[string]string) error {
+		title := "renamed"
+		_, err := s.UpdateConversation(ctx, convID, ConversationPatch{Title: &title})
+		return err
+	},
+	"PinMessage": func(ctx context.Context, s Store, convID string, ids map[string]string) error {
+		_, err := s.PinMessage(ctx, convID, ids["q0"], true)
+		return err
+	},
+}
+
+// fenceSetup 在 convID 上写一段带分支的对话（q0 -> a0 被 a1 替换，之后追加了还没回复的 q1'），返回各条消息的 ID 和快照。
+func fenceSetup(t *testing.T, s Store, convID string) (map[string]string, []string) {
+	t.Helper()
+	ctx := WithoutFence(context.Background())
+	if _, err := s.EnsureConversation(ctx, Conversation{ID: convID}); err != nil {
+		t.Fatal(err)
+	}
+	_, q0, err := s.AppendUser(ctx, convID, "q0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.InsertAssistant(ctx, convID, q0, "a0"); err != nil {
+		t.Fatal(err)
+	}
+	ids := map[string]string{"q0": q0}
+	if msgs, err := s.History(ctx, convID); err == nil {
+		ids["a0"] = msgs[len(msgs)-1].ID
+	}
+	if _, err := s.ReplaceReply(ctx, convID, q0, []Message{{Role: "assistant", Content: "a1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ids["pending"], err = s.AppendUser(ctx, convID, "q1"); err != nil {
+		t.Fatal(err)
+	}
+	return ids, snapshot(t, s, convID)
+}
+
+// snapshot 是会话当前的样子：标题、当前路径和分支数。
+func snapshot(t *testing.T, s Store, convID string) []string {
+	t.Helper()
+	ctx := context.Background()
+	c, err := s.GetConversation(ctx, convID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := s.History(ctx, convID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	branches, err := s.Branches(ctx, convID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := append([]string{"title:" + c.Title}, describe(msgs)...)
+	for _, b := range branches {
+		out = append(out, "branch:"+b.Messages[0].Content)
+	}
+	return out
+}
+
+// 锁被更新的持有者抢走之后，旧持有者带着旧号的写入全部被拒（ErrFenced），会话不变；新持有者的号照常写入。
+func TestFencedWrites(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for op, write := range fencedWrites {
+				convID := "stale-" + op
+				ids, before := fenceSetup(t, s, convID)
+
+				stale, ok, err := s.AcquireLock(ctx, convID, 0, nil)
+				if err != nil || !ok {
+					t.Fatalf("acquire: ok=%v err=%v", ok, err)
+				}
+				stale.Release()
+				cur, ok, err := s.AcquireLock(ctx, convID, 0, nil)
+				if err != nil || !ok {
+					t.Fatalf("acquire: ok=%v err=%v", ok, err)
+				}
+
+				if err := write(WithFence(ctx, stale.Fence()), s, convID, ids); !errors.Is(err, ErrFenced) {
+					t.Errorf("%s with a stale fence: err = %v, want ErrFenced", op, err)
+				}
+				if after := snapshot(t, s, convID); !slices.Equal(after, before) {
+					t.Errorf("%s with a stale fence changed the conversation:\n%v\n%v", op, before, after)
+				}
+				if err := write(WithFence(ctx, cur.Fence()), s, convID, ids); err != nil {
+					t.Errorf("%s with the current fence: %v", op, err)
+				}
+				cur.Release()
+			}
+		})
+	}
+}
+
+// 没带号的写入返回 ErrNoFence；WithoutFence 声明不持锁的写入不校验，别人持锁时也能写。
+func TestUnfencedWrites(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for op, write := range fencedWrites {
+				convID := "unfenced-" + op
+				ids, before := fenceSetup(t, s, convID)
+
+				if err := write(ctx, s, convID, ids); !errors.Is(err, ErrNoFence) {
+					t.Errorf("%s without a fence: err = %v, want ErrNoFence", op, err)
+				}
+				if after := snapshot(t, s, convID); !slices.Equal(after, before) {
+					t.Errorf("%s without a fence changed the conversation:\n%v\n%v", op, before, after)
+				}
+
+				lease, ok, err := s.AcquireLock(ctx, convID, 0, nil)
+				if err != nil || !ok {
+					t.Fatalf("acquire: ok=%v err=%v", ok, err)
+				}
+				if err := write(WithoutFence(ctx), s, convID, ids); err != nil {
+					t.Errorf("%s WithoutFence while locked: %v", op, err)
+				}
+				lease.Release()
+			}
+		})
+	}
+}
+
+// 会话删掉之后计数器跟着删，删除前拿到的号写不进重建的会话。
+func TestFenceAfterDelete(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			fenceSetup(t, s, "c1")
+			lease, ok, err := s.AcquireLock(ctx, "c1", 0, nil)
+			if err != nil || !ok {
+				t.Fatalf("acquire: ok=%v err=%v", ok, err)
+			}
+			defer lease.Release()
+
+			if err := s.DeleteConversation(WithoutFence(ctx), "c1"); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := s.AppendUser(WithFence(ctx, lease.Fence()), "c1", "q"); !errors.Is(err, ErrFenced) {
+				t.Fatalf("append after delete: err = %v, want ErrFenced", err)
+			}
+		})
+	}
+}
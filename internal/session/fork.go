@@ -0,0 +1,37 @@
+package session
+
+// forkMessages 复制树上从根到 msgID（含）的路径，msgID 为空时复制当前路径：
+// 每条消息换一个新 ID，ParentID 跟着映射到新 ID，其余字段（时间、置顶、工具调用等）原样保留。
+// 返回原路径和副本（下标一一对应）；msgID 不在树上时返回 ErrMessageNotFound。
+func forkMessages(t *tree, msgID string) (src, out []Message, err error) {
+	src = t.path()
+	if msgID != "" {
+		if _, ok := t.get(msgID); !ok {
+			return nil, nil, ErrMessageNotFound
+		}
+		src = t.pathTo(msgID)
+	}
+	ids := make(map[string]string, len(src))
+	out = make([]Message, len(src))
+	for i, m := range src {
+		id := newID()
+		if m.ID != "" {
+			ids[m.ID] = id
+		}
+		m.ID = id
+		m.ParentID = ids[m.ParentID]
+		out[i] = m
+	}
+	return src, out, nil
+}
+
+// countMessages 统计非 system 消息数，对应 Conversation.MessageCount 的口径。
+func countMessages(msgs []Message) int {
+	n := 0
+	for _, m := range msgs {
+		if m.Role != "system" {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,122 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// 幂等键：客户端带同一个 Idempotency-Key 重试 /ask、/ask/stream 时，按键找到第一次请求的记录，
+// 回放它的结果，不再重复追加 user、重复调模型。记录先以 pending 写入，生成结束后改成 done / failed。
+
+const (
+	IdempotencyPending = "pending"
+	IdempotencyDone    = "done"
+	IdempotencyFailed  = "failed"
+)
+
+// IdempotencyRecord 是一个幂等键对应的请求。
+type IdempotencyRecord struct {
+	Key            string    `json:"key"`
+	ConversationID string    `json:"conversation_id"`
+	RequestHash    string    `json:"request_hash"`      // 请求体的哈希，同一个键换了请求内容时拒绝
+	UserID         string    `json:"user_id,omitempty"` // user 写入之后才有
+	Answer         string    `json:"answer,omitempty"`
+	Title          string    `json:"title,omitempty"`     // 首轮生成的会话标题
+	Persisted      bool      `json:"persisted,omitempty"` // 答案是否写进了会话（锁丢了、user 被裁剪时为 false）
+	Status         string    `json:"status"`
+	Error          string    `json:"error,omitempty"` // failed 时的错误信息
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// idempotencyPendingTTL 是 pending 记录的保留时间：处理请求的进程中途退出时，
+// 记录过期后重试会重新执行，而不是一直等下去。
+const idempotencyPendingTTL = 10 * time.Minute
+
+// ttl 是记录的保留时间：结束后的记录保留 CHAT_IDEMPOTENCY_TTL（默认 24h）。
+func (rec IdempotencyRecord) ttl() time.Duration {
+	if rec.Status == IdempotencyPending {
+		return idempotencyPendingTTL
+	}
+	return getDurationEnv("CHAT_IDEMPOTENCY_TTL", 24*time.Hour)
+}
+
+func (s *RedisStore) idempotencyKey(key string) string {
+	return "chat_idem:" + key
+}
+
+// idempotencySetKey 记下会话用过的幂等键，删除会话时一起删掉对应的记录。
+func (s *RedisStore) idempotencySetKey(convID string) string {
+	return "chat_idem_keys:" + convID
+}
+
+// trackIdempotency 把 rec 登记到会话的幂等键集合里，集合至少和最长的记录活得一样久。
+func (s *RedisStore) trackIdempotency(ctx context.Context, rec IdempotencyRecord) error {
+	key := s.idempotencySetKey(rec.ConversationID)
+	pipe := s.rdb.TxPipeline()
+	pipe.SAdd(ctx, key, rec.Key)
+	pipe.Expire(ctx, key, max(rec.ttl(), getDurationEnv("CHAT_IDEMPOTENCY_TTL", 24*time.Hour)))
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisStore) BeginIdempotency(ctx context.Context, rec IdempotencyRecord) (*IdempotencyRecord, bool, error) {
+	rec.UpdatedAt = nowUTC()
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return nil, false, err
+	}
+	// SET NX 失败后读之前记录刚好过期的话，再试一次
+	for i := 0; i < 2; i++ {
+		ok, err := s.rdb.SetNX(ctx, s.idempotencyKey(rec.Key), b, rec.ttl()).Result()
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			if err := s.trackIdempotency(ctx, rec); err != nil {
+				return nil, false, err
+			}
+			return &rec, true, nil
+		}
+		cur, err := s.GetIdempotency(ctx, rec.Key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		return cur, false, nil
+	}
+	return nil, false, ErrConflict
+}
+
+func (s *RedisStore) GetIdempotency(ctx context.Context, key string) (*IdempotencyRecord, error) {
+	data, err := s.rdb.Get(ctx, s.idempotencyKey(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec IdempotencyRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (s *RedisStore) SaveIdempotency(ctx context.Context, rec IdempotencyRecord) error {
+	rec.UpdatedAt = nowUTC()
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.rdb.Set(ctx, s.idempotencyKey(rec.Key), b, rec.ttl()).Err()
+}
+
+func (s *RedisStore) DeleteIdempotency(ctx context.Context, key string) error {
+	return s.rdb.Del(ctx, s.idempotencyKey(key)).Err()
+}
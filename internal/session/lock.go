@@ -2,12 +2,15 @@ package session
 
 import (
 	"context"
+	"errors"
 	"os"
+	"sync"
 	"time"
-
-	"github.com/google/uuid"
 )
 
+// ErrLeaseLost 表示会话锁在请求结束前丢了（续期失败、过期后被别人抢到），此时不应再写会话。
+var ErrLeaseLost = errors.New("conversation lock lease lost")
+
 func getDurationEnv(key string, def time.Duration) time.Duration {
 	v := os.Getenv(key)
 	if v == "" {
@@ -20,30 +23,155 @@ func getDurationEnv(key string, def time.Duration) time.Duration {
 	return d
 }
 
-// AcquireLock：给某个 convID 上锁，返回 token（解锁时要带 token）
-// 用 SET key value NX PX 实现。
-func (s *Store) AcquireLock(ctx context.Context, convID string) (token string, ok bool, err error) {
-	ttl := getDurationEnv("CHAT_LOCK_TTL", 20*time.Second)
-	key := "chat:lock:" + convID
-	token = uuid.NewString()
+// lockTTL 是会话锁的过期时间（CHAT_LOCK_TTL，默认 20s），持有期间由 Lease 按 1/3 周期续期。
+func lockTTL() time.Duration {
+	return getDurationEnv("CHAT_LOCK_TTL", 20*time.Second)
+}
 
-	ok, err = s.rdb.SetNX(ctx, key, token, ttl).Result()
-	return token, ok, err
+// locker 是 Lease 续期和释放要用到的后端操作。
+type locker interface {
+	RenewLock(ctx context.Context, convID, token string, ttl time.Duration) (bool, error)
+	ReleaseLock(ctx context.Context, convID, token string) error
 }
 
-// ReleaseLock：只允许持有 token 的请求解锁（Lua 校验 value）
-// 防止 A 的锁被 B 解掉。
-func (s *Store) ReleaseLock(ctx context.Context, convID, token string) error {
-	key := "chat:lock:" + convID
+// Lease 是抢到的会话锁。后台 goroutine 每 ttl/3 用 token 校验后续期一次，
+// 直到 Release 或 AcquireLock 传入的 ctx 结束；续期发现锁已经不是自己的
+// （或者连续失败超过一个 ttl）就认为租约丢了：Lost 关闭、Err 返回 ErrLeaseLost，持有方应放弃落库。
+type Lease struct {
+	convID string
+	token  string
+	fence  int64
+	ttl    time.Duration
+	store  locker
+
+	lost    chan struct{}
+	stop    chan struct{}
+	release sync.Once
+	lose    sync.Once
+}
+
+func newLease(ctx context.Context, store locker, convID, token string, fence int64, ttl time.Duration) *Lease {
+	l := &Lease{
+		convID: convID,
+		token:  token,
+		fence:  fence,
+		ttl:    ttl,
+		store:  store,
+		lost:   make(chan struct{}),
+		stop:   make(chan struct{}),
+	}
+	go l.keepAlive(ctx)
+	return l
+}
+
+// Token 是锁的持有凭证。
+func (l *Lease) Token() string { return l.token }
+
+// Fence 是这次抢锁拿到的 fencing 号，每次抢锁单调递增；用 WithFence 带给写操作。
+func (l *Lease) Fence() int64 { return l.fence }
+
+// Lost 在租约丢失时关闭。
+func (l *Lease) Lost() <-chan struct{} { return l.lost }
+
+// Err 在租约丢失后返回 ErrLeaseLost，否则返回 nil。
+func (l *Lease) Err() error {
+	select {
+	case <-l.lost:
+		return ErrLeaseLost
+	default:
+		return nil
+	}
+}
+
+// Release 停止续期并释放锁，可以重复调用。
+func (l *Lease) Release() {
+	l.release.Do(func() {
+		close(l.stop)
+		_ = l.store.ReleaseLock(context.Background(), l.convID, l.token)
+	})
+}
+
+func (l *Lease) keepAlive(ctx context.Context) {
+	t := time.NewTicker(l.ttl / 3)
+	defer t.Stop()
+
+	renewed := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-l.stop:
+			return
+		case <-t.C:
+		}
 
-	// KEYS[1]=key, ARGV[1]=token
+		rctx, cancel := context.WithTimeout(ctx, l.ttl/3)
+		ok, err := l.store.RenewLock(rctx, l.convID, l.token, l.ttl)
+		cancel()
+		switch {
+		case err == nil && ok:
+			renewed = time.Now()
+		case err == nil, time.Since(renewed) >= l.ttl:
+			// 续期途中 Release 了：锁是自己放掉的，不算丢
+			select {
+			case <-l.stop:
+				return
+			default:
+			}
+			l.lose.Do(func() { close(l.lost) })
+			return
+		}
+	}
+}
+
+// AcquireLock：排队给某个 convID 上锁，抢到时返回续期中的租约
+// 队首的等待者用 SET key value NX PX 抢锁，同一个脚本里 INCR fencing 计数器取号（见 lock_queue.go）。
+func (s *RedisStore) AcquireLock(ctx context.Context, convID string, wait time.Duration, queued func(pos int)) (*Lease, bool, error) {
+	ttl := lockTTL()
+	token, fence, err := waitLock(ctx, redisLockQueue{s}, convID, ttl, wait, queued)
+	if err != nil || fence == 0 {
+		return nil, false, err
+	}
+	return newLease(ctx, s, convID, token, fence, ttl), true, nil
+}
+
+// fenceTTL：计数器至少要比锁活得久，跟会话 TTL 走。
+func (s *RedisStore) fenceTTL(lock time.Duration) time.Duration {
+	return max(s.ttl, 2*lock)
+}
+
+func (s *RedisStore) lockKey(convID string) string {
+	return "chat:lock:" + convID
+}
+
+// RenewLock：只有锁还是 token 的时候才续期（Lua 校验 value 后 PEXPIRE），fencing 计数器一起续。
+func (s *RedisStore) RenewLock(ctx context.Context, convID, token string, ttl time.Duration) (bool, error) {
+	// KEYS[1]=lock, KEYS[2]=fence, ARGV[1]=token, ARGV[2]=lock ttl(ms), ARGV[3]=fence ttl(ms)
+	script := `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+  redis.call("PEXPIRE", KEYS[2], ARGV[3])
+  return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+else
+  return 0
+end
+`
+	n, err := s.rdb.Eval(ctx, script, []string{s.lockKey(convID), s.fenceKey(convID)},
+		token, ttl.Milliseconds(), s.fenceTTL(ttl).Milliseconds()).Int()
+	return n == 1, err
+}
+
+// ReleaseLock：只允许持有 token 的请求解锁（Lua 校验 value）
+// 防止 A 的锁被 B 解掉。解锁后通知排队的请求。
+func (s *RedisStore) ReleaseLock(ctx context.Context, convID, token string) error {
+	// KEYS[1]=key, KEYS[2]=channel, ARGV[1]=token
 	script := `
 if redis.call("GET", KEYS[1]) == ARGV[1] then
-  return redis.call("DEL", KEYS[1])
+  redis.call("DEL", KEYS[1])
+  return redis.call("PUBLISH", KEYS[2], "released")
 else
   return 0
 end
 `
-	_, err := s.rdb.Eval(ctx, script, []string{key}, token).Result()
+	_, err := s.rdb.Eval(ctx, script, []string{s.lockKey(convID), s.lockChannel(convID)}, token).Result()
 	return err
 }
@@ -0,0 +1,285 @@
+package session
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// 排队抢锁：等锁的请求按到达顺序排成队，只有排在队首的才去抢，
+// 锁释放（或者前面的人放弃排队）时通知等待者马上重试，不用定时轮询。
+// 持锁方崩溃时不会有释放通知，靠 lockPoll 兜底，等锁自然过期。
+
+// lockPoll 是排队时的兜底重试间隔。
+const lockPoll = time.Second
+
+// lockQueue 是排队抢锁在各个后端上的实现。
+type lockQueue interface {
+	// try 在 token 排到队首且锁空闲时抢锁并出队，返回 fencing 号；
+	// 没抢到时返回 0 和排在前面的人数，token 还没排队的话排到队尾。
+	try(ctx context.Context, convID, token string, ttl time.Duration) (fence int64, ahead int, err error)
+	// leave 放弃排队。
+	leave(ctx context.Context, convID, token string) error
+	// subscribe 返回一个在锁释放、队列前移时收到信号的 channel。
+	subscribe(ctx context.Context, convID string) (<-chan struct{}, func(), error)
+}
+
+// waitLock 排队抢锁，最多等 wait（<= 0 时只试一次）；排队位置变化时回调 queued（从 1 开始，1 表示下一个就轮到）。
+// 超时返回 fence=0。
+func waitLock(ctx context.Context, q lockQueue, convID string, ttl, wait time.Duration, queued func(pos int)) (token string, fence int64, err error) {
+	token = newID()
+	if fence, _, err = q.try(ctx, convID, token, ttl); err != nil || fence > 0 {
+		return token, fence, err
+	}
+	// 没抢到时 token 已经在队列里了，走的时候要出队（ctx 可能已经结束）
+	defer func() {
+		if fence == 0 {
+			_ = q.leave(context.WithoutCancel(ctx), convID, token)
+		}
+	}()
+	if wait <= 0 {
+		return token, 0, nil
+	}
+
+	changed, unsubscribe, err := q.subscribe(ctx, convID)
+	if err != nil {
+		return token, 0, err
+	}
+	defer unsubscribe()
+
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	poll := time.NewTicker(lockPoll)
+	defer poll.Stop()
+
+	pos := 0
+	for {
+		// 订阅之后先再试一次：第一次 try 和订阅之间的通知已经错过了
+		var ahead int
+		if fence, ahead, err = q.try(ctx, convID, token, ttl); err != nil || fence > 0 {
+			return token, fence, err
+		}
+		if queued != nil && ahead+1 != pos {
+			pos = ahead + 1
+			queued(pos)
+		}
+		select {
+		case <-changed:
+		case <-poll.C:
+		case <-timeout.C:
+			return token, 0, nil
+		case <-ctx.Done():
+			return token, 0, ctx.Err()
+		}
+	}
+}
+
+// localQueue 是单进程内的排队（内存和 SQLite 后端），锁本身仍由 lock 判断。
+// SQLite 文件被多个进程共用时，进程之间不保证先来先得，只靠 lockPoll 重试。
+type localQueue struct {
+	mu     sync.Mutex
+	tokens map[string][]string
+	subs   map[string]map[chan struct{}]struct{}
+	lock   func(ctx context.Context, convID, token string, ttl time.Duration) (int64, error)
+}
+
+func newLocalQueue(lock func(ctx context.Context, convID, token string, ttl time.Duration) (int64, error)) *localQueue {
+	return &localQueue{
+		tokens: map[string][]string{},
+		subs:   map[string]map[chan struct{}]struct{}{},
+		lock:   lock,
+	}
+}
+
+func (q *localQueue) try(ctx context.Context, convID, token string, ttl time.Duration) (int64, int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	list := q.tokens[convID]
+	idx := slices.Index(list, token)
+	if idx < 0 {
+		idx = len(list)
+	}
+	if idx == 0 {
+		fence, err := q.lock(ctx, convID, token, ttl)
+		if err != nil {
+			return 0, 0, err
+		}
+		if fence > 0 {
+			if len(list) > 0 {
+				q.remove(convID, token)
+				q.broadcast(convID)
+			}
+			return fence, 0, nil
+		}
+	}
+	if idx == len(list) {
+		q.tokens[convID] = append(list, token)
+	}
+	return 0, idx, nil
+}
+
+func (q *localQueue) leave(ctx context.Context, convID, token string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.remove(convID, token)
+	q.broadcast(convID)
+	return nil
+}
+
+func (q *localQueue) subscribe(ctx context.Context, convID string) (<-chan struct{}, func(), error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ch := make(chan struct{}, 1)
+	if q.subs[convID] == nil {
+		q.subs[convID] = map[chan struct{}]struct{}{}
+	}
+	q.subs[convID][ch] = struct{}{}
+	return ch, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		delete(q.subs[convID], ch)
+		if len(q.subs[convID]) == 0 {
+			delete(q.subs, convID)
+		}
+	}, nil
+}
+
+// notify 在锁释放后唤醒等待者（调用方不能持有会再去拿 q.mu 的锁）。
+func (q *localQueue) notify(convID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.broadcast(convID)
+}
+
+func (q *localQueue) remove(convID, token string) {
+	list := slices.DeleteFunc(q.tokens[convID], func(t string) bool { return t == token })
+	if len(list) == 0 {
+		delete(q.tokens, convID)
+		return
+	}
+	q.tokens[convID] = list
+}
+
+func (q *localQueue) broadcast(convID string) {
+	for ch := range q.subs[convID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Redis 上的排队：chat:lockq:<id> 是等待者 token 的 list，每个等待者每次重试都在 chat:lockw:<id>
+// 这个 hash 里刷新自己的存活期限（token -> 过期时间，毫秒，按 Redis 的 TIME 算），
+// 掉线的等待者过期后被后面的人从队列和 hash 里清掉。脚本用到的 key 都通过 KEYS 传入。
+// 抢到锁、放弃排队、释放锁都会 PUBLISH 到 chat:lockev:<id>。
+
+// waiterTTL 要比 lockPoll 长，正常等待的请求来不及过期。
+const waiterTTL = 5 * lockPoll
+
+func (s *RedisStore) lockQueueKey(convID string) string {
+	return "chat:lockq:" + convID
+}
+
+func (s *RedisStore) lockWaitersKey(convID string) string {
+	return "chat:lockw:" + convID
+}
+
+func (s *RedisStore) lockChannel(convID string) string {
+	return "chat:lockev:" + convID
+}
+
+// KEYS[1]=lock, KEYS[2]=fence, KEYS[3]=queue, KEYS[4]=channel, KEYS[5]=waiters
+// ARGV[1]=token, ARGV[2]=lock ttl(ms), ARGV[3]=fence ttl(ms), ARGV[4]=waiter ttl(ms),
+// ARGV[5]=计数器不存在时的起始值（见 fenceSeed）
+var tryLockScript = redis.NewScript(`
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+redis.call("HSET", KEYS[5], ARGV[1], now + tonumber(ARGV[4]))
+local ahead, queued = 0, false
+for _, token in ipairs(redis.call("LRANGE", KEYS[3], 0, -1)) do
+  if token == ARGV[1] then
+    queued = true
+    break
+  end
+  if tonumber(redis.call("HGET", KEYS[5], token) or "0") > now then
+    ahead = ahead + 1
+  else
+    redis.call("LREM", KEYS[3], 0, token)
+    redis.call("HDEL", KEYS[5], token)
+  end
+end
+if ahead == 0 and redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+  redis.call("HDEL", KEYS[5], ARGV[1])
+  if queued then
+    redis.call("LREM", KEYS[3], 0, ARGV[1])
+    redis.call("PUBLISH", KEYS[4], "acquired")
+  end
+  if redis.call("EXISTS", KEYS[2]) == 0 then
+    redis.call("SET", KEYS[2], ARGV[5])
+  end
+  local fence = redis.call("INCR", KEYS[2])
+  redis.call("PEXPIRE", KEYS[2], ARGV[3])
+  return {fence, 0}
+end
+if not queued then
+  redis.call("RPUSH", KEYS[3], ARGV[1])
+end
+redis.call("PEXPIRE", KEYS[3], ARGV[4])
+redis.call("PEXPIRE", KEYS[5], ARGV[4])
+return {0, ahead}
+`)
+
+// KEYS[1]=queue, KEYS[2]=channel, KEYS[3]=waiters, ARGV[1]=token
+var leaveLockScript = redis.NewScript(`
+redis.call("LREM", KEYS[1], 0, ARGV[1])
+redis.call("HDEL", KEYS[3], ARGV[1])
+redis.call("PUBLISH", KEYS[2], "left")
+return 1
+`)
+
+type redisLockQueue struct {
+	s *RedisStore
+}
+
+func (q redisLockQueue) try(ctx context.Context, convID, token string, ttl time.Duration) (int64, int, error) {
+	s := q.s
+	keys := []string{s.lockKey(convID), s.fenceKey(convID), s.lockQueueKey(convID), s.lockChannel(convID), s.lockWaitersKey(convID)}
+	res, err := tryLockScript.Run(ctx, s.rdb, keys,
+		token, ttl.Milliseconds(), s.fenceTTL(ttl).Milliseconds(), waiterTTL.Milliseconds(), fenceSeed()).Int64Slice()
+	if err != nil {
+		return 0, 0, err
+	}
+	return res[0], int(res[1]), nil
+}
+
+func (q redisLockQueue) leave(ctx context.Context, convID, token string) error {
+	s := q.s
+	keys := []string{s.lockQueueKey(convID), s.lockChannel(convID), s.lockWaitersKey(convID)}
+	return leaveLockScript.Run(ctx, s.rdb, keys, token).Err()
+}
+
+func (q redisLockQueue) subscribe(ctx context.Context, convID string) (<-chan struct{}, func(), error) {
+	ps := q.s.rdb.Subscribe(ctx, q.s.lockChannel(convID))
+	// 等订阅确认之后再返回，之后的 PUBLISH 都不会错过
+	if _, err := ps.Receive(ctx); err != nil {
+		_ = ps.Close()
+		return nil, nil, err
+	}
+	ch := make(chan struct{}, 1)
+	go func() {
+		for range ps.Channel() {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch, func() { _ = ps.Close() }, nil
+}
@@ -0,0 +1,156 @@
+package session
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// 等锁的请求按到达顺序拿到锁，排队位置从 1 开始往前挪。
+func TestLockQueueFIFO(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			holder, ok, err := s.AcquireLock(ctx, "c1", 0, nil)
+			if err != nil || !ok {
+				t.Fatalf("acquire: ok=%v err=%v", ok, err)
+			}
+
+			const n = 4
+			var (
+				mu        sync.Mutex
+				order     []int
+				positions = make([][]int, n)
+				wg        sync.WaitGroup
+			)
+			for i := range n {
+				queued := make(chan struct{})
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					first := true
+					lease, ok, err := s.AcquireLock(ctx, "c1", 5*time.Second, func(pos int) {
+						mu.Lock()
+						positions[i] = append(positions[i], pos)
+						mu.Unlock()
+						if first {
+							first = false
+							close(queued)
+						}
+					})
+					if err != nil || !ok {
+						t.Errorf("waiter %d: ok=%v err=%v", i, ok, err)
+						return
+					}
+					mu.Lock()
+					order = append(order, i)
+					mu.Unlock()
+					time.Sleep(10 * time.Millisecond)
+					lease.Release()
+				}()
+				// 等它排上队再放下一个，到达顺序才确定
+				select {
+				case <-queued:
+				case <-time.After(2 * time.Second):
+					t.Fatalf("waiter %d never queued", i)
+				}
+			}
+			holder.Release()
+			wg.Wait()
+
+			if want := []int{0, 1, 2, 3}; !slices.Equal(order, want) {
+				t.Fatalf("acquired in order %v, want %v", order, want)
+			}
+			for i, pos := range positions {
+				if len(pos) == 0 || pos[0] != i+1 {
+					t.Errorf("waiter %d positions %v, want to start at %d", i, pos, i+1)
+				}
+				if !slices.IsSortedFunc(pos, func(a, b int) int { return b - a }) {
+					t.Errorf("waiter %d positions %v, want non-increasing", i, pos)
+				}
+			}
+		})
+	}
+}
+
+// 直接跑 tryLockScript：只有队首能抢锁，锁空着时排在后面的也要等前面的人；
+// 过期的等待者被后面的人清掉，放弃排队的人让出位置。
+func TestRedisTryLockScript(t *testing.T) {
+	t.Setenv("REDIS_ADDR", miniredis.RunT(t).Addr())
+	s, err := NewRedisStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.rdb.Close() })
+
+	ctx := context.Background()
+	q := redisLockQueue{s}
+	const ttl = 10 * time.Second
+	try := func(token string, wantLock bool, wantAhead int) int64 {
+		t.Helper()
+		fence, ahead, err := q.try(ctx, "c1", token, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (fence > 0) != wantLock || ahead != wantAhead {
+			t.Fatalf("try(%s) = fence %d ahead %d, want lock %v ahead %d", token, fence, ahead, wantLock, wantAhead)
+		}
+		return fence
+	}
+	queue := func(want ...string) {
+		t.Helper()
+		got, err := s.rdb.LRange(ctx, s.lockQueueKey("c1"), 0, -1).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("queue = %v, want %v", got, want)
+		}
+	}
+
+	fa := try("A", true, 0)
+	try("B", false, 0)
+	try("C", false, 1)
+	try("D", false, 2)
+	try("C", false, 1) // 重试不会重复排队
+	queue("B", "C", "D")
+
+	// A 释放后锁空着，C 也抢不到：B 在它前面
+	if err := s.ReleaseLock(ctx, "c1", "A"); err != nil {
+		t.Fatal(err)
+	}
+	try("C", false, 1)
+	fb := try("B", true, 0)
+	if fb != fa+1 {
+		t.Fatalf("fence %d after %d, want +1", fb, fa)
+	}
+	queue("C", "D")
+	try("D", false, 1)
+
+	// C 掉线：存活期限过了，D 重试时把它清掉，B 释放后 D 就是队首
+	if err := s.rdb.HSet(ctx, s.lockWaitersKey("c1"), "C", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	try("D", false, 0)
+	queue("D")
+	if err := s.ReleaseLock(ctx, "c1", "B"); err != nil {
+		t.Fatal(err)
+	}
+	if fd := try("D", true, 0); fd != fb+1 {
+		t.Fatalf("fence %d after %d, want +1", fd, fb)
+	}
+	queue()
+
+	// E、F 排队，E 放弃之后 F 排到队首
+	try("E", false, 0)
+	try("F", false, 1)
+	if err := q.leave(ctx, "c1", "E"); err != nil {
+		t.Fatal(err)
+	}
+	try("F", false, 0)
+	queue("F")
+}
@@ -0,0 +1,191 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLocker 按 renew 的脚本回答续期，记下续期和释放的次数。
+type fakeLocker struct {
+	mu       sync.Mutex
+	renew    func(n int) (bool, error) // n 是第几次续期，从 1 开始
+	renews   int
+	releases int
+}
+
+func (f *fakeLocker) RenewLock(ctx context.Context, convID, token string, ttl time.Duration) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.renews++
+	return f.renew(f.renews)
+}
+
+func (f *fakeLocker) ReleaseLock(ctx context.Context, convID, token string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.releases++
+	return nil
+}
+
+func (f *fakeLocker) counts() (renews, releases int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.renews, f.releases
+}
+
+// waitLost 等租约丢失，最多等 d。
+func waitLost(l *Lease, d time.Duration) bool {
+	select {
+	case <-l.Lost():
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// 持有期间续期：锁活过好几个 TTL，别人抢不到；释放之后马上能抢到。
+func TestLeaseKeepAlive(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("CHAT_LOCK_TTL", "300ms")
+			ctx := context.Background()
+			lease, ok, err := s.AcquireLock(ctx, "c1", 0, nil)
+			if err != nil || !ok {
+				t.Fatalf("acquire: ok=%v err=%v", ok, err)
+			}
+			if waitLost(lease, time.Second) {
+				t.Fatal("lease lost while renewing")
+			}
+			if _, ok, err := s.AcquireLock(ctx, "c1", 0, nil); err != nil || ok {
+				t.Fatalf("second acquire while held: ok=%v err=%v", ok, err)
+			}
+
+			lease.Release()
+			lease.Release()
+			next, ok, err := s.AcquireLock(ctx, "c1", 0, nil)
+			if err != nil || !ok {
+				t.Fatalf("acquire after release: ok=%v err=%v", ok, err)
+			}
+			defer next.Release()
+			if next.Fence() <= lease.Fence() {
+				t.Fatalf("fence %d after %d, want increasing", next.Fence(), lease.Fence())
+			}
+			if lease.Err() != nil {
+				t.Fatalf("released lease reports %v", lease.Err())
+			}
+		})
+	}
+}
+
+// 锁被别人拿走（过期后被抢）之后，下一次续期发现不是自己的：Lost 关闭，Err 返回 ErrLeaseLost。
+func TestLeaseLost(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("CHAT_LOCK_TTL", "150ms")
+			ctx := context.Background()
+			lease, ok, err := s.AcquireLock(ctx, "c1", 0, nil)
+			if err != nil || !ok {
+				t.Fatalf("acquire: ok=%v err=%v", ok, err)
+			}
+			defer lease.Release()
+
+			// 相当于锁过期：用 token 删掉，再让另一个请求抢到
+			if err := s.ReleaseLock(ctx, "c1", lease.Token()); err != nil {
+				t.Fatal(err)
+			}
+			other, ok, err := s.AcquireLock(ctx, "c1", 0, nil)
+			if err != nil || !ok {
+				t.Fatalf("steal: ok=%v err=%v", ok, err)
+			}
+			defer other.Release()
+
+			if !waitLost(lease, time.Second) {
+				t.Fatal("lease not lost after the lock was taken")
+			}
+			if !errors.Is(lease.Err(), ErrLeaseLost) {
+				t.Fatalf("Err = %v, want ErrLeaseLost", lease.Err())
+			}
+			if other.Err() != nil {
+				t.Fatalf("new holder lost its lease: %v", other.Err())
+			}
+		})
+	}
+}
+
+func TestLeaseRenewErrors(t *testing.T) {
+	const ttl = 60 * time.Millisecond
+
+	t.Run("transient", func(t *testing.T) {
+		// 偶尔失败、一个 ttl 之内又续上的不算丢
+		f := &fakeLocker{renew: func(n int) (bool, error) {
+			if n%2 == 0 {
+				return false, errors.New("timeout")
+			}
+			return true, nil
+		}}
+		l := newLease(context.Background(), f, "c1", "tok", 1, ttl)
+		defer l.Release()
+		if waitLost(l, 5*ttl) {
+			t.Fatal("lease lost on transient renew errors")
+		}
+	})
+
+	t.Run("persistent", func(t *testing.T) {
+		// 连续失败超过一个 ttl 就认为丢了
+		f := &fakeLocker{renew: func(int) (bool, error) { return false, errors.New("connection refused") }}
+		l := newLease(context.Background(), f, "c1", "tok", 1, ttl)
+		defer l.Release()
+		if !waitLost(l, 5*ttl) {
+			t.Fatal("lease kept after failing to renew for a whole ttl")
+		}
+		if renews, _ := f.counts(); renews < 2 {
+			t.Fatalf("lost after %d renew attempts, want it to keep retrying for a ttl", renews)
+		}
+	})
+
+	t.Run("not owner", func(t *testing.T) {
+		// 续期明确答复锁不是自己的，马上丢
+		f := &fakeLocker{renew: func(int) (bool, error) { return false, nil }}
+		l := newLease(context.Background(), f, "c1", "tok", 1, ttl)
+		defer l.Release()
+		if !waitLost(l, ttl) {
+			t.Fatal("lease kept after the store said the lock is someone else's")
+		}
+	})
+}
+
+// Release 和 ctx 结束都会停止续期，但都不算租约丢失；Release 只释放一次。
+func TestLeaseStopsRenewing(t *testing.T) {
+	const ttl = 30 * time.Millisecond
+	ok := func(int) (bool, error) { return true, nil }
+
+	f := &fakeLocker{renew: ok}
+	l := newLease(context.Background(), f, "c1", "tok", 1, ttl)
+	time.Sleep(3 * ttl)
+	l.Release()
+	l.Release()
+	// 释放时可能正好有一次续期在路上，等它结束再数
+	time.Sleep(ttl)
+	before, releases := f.counts()
+	time.Sleep(3 * ttl)
+	if after, _ := f.counts(); before == 0 || after != before {
+		t.Fatalf("renews: %d before release, %d after", before, after)
+	}
+	if releases != 1 || l.Err() != nil {
+		t.Fatalf("releases %d, Err %v", releases, l.Err())
+	}
+
+	f = &fakeLocker{renew: ok}
+	ctx, cancel := context.WithCancel(context.Background())
+	l = newLease(ctx, f, "c1", "tok", 1, ttl)
+	cancel()
+	time.Sleep(ttl)
+	before, _ = f.counts()
+	time.Sleep(3 * ttl)
+	if after, _ := f.counts(); after != before || l.Err() != nil {
+		t.Fatalf("renews %d -> %d after ctx done, Err %v", before, after, l.Err())
+	}
+}
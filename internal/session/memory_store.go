@@ -0,0 +1,567 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MemoryStore 是进程内的 Store 实现，语义与 RedisStore 保持一致
+// （TTL 过期、写入时裁剪、带 token 的锁），用于本地开发和单元测试。
+// 过期数据在访问时惰性清理，另外每隔一个 TTL 顺带扫一遍；
+// 过期的会话在 tombstones 里留一个时间戳，用于区分过期和不存在。
+type MemoryStore struct {
+	ttl time.Duration
+
+	mu         sync.Mutex
+	convs      map[string]*memConv
+	locks      map[string]memLock
+	fences     map[string]int64 // fencing 计数器，释放锁时保留
+	queue      *localQueue
+	idem       map[string]memIdem // 幂等键记录
+	tombstones map[string]time.Time
+	lastGC     time.Time
+}
+
+type memConv struct {
+	nodes    []Message // 整棵消息树，按写入顺序
+	head     string    // 当前激活的叶子
+	meta     Conversation
+	pending  []Message // 被裁剪、还没并入摘要的消息
+	expireAt time.Time
+}
+
+type memIdem struct {
+	rec      IdempotencyRecord
+	expireAt time.Time
+}
+
+type memLock struct {
+	token    string
+	expireAt time.Time
+}
+
+func NewMemoryStore() (*MemoryStore, error) {
+	ttl, err := sessionTTL()
+	if err != nil {
+		return nil, err
+	}
+	s := &MemoryStore{
+		ttl:        ttl,
+		convs:      map[string]*memConv{},
+		locks:      map[string]memLock{},
+		fences:     map[string]int64{},
+		idem:       map[string]memIdem{},
+		tombstones: map[string]time.Time{},
+		lastGC:     time.Now(),
+	}
+	s.queue = newLocalQueue(s.tryLock)
+	return s, nil
+}
+
+func (s *MemoryStore) NewConversationID() string {
+	return newID()
+}
+
+// conv 返回未过期的会话（调用方需持有 s.mu），不存在时返回 nil。
+func (s *MemoryStore) conv(id string, now time.Time) *memConv {
+	c, ok := s.convs[id]
+	if !ok {
+		return nil
+	}
+	if !now.Before(c.expireAt) {
+		s.expire(id, c)
+		return nil
+	}
+	return c
+}
+
+// expire 删除过期会话并留下 tombstone（调用方需持有 s.mu）。
+func (s *MemoryStore) expire(id string, c *memConv) {
+	delete(s.convs, id)
+	s.tombstones[id] = c.expireAt
+}
+
+// missing 返回会话不存在时应报的错误（调用方需持有 s.mu）。
+func (s *MemoryStore) missing(id string) error {
+	if _, ok := s.tombstones[id]; ok {
+		return ErrExpired
+	}
+	return ErrNotFound
+}
+
+// tree 返回未过期会话的消息树（副本，调用方需持有 s.mu），会话不存在时是空树。
+func (s *MemoryStore) tree(id string, now time.Time) *tree {
+	if c := s.conv(id, now); c != nil {
+		return newTree(c.nodes, c.head)
+	}
+	return newTree(nil, "")
+}
+
+// writeConfig 按会话元数据取写入配置（调用方需持有 s.mu）。
+func (s *MemoryStore) writeConfig(id string, now time.Time) writeConfig {
+	if c := s.conv(id, now); c != nil {
+		return writeConfig{
+			pruneConfig: newPruneConfig(c.meta.Model, c.meta.PrunePolicy, c.meta.Summary),
+			prompt:      c.meta.SystemPrompt,
+			owner:       c.meta.Owner,
+		}
+	}
+	return writeConfig{pruneConfig: newPruneConfig("", "", "")}
+}
+
+// ensure 返回会话，不存在时创建空会话（调用方需持有 s.mu）。
+func (s *MemoryStore) ensure(id string, now time.Time) *memConv {
+	if c := s.conv(id, now); c != nil {
+		return c
+	}
+	c := &memConv{
+		meta:     Conversation{ID: id, CreatedAt: now, UpdatedAt: now},
+		expireAt: now.Add(s.ttl),
+	}
+	s.convs[id] = c
+	delete(s.tombstones, id)
+	s.gc(now)
+	return c
+}
+
+// store 写入消息树并刷新 TTL / 元数据（调用方需持有 s.mu）；空树只清空消息，标题、归属、策略等元数据保留，
+// 和 Redis / SQLite 一致。added 是本次新增的 user/assistant 消息数。
+func (s *MemoryStore) store(id string, t *tree, added int, now time.Time) {
+	if len(t.nodes) == 0 && s.conv(id, now) == nil {
+		return
+	}
+	c := s.ensure(id, now)
+	c.nodes = t.nodes
+	c.head = t.head
+	c.meta.UpdatedAt = now
+	c.meta.MessageCount += added
+	c.expireAt = now.Add(s.ttl)
+}
+
+// write 见 treeStore：在 s.mu 里改写消息树，按会话策略裁剪当前路径（tree.prune），
+// 策略要求摘要时把丢弃的消息记入待摘要队列。
+func (s *MemoryStore) write(ctx context.Context, id string, fn treeWrite) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkFence(ctx, id); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	cfg := s.writeConfig(id, now)
+	t := s.tree(id, now)
+	added, err := fn(t, cfg)
+	if errors.Is(err, errNoWrite) {
+		return injectSummary(t.path(), cfg.summary), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	plan := cfg.plan(t.path())
+	if dropped := t.prune(plan); len(dropped) > 0 && plan.Summarize {
+		c := s.ensure(id, now)
+		c.pending = append(c.pending, dropped...)
+	}
+	s.store(id, t, added, now)
+	return injectSummary(t.path(), cfg.summary), nil
+}
+
+func (s *MemoryStore) gc(now time.Time) {
+	if now.Sub(s.lastGC) < s.ttl {
+		return
+	}
+	s.lastGC = now
+	for id, c := range s.convs {
+		if !now.Before(c.expireAt) {
+			s.expire(id, c)
+		}
+	}
+	for id, t := range s.tombstones {
+		if now.Sub(t) > tombstoneTTL() {
+			delete(s.tombstones, id)
+		}
+	}
+	for id, l := range s.locks {
+		if !now.Before(l.expireAt) {
+			delete(s.locks, id)
+		}
+	}
+	for key, e := range s.idem {
+		if !now.Before(e.expireAt) {
+			delete(s.idem, key)
+		}
+	}
+	for id := range s.fences {
+		_, live := s.convs[id]
+		_, locked := s.locks[id]
+		if !live && !locked {
+			delete(s.fences, id)
+		}
+	}
+}
+
+// checkFence 校验 ctx 里的 fencing 号（调用方持有 s.mu，校验和写入在同一把锁里）。
+func (s *MemoryStore) checkFence(ctx context.Context, convID string) error {
+	fence, err := fenceFrom(ctx)
+	if err != nil {
+		return err
+	}
+	if fenced(fence, s.fences[convID]) {
+		return ErrFenced
+	}
+	return nil
+}
+
+func (s *MemoryStore) Load(ctx context.Context, id string) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	return injectSummary(s.tree(id, now).path(), s.writeConfig(id, now).summary), nil
+}
+
+func (s *MemoryStore) History(ctx context.Context, id string) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.conv(id, now) == nil {
+		return nil, s.missing(id)
+	}
+	return s.tree(id, now).path(), nil
+}
+
+func (s *MemoryStore) Update(
+	ctx context.Context,
+	id string,
+	updater func(cur []Message) ([]Message, error),
+) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkFence(ctx, id); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	next, err := updater(s.tree(id, now).path())
+	if err != nil {
+		return nil, err
+	}
+	s.store(id, linearTree(next), 0, now)
+	return next, nil
+}
+
+func (s *MemoryStore) AppendUser(ctx context.Context, convID string, userContent string) ([]Message, string, error) {
+	return appendUserTo(ctx, s, convID, userContent)
+}
+
+func (s *MemoryStore) InsertAssistant(ctx context.Context, convID, userID, assistantContent string) error {
+	return s.InsertReply(ctx, convID, userID, []Message{{Role: "assistant", Content: assistantContent}})
+}
+
+func (s *MemoryStore) InsertReply(ctx context.Context, convID, userID string, reply []Message) error {
+	return insertReplyTo(ctx, s, convID, userID, reply)
+}
+
+func (s *MemoryStore) ReplaceReply(ctx context.Context, convID, userID string, reply []Message) (*Branch, error) {
+	return replaceReplyIn(ctx, s, convID, userID, reply)
+}
+
+func (s *MemoryStore) Branches(ctx context.Context, convID string) ([]Branch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.conv(convID, now) == nil {
+		return nil, s.missing(convID)
+	}
+	return s.tree(convID, now).branches(), nil
+}
+
+func (s *MemoryStore) EditUser(ctx context.Context, convID, msgID, content string) ([]Message, string, *Branch, error) {
+	return editUserIn(ctx, s, convID, msgID, content)
+}
+
+func (s *MemoryStore) SwitchBranch(ctx context.Context, convID, branchID string) (*Branch, error) {
+	return switchBranchIn(ctx, s, convID, branchID)
+}
+
+func (s *MemoryStore) Fork(ctx context.Context, convID, msgID, newID string) (*Conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	src := s.conv(convID, now)
+	if src == nil {
+		return nil, s.missing(convID)
+	}
+	_, msgs, err := forkMessages(s.tree(convID, now), msgID)
+	if err != nil {
+		return nil, err
+	}
+	// 树上留下的消息都在摘要覆盖的范围之后，摘要和待摘要队列对新会话同样适用
+	c := s.ensure(newID, now)
+	fork := linearTree(msgs)
+	c.nodes, c.head = fork.nodes, fork.head
+	c.pending = slices.Clone(src.pending)
+	c.meta = src.meta
+	c.meta.ID = newID
+	c.meta.Tools = slices.Clone(src.meta.Tools)
+	c.meta.CreatedAt = now
+	c.meta.UpdatedAt = now
+	c.meta.MessageCount = countMessages(msgs)
+	c.meta.ForkedFrom = convID
+	meta := c.meta
+	return &meta, nil
+}
+
+func (s *MemoryStore) PendingSummary(ctx context.Context, id string) (string, []Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.conv(id, time.Now())
+	if c == nil {
+		return "", nil, s.missing(id)
+	}
+	return c.meta.Summary, append([]Message(nil), c.pending...), nil
+}
+
+func (s *MemoryStore) SaveSummary(ctx context.Context, id, prev, summary string, batch []Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkFence(ctx, id); err != nil {
+		return err
+	}
+	c := s.conv(id, time.Now())
+	if c == nil {
+		return s.missing(id)
+	}
+	if c.meta.Summary != prev {
+		return ErrConflict
+	}
+	c.meta.Summary = summary
+	c.pending = c.pending[min(len(batch), len(c.pending)):]
+	return nil
+}
+
+func (s *MemoryStore) PinMessage(ctx context.Context, convID, msgID string, pinned bool) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkFence(ctx, convID); err != nil {
+		return nil, err
+	}
+	c := s.conv(convID, time.Now())
+	if c == nil {
+		return nil, s.missing(convID)
+	}
+	for i := range c.nodes {
+		if c.nodes[i].ID == msgID {
+			c.nodes[i].Pinned = pinned
+			m := c.nodes[i]
+			return &m, nil
+		}
+	}
+	return nil, ErrMessageNotFound
+}
+
+func (s *MemoryStore) AcquireLock(ctx context.Context, convID string, wait time.Duration, queued func(pos int)) (*Lease, bool, error) {
+	ttl := lockTTL()
+	token, fence, err := waitLock(ctx, s.queue, convID, ttl, wait, queued)
+	if err != nil || fence == 0 {
+		return nil, false, err
+	}
+	return newLease(ctx, s, convID, token, fence, ttl), true, nil
+}
+
+// tryLock 在锁空闲（或已过期）时给 token 上锁，返回新的 fencing 号；锁被占着时返回 0。
+func (s *MemoryStore) tryLock(ctx context.Context, convID, token string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if l, ok := s.locks[convID]; ok && now.Before(l.expireAt) {
+		return 0, nil
+	}
+	s.locks[convID] = memLock{
+		token:    token,
+		expireAt: now.Add(ttl),
+	}
+	if _, ok := s.fences[convID]; !ok {
+		s.fences[convID] = fenceSeed()
+	}
+	s.fences[convID]++
+	return s.fences[convID], nil
+}
+
+func (s *MemoryStore) RenewLock(ctx context.Context, convID, token string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	l, ok := s.locks[convID]
+	if !ok || l.token != token || !now.Before(l.expireAt) {
+		return false, nil
+	}
+	l.expireAt = now.Add(ttl)
+	s.locks[convID] = l
+	return true, nil
+}
+
+func (s *MemoryStore) ReleaseLock(ctx context.Context, convID, token string) error {
+	s.mu.Lock()
+	l, ok := s.locks[convID]
+	if ok && l.token == token {
+		delete(s.locks, convID)
+	}
+	s.mu.Unlock()
+
+	if ok && l.token == token {
+		s.queue.notify(convID)
+	}
+	return nil
+}
+
+func (s *MemoryStore) EnsureConversation(ctx context.Context, c Conversation) (*Conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if cur := s.conv(c.ID, now); cur != nil {
+		meta := cur.meta
+		return &meta, nil
+	}
+	cur := s.ensure(c.ID, now)
+	cur.meta.Title = c.Title
+	cur.meta.Owner = c.Owner
+	cur.meta.Model = c.Model
+	cur.meta.Persona = c.Persona
+	cur.meta.SystemPrompt = c.SystemPrompt
+	cur.meta.Tools = slices.Clone(c.Tools)
+	meta := cur.meta
+	return &meta, nil
+}
+
+func (s *MemoryStore) GetConversation(ctx context.Context, id string) (*Conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.conv(id, time.Now())
+	if c == nil {
+		return nil, s.missing(id)
+	}
+	meta := c.meta
+	return &meta, nil
+}
+
+func (s *MemoryStore) ListConversations(ctx context.Context, owner string) ([]Conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	out := make([]Conversation, 0, len(s.convs))
+	for id := range s.convs {
+		c := s.conv(id, now)
+		if c == nil || c.meta.Owner != owner {
+			continue
+		}
+		out = append(out, c.meta)
+	}
+	sortConversations(out)
+	return out, nil
+}
+
+func (s *MemoryStore) UpdateConversation(ctx context.Context, id string, patch ConversationPatch) (*Conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkFence(ctx, id); err != nil {
+		return nil, err
+	}
+	c := s.conv(id, time.Now())
+	if c == nil {
+		return nil, s.missing(id)
+	}
+	if patch.IfEmpty && (c.meta.MessageCount > 0 || len(c.nodes) > 0) {
+		return nil, ErrConflict
+	}
+	patch.apply(&c.meta)
+	// 树根是第一条写入的消息
+	if patch.SystemPrompt != nil && len(c.nodes) > 0 && c.nodes[0].Role == "system" {
+		c.nodes[0].Content = systemPrompt(c.meta.SystemPrompt)
+	}
+	meta := c.meta
+	return &meta, nil
+}
+
+// DeleteConversation 连同 fencing 计数器、锁和幂等键记录一起删掉，同一个 ID 重新创建的会话不会继承它们。
+func (s *MemoryStore) DeleteConversation(ctx context.Context, id string) error {
+	s.mu.Lock()
+	if s.conv(id, time.Now()) == nil {
+		delete(s.tombstones, id)
+		s.mu.Unlock()
+		return ErrNotFound
+	}
+	delete(s.convs, id)
+	delete(s.fences, id)
+	delete(s.locks, id)
+	for key, e := range s.idem {
+		if e.rec.ConversationID == id {
+			delete(s.idem, key)
+		}
+	}
+	s.mu.Unlock()
+
+	// 排队等锁的请求马上重试
+	s.queue.notify(id)
+	return nil
+}
+
+func (s *MemoryStore) BeginIdempotency(ctx context.Context, rec IdempotencyRecord) (*IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if e, ok := s.idem[rec.Key]; ok && now.Before(e.expireAt) {
+		cur := e.rec
+		return &cur, false, nil
+	}
+	rec.UpdatedAt = now.UTC()
+	s.idem[rec.Key] = memIdem{rec: rec, expireAt: now.Add(rec.ttl())}
+	return &rec, true, nil
+}
+
+func (s *MemoryStore) GetIdempotency(ctx context.Context, key string) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.idem[key]
+	if !ok || !time.Now().Before(e.expireAt) {
+		delete(s.idem, key)
+		return nil, ErrNotFound
+	}
+	rec := e.rec
+	return &rec, nil
+}
+
+func (s *MemoryStore) SaveIdempotency(ctx context.Context, rec IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	rec.UpdatedAt = now.UTC()
+	s.idem[rec.Key] = memIdem{rec: rec, expireAt: now.Add(rec.ttl())}
+	return nil
+}
+
+func (s *MemoryStore) DeleteIdempotency(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.idem, key)
+	return nil
+}
@@ -0,0 +1,95 @@
+package session
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestMemoryStoreEmptyUpdateKeepsMeta(t *testing.T) {
+	ctx := WithoutFence(context.Background())
+	s, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := s.NewConversationID()
+	if _, err := s.EnsureConversation(ctx, Conversation{ID: id, Title: "t", Owner: "alice", Persona: "coder"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.AppendUser(ctx, id, "hi"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Update(ctx, id, func(cur []Message) ([]Message, error) { return nil, nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := s.GetConversation(ctx, id)
+	if err != nil {
+		t.Fatalf("conversation gone after empty update: %v", err)
+	}
+	if c.Title != "t" || c.Owner != "alice" || c.Persona != "coder" {
+		t.Fatalf("metadata lost: %+v", c)
+	}
+	msgs, err := s.History(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 0 {
+		t.Fatalf("want no messages, got %d", len(msgs))
+	}
+}
+
+func TestMemoryStoreEmptyUpdateDoesNotCreate(t *testing.T) {
+	ctx := WithoutFence(context.Background())
+	s, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := s.NewConversationID()
+	if _, err := s.Update(ctx, id, func(cur []Message) ([]Message, error) { return nil, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetConversation(ctx, id); err == nil {
+		t.Fatal("empty update created a conversation")
+	}
+}
+
+func TestMemoryStoreReplaceReplyPrunes(t *testing.T) {
+	ctx := WithoutFence(context.Background())
+	s, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := s.NewConversationID()
+	if _, err := s.EnsureConversation(ctx, Conversation{ID: id, PrunePolicy: PolicyTurns}); err != nil {
+		t.Fatal(err)
+	}
+	var last string
+	for _, q := range []string{"q1", "q2"} {
+		_, userID, err := s.AppendUser(ctx, id, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.InsertReply(ctx, id, userID, []Message{{Role: "assistant", Content: "a-" + q}}); err != nil {
+			t.Fatal(err)
+		}
+		last = userID
+	}
+	// 窗口收紧到 1 轮：重新生成也要按策略裁剪，和 InsertReply 一样
+	t.Setenv("CHAT_MAX_TURNS", "1")
+	if _, err := s.ReplaceReply(ctx, id, last, []Message{{Role: "assistant", Content: "again"}}); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := s.History(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range msgs {
+		got = append(got, m.Role+":"+m.Content)
+	}
+	if want := []string{"system:" + msgs[0].Content, "user:q2", "assistant:again"}; !slices.Equal(got, want) {
+		t.Fatalf("history after regenerate = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,85 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MessageVersion 是当前的消息存储格式：
+//
+//	1（老数据，没有 v 字段）：id / parent_id / role / content / created_at / pinned，工具字段可能有也可能没有
+//	2：加入 name / parts / tool_name，tool_calls 带 type
+//
+// 解码时老版本会就地升级，重新写回时总是按当前版本编码。
+const MessageVersion = 2
+
+// ErrMessageVersion 表示消息是更新版本的程序写入的，当前程序不认识。
+var ErrMessageVersion = errors.New("unsupported message version")
+
+// 内容片段类型，与 OpenAI / eino 的 ChatMessagePartType 一致。
+const (
+	PartText  = "text"
+	PartImage = "image_url"
+	PartAudio = "audio_url"
+	PartVideo = "video_url"
+	PartFile  = "file_url"
+)
+
+// ContentPart 是多模态消息里的一个片段：文本，或者 URL / base64 形式的图片、音频、视频、文件。
+type ContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Data     string `json:"data,omitempty"` // base64，和 URL 二选一
+	MIMEType string `json:"mime_type,omitempty"`
+	Detail   string `json:"detail,omitempty"` // 图片清晰度：high / low / auto
+}
+
+// messageJSON 是 Message 的默认 JSON 形式（没有自定义方法，避免递归）。
+type messageJSON Message
+
+func (m Message) MarshalJSON() ([]byte, error) {
+	out := messageJSON(m)
+	out.V = MessageVersion
+	return json.Marshal(out)
+}
+
+func (m *Message) UnmarshalJSON(b []byte) error {
+	var in messageJSON
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+	if in.V == 0 {
+		in.V = 1
+	}
+	if in.V > MessageVersion {
+		return fmt.Errorf("%w: %d (max %d)", ErrMessageVersion, in.V, MessageVersion)
+	}
+	if in.V < 2 {
+		// v1 的工具调用没有 type
+		for i := range in.ToolCalls {
+			if in.ToolCalls[i].Type == "" {
+				in.ToolCalls[i].Type = "function"
+			}
+		}
+	}
+	in.V = MessageVersion
+	*m = Message(in)
+	return nil
+}
+
+// Text 返回消息的纯文本：有 Parts 时拼接其中的文本片段，否则就是 Content。
+func (m Message) Text() string {
+	if len(m.Parts) == 0 {
+		return m.Content
+	}
+	var texts []string
+	for _, p := range m.Parts {
+		if p.Type == PartText && p.Text != "" {
+			texts = append(texts, p.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
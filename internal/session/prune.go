@@ -1,8 +1,12 @@
 package session
 
 import (
+	"fmt"
+	"math"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 )
 
 func getIntEnv(key string, def int) int {
@@ -17,130 +21,205 @@ func getIntEnv(key string, def int) int {
 	return n
 }
 
-// Prune 会：
-// 1) 永远保留最早的 system（如果存在）
-// 2) 只保留最后 N 轮（1轮 = user+assistant；不完整的一轮也算）
-// 3) 再按字符数上限裁剪最早的对话内容
-func Prune(msgs []Message) []Message {
-	if len(msgs) == 0 {
-		return msgs
-	}
-
-	maxTurns := getIntEnv("CHAT_MAX_TURNS", 10)
-	maxChars := getIntEnv("CHAT_MAX_CHARS", 24000)
+// PrunePlan 是一次裁剪的结果，三个后端都按它执行（Redis / 内存在写入时删掉丢弃的消息，SQLite 在读取时跳过），保证一致：
+// msgs[Tail:] 全部保留；Tail 之前只保留 Keep 里的下标（开头的 system、置顶消息），其余丢弃。
+type PrunePlan struct {
+	Keep      []int // Tail 之前仍保留的消息下标，升序
+	Tail      int
+	Summarize bool // 丢弃的消息进入待摘要队列
+}
 
-	// 1) 找 system（我们约定 system 只放第一条）
-	var system *Message
-	start := 0
-	if msgs[0].Role == "system" {
-		system = &msgs[0]
-		start = 1
+// Apply 返回裁剪后的消息（新切片）。
+func (p PrunePlan) Apply(msgs []Message) []Message {
+	out := make([]Message, 0, len(p.Keep)+len(msgs)-p.Tail)
+	for _, i := range p.Keep {
+		out = append(out, msgs[i])
 	}
+	return append(out, msgs[p.Tail:]...)
+}
 
-	rest := msgs[start:]
-
-	// 2) 轮次裁剪：保留最后 maxTurns 轮
-	// 将 rest 从尾部往前数，遇到 user 认为是新一轮开始
-	turnStarts := make([]int, 0, maxTurns+1)
-	for i := len(rest) - 1; i >= 0; i-- {
-		if rest[i].Role == "user" {
-			turnStarts = append(turnStarts, i)
-			if len(turnStarts) >= maxTurns {
-				break
-			}
+// Dropped 返回被丢弃的消息，按原顺序。
+func (p PrunePlan) Dropped(msgs []Message) []Message {
+	var out []Message
+	for i := range msgs[:p.Tail] {
+		if !slices.Contains(p.Keep, i) {
+			out = append(out, msgs[i])
 		}
 	}
-	// 如果 user 条数不足，说明总轮数 <= maxTurns，不裁剪
-	cut := 0
-	if len(turnStarts) >= maxTurns {
-		// turnStarts[0] 是最后一轮的 user，下标越大越早
-		// 我们要保留“最早的那轮”的起点
-		cut = turnStarts[len(turnStarts)-1]
+	return out
+}
+
+// PrunePolicy 决定一段历史里哪些消息继续送给模型。
+// 约定：开头的 system 永远保留，最后一条消息永远保留。
+type PrunePolicy interface {
+	Name() string
+	Plan(msgs []Message, budget Budget) PrunePlan
+}
+
+const (
+	PolicyTurns     = "turns"
+	PolicyTokens    = "tokens"
+	PolicySliding   = "sliding"
+	PolicySummarize = "summarize"
+)
+
+// TurnWindow 只保留最后 MaxTurns 轮（1 轮 = user+assistant；不完整的一轮也算），不看 token。
+type TurnWindow struct{ MaxTurns int }
+
+func (TurnWindow) Name() string { return PolicyTurns }
+
+func (p TurnWindow) Plan(msgs []Message, _ Budget) PrunePlan {
+	return planWindow(msgs, Budget{}, p.MaxTurns, false, false)
+}
+
+// TokenBudget 从后往前累加，超出模型 token 预算（窗口 - 回复预留 - system）的更早消息丢弃。
+type TokenBudget struct{}
+
+func (TokenBudget) Name() string { return PolicyTokens }
+
+func (TokenBudget) Plan(msgs []Message, budget Budget) PrunePlan {
+	return planWindow(msgs, budget, 0, true, false)
+}
+
+// SlidingWindow 先按轮次、再按 token 预算裁剪，置顶（Pinned）的消息不会被裁掉，
+// 它们的 token 先从预算里扣除。这是默认策略。
+type SlidingWindow struct{ MaxTurns int }
+
+func (SlidingWindow) Name() string { return PolicySliding }
+
+func (p SlidingWindow) Plan(msgs []Message, budget Budget) PrunePlan {
+	return planWindow(msgs, budget, p.MaxTurns, true, true)
+}
+
+// SummarizeAndDrop 按 Inner 裁剪，丢弃的消息交给滚动摘要（见 summary.go）。
+type SummarizeAndDrop struct{ Inner PrunePolicy }
+
+func (SummarizeAndDrop) Name() string { return PolicySummarize }
+
+func (p SummarizeAndDrop) Plan(msgs []Message, budget Budget) PrunePlan {
+	plan := p.Inner.Plan(msgs, budget)
+	plan.Summarize = true
+	return plan
+}
+
+// ParsePolicy 按名字构造策略，空串表示默认策略（CHAT_PRUNE_POLICY）。
+func ParsePolicy(name string) (PrunePolicy, error) {
+	maxTurns := getIntEnv("CHAT_MAX_TURNS", 10)
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "":
+		return defaultPolicy(), nil
+	case PolicyTurns:
+		return TurnWindow{MaxTurns: maxTurns}, nil
+	case PolicyTokens:
+		return TokenBudget{}, nil
+	case PolicySliding:
+		return SlidingWindow{MaxTurns: maxTurns}, nil
+	case PolicySummarize:
+		return SummarizeAndDrop{Inner: SlidingWindow{MaxTurns: maxTurns}}, nil
+	default:
+		return nil, fmt.Errorf("unknown prune policy %q (want turns, tokens, sliding or summarize)", name)
 	}
+}
 
-	kept := rest
-	if cut > 0 && cut < len(rest) {
-		kept = rest[cut:]
+// PolicyFor 返回会话实际使用的策略，未知名字按默认处理。
+func PolicyFor(name string) PrunePolicy {
+	p, err := ParsePolicy(name)
+	if err != nil {
+		return defaultPolicy()
 	}
+	return p
+}
 
-	// 3) 字符数裁剪（第二道保险）：从后往前累加，超过就截掉更早的
-	total := 0
-	idx := len(kept)
-	for i := len(kept) - 1; i >= 0; i-- {
-		total += len(kept[i].Content)
-		if total > maxChars {
-			idx = i + 1
-			break
-		}
+// defaultPolicy：CHAT_PRUNE_POLICY 指定的策略；未指定时 CHAT_SUMMARIZE=true 相当于 summarize，否则 sliding。
+func defaultPolicy() PrunePolicy {
+	name := os.Getenv("CHAT_PRUNE_POLICY")
+	if name == "" && summaryEnabled() {
+		name = PolicySummarize
 	}
-	if idx < len(kept) {
-		kept = kept[idx:]
+	if name == "" {
+		name = PolicySliding
 	}
-
-	// 4) 拼回 system
-	if system != nil {
-		out := make([]Message, 0, 1+len(kept))
-		out = append(out, *system)
-		out = append(out, kept...)
-		return out
+	p, err := ParsePolicy(name)
+	if err != nil {
+		return SlidingWindow{MaxTurns: getIntEnv("CHAT_MAX_TURNS", 10)}
 	}
-	return kept
+	return p
 }
 
-// prunePlan returns whether to keep the leading system message and the tail start index
-// (absolute index in msgs) to keep after trimming.
-func prunePlan(msgs []Message) (bool, int) {
+// planWindow 是几个内置策略共用的算法：
+// 1) 开头的 system 永远保留
+// 2) maxTurns > 0 时只保留最后 maxTurns 轮
+// 3) useTokens 时再按 token 预算从后往前累加，超过就截掉更早的（最后一条总会保留）
+// keepPinned 时置顶消息不参与 2) 3) 的裁剪，token 预先扣除。
+func planWindow(msgs []Message, budget Budget, maxTurns int, useTokens, keepPinned bool) PrunePlan {
+	var plan PrunePlan
 	if len(msgs) == 0 {
-		return false, 0
+		return plan
 	}
 
-	maxTurns := getIntEnv("CHAT_MAX_TURNS", 10)
-	maxChars := getIntEnv("CHAT_MAX_CHARS", 24000)
+	limit := math.MaxInt
+	if useTokens {
+		limit = budget.Limit()
+	}
 
-	keepSystem := false
 	start := 0
 	if msgs[0].Role == "system" {
-		keepSystem = true
+		plan.Keep = append(plan.Keep, 0)
 		start = 1
+		if useTokens {
+			limit -= budget.Count(msgs[0])
+		}
 	}
 
-	rest := msgs[start:]
-
-	// 2) 轮次裁剪：保留最后 maxTurns 轮
-	turnStarts := make([]int, 0, maxTurns+1)
-	for i := len(rest) - 1; i >= 0; i-- {
-		if rest[i].Role == "user" {
-			turnStarts = append(turnStarts, i)
-			if len(turnStarts) >= maxTurns {
-				break
+	// tool 结果必须紧跟发起调用的 assistant，单独置顶没有意义
+	pinned := func(i int) bool { return keepPinned && msgs[i].Pinned && msgs[i].Role != "tool" }
+	if useTokens {
+		for i := start; i < len(msgs); i++ {
+			if pinned(i) {
+				limit -= budget.Count(msgs[i])
 			}
 		}
 	}
-	cut := 0
-	if len(turnStarts) >= maxTurns {
-		cut = turnStarts[len(turnStarts)-1]
-	}
 
-	absStart := start + cut
-	kept := rest
-	if cut > 0 && cut < len(rest) {
-		kept = rest[cut:]
+	// 轮次：从尾部往前数，遇到 user 认为是新一轮开始
+	cut := start
+	if maxTurns > 0 {
+		turns := 0
+		for i := len(msgs) - 1; i >= start; i-- {
+			if msgs[i].Role == "user" && !pinned(i) {
+				turns++
+				if turns == maxTurns {
+					cut = i
+					break
+				}
+			}
+		}
 	}
 
-	// 3) 字符数裁剪：从后往前累加，超过就截掉更早的
+	// token：从后往前累加
+	tail := cut
 	total := 0
-	idx := len(kept)
-	for i := len(kept) - 1; i >= 0; i-- {
-		total += len(kept[i].Content)
-		if total > maxChars {
-			idx = i + 1
+	for i := len(msgs) - 1; useTokens && i >= cut; i-- {
+		if pinned(i) {
+			continue
+		}
+		total += budget.Count(msgs[i])
+		if total > limit && i < len(msgs)-1 {
+			tail = i + 1
 			break
 		}
 	}
 
-	tailStart := absStart
-	if idx < len(kept) {
-		tailStart = absStart + idx
+	// 不能从 tool 消息开始：发起调用的 assistant 已经被裁掉，模型接口会拒绝孤立的工具结果
+	for tail < len(msgs)-1 && msgs[tail].Role == "tool" {
+		tail++
+	}
+
+	plan.Tail = tail
+	for i := start; i < tail; i++ {
+		if pinned(i) {
+			plan.Keep = append(plan.Keep, i)
+		}
 	}
-	return keepSystem, tailStart
+	return plan
 }
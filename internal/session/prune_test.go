@@ -0,0 +1,118 @@
+package session
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/JekYUlll/eino-mini/internal/tokenizer"
+)
+
+// conv 按简写构造一段历史：s 开头是 system，u 是 user，a 是 assistant，c 是发起工具调用的 assistant，
+// t 是工具结果；前面加 * 表示置顶。内容就是简写本身（不超过 4 个字符），启发式 tokenizer 下每条都是 5 个 token。
+func conv(specs ...string) []Message {
+	roles := map[byte]string{'s': "system", 'u': "user", 'a': "assistant", 'c': "assistant", 't': "tool"}
+	out := make([]Message, 0, len(specs))
+	for _, spec := range specs {
+		content, pinned := strings.CutPrefix(spec, "*")
+		m := Message{ID: content, Role: roles[content[0]], Content: content, Pinned: pinned}
+		if content[0] == 'c' {
+			m.ToolCalls = []ToolCall{{ID: content, Name: "f"}}
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// window 是按 5 token 一条消息算、能放下 n 条消息的预算。
+func window(n int) Budget {
+	return Budget{Window: 5 * n, Tokenizer: tokenizer.Get(tokenizer.Heuristic)}
+}
+
+func TestPrunePolicies(t *testing.T) {
+	history := conv("s", "*u1", "a1", "u2", "a2", "u3", "a3")
+	tools := conv("s", "u1", "c1", "t1", "a1", "u2", "a2")
+
+	cases := []struct {
+		name   string
+		policy PrunePolicy
+		msgs   []Message
+		budget Budget
+		want   []string // 保留下来的消息内容
+	}{
+		{"turns", TurnWindow{MaxTurns: 2}, history, window(100), []string{"s", "u2", "a2", "u3", "a3"}},
+		{"turns ignores tokens", TurnWindow{MaxTurns: 2}, history, window(1), []string{"s", "u2", "a2", "u3", "a3"}},
+		{"turns ignores pins", TurnWindow{MaxTurns: 1}, history, window(100), []string{"s", "u3", "a3"}},
+		{"turns fewer than max", TurnWindow{MaxTurns: 10}, history, window(100), []string{"s", "u1", "a1", "u2", "a2", "u3", "a3"}},
+		{"turns without system", TurnWindow{MaxTurns: 1}, history[1:], window(100), []string{"u3", "a3"}},
+		{"turns incomplete turn", TurnWindow{MaxTurns: 1}, conv("s", "u1", "a1", "u2"), window(100), []string{"s", "u2"}},
+
+		{"tokens", TokenBudget{}, history, window(5), []string{"s", "u2", "a2", "u3", "a3"}},
+		{"tokens ignores pins", TokenBudget{}, history, window(3), []string{"s", "u3", "a3"}},
+		{"tokens keeps last message", TokenBudget{}, history, window(1), []string{"s", "a3"}},
+		{"tokens empty budget", TokenBudget{}, history, Budget{Tokenizer: tokenizer.Get(tokenizer.Heuristic)}, []string{"s", "a3"}},
+		{"tokens skips orphan tool result", TokenBudget{}, tools, window(5), []string{"s", "a1", "u2", "a2"}},
+		{"tokens counts tool calls", TokenBudget{}, tools, window(6), []string{"s", "a1", "u2", "a2"}},
+
+		{"sliding keeps pins", SlidingWindow{MaxTurns: 1}, history, window(100), []string{"s", "u1", "u3", "a3"}},
+		{"sliding pins use budget", SlidingWindow{MaxTurns: 10}, history, window(5), []string{"s", "u1", "a2", "u3", "a3"}},
+		{"sliding keeps last message", SlidingWindow{MaxTurns: 10}, history, window(1), []string{"s", "u1", "a3"}},
+		{"sliding pinned tool result", SlidingWindow{MaxTurns: 1}, conv("s", "u1", "c1", "*t1", "a1", "u2", "a2"), window(100), []string{"s", "u2", "a2"}},
+
+		{"summarize turns", SummarizeAndDrop{Inner: TurnWindow{MaxTurns: 1}}, history, window(100), []string{"s", "u3", "a3"}},
+		{"summarize sliding", SummarizeAndDrop{Inner: SlidingWindow{MaxTurns: 1}}, history, window(100), []string{"s", "u1", "u3", "a3"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			plan := c.policy.Plan(c.msgs, c.budget)
+
+			var got []string
+			for _, m := range plan.Apply(c.msgs) {
+				got = append(got, m.Content)
+			}
+			if !slices.Equal(got, c.want) {
+				t.Fatalf("kept %v, want %v (plan %+v)", got, c.want, plan)
+			}
+			if last := c.msgs[len(c.msgs)-1]; got[len(got)-1] != last.Content {
+				t.Fatalf("last message %s dropped", last.Content)
+			}
+
+			// 保留的和丢弃的加起来正好是原来的历史
+			dropped := plan.Dropped(c.msgs)
+			all := slices.Concat(plan.Apply(c.msgs), dropped)
+			slices.SortFunc(all, func(a, b Message) int {
+				return messageIndex(c.msgs, a.ID) - messageIndex(c.msgs, b.ID)
+			})
+			if !reflect.DeepEqual(all, c.msgs) {
+				t.Fatalf("kept + dropped = %v, want %v", describe(all), describe(c.msgs))
+			}
+
+			_, summarize := c.policy.(SummarizeAndDrop)
+			if plan.Summarize != summarize {
+				t.Fatalf("Summarize = %v, want %v", plan.Summarize, summarize)
+			}
+		})
+	}
+}
+
+// SummarizeAndDrop 的裁剪结果跟它包着的策略一样，只是多了 Summarize。
+func TestSummarizeWrapsInner(t *testing.T) {
+	msgs := conv("s", "*u1", "a1", "u2", "a2", "u3", "a3")
+	for _, inner := range []PrunePolicy{TurnWindow{MaxTurns: 1}, TokenBudget{}, SlidingWindow{MaxTurns: 2}} {
+		want := inner.Plan(msgs, window(4))
+		want.Summarize = true
+		if got := (SummarizeAndDrop{Inner: inner}).Plan(msgs, window(4)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", inner.Name(), got, want)
+		}
+	}
+}
+
+func TestPruneEmpty(t *testing.T) {
+	for _, p := range []PrunePolicy{TurnWindow{MaxTurns: 1}, TokenBudget{}, SlidingWindow{MaxTurns: 1}, SummarizeAndDrop{Inner: TokenBudget{}}} {
+		plan := p.Plan(nil, window(1))
+		if len(plan.Keep) != 0 || plan.Tail != 0 || len(plan.Apply(nil)) != 0 {
+			t.Errorf("%s: plan %+v for empty history", p.Name(), plan)
+		}
+	}
+}
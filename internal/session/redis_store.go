@@ -0,0 +1,805 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisStore 把每个会话的消息树存成一个 Redis list（chat_session:<id>），元素是 JSON 编码的 Message，
+// 按写入顺序排列；当前激活的叶子记在元数据的 head 字段里（见 branch.go）。
+type RedisStore struct {
+	rdb *redis.Client
+	ttl time.Duration
+}
+
+func NewRedisStore() (*RedisStore, error) {
+	ttl, err := sessionTTL()
+	if err != nil {
+		return nil, err
+	}
+
+	db := 0
+	if v := os.Getenv("REDIS_DB"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			db = n
+		}
+	}
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     os.Getenv("REDIS_ADDR"),
+		Password: os.Getenv("REDIS_PASSWORD"),
+		DB:       db,
+	})
+
+	return &RedisStore{
+		rdb: rdb,
+		ttl: ttl,
+	}, nil
+}
+
+func (s *RedisStore) NewConversationID() string {
+	return newID()
+}
+
+func (s *RedisStore) key(id string) string {
+	return "chat_session:" + id
+}
+
+func (s *RedisStore) Load(ctx context.Context, id string) ([]Message, error) {
+	t, err := s.loadTree(ctx, s.rdb, id)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := s.pruneConfig(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return injectSummary(t.path(), cfg.summary), nil
+}
+
+func (s *RedisStore) History(ctx context.Context, id string) ([]Message, error) {
+	t, err := s.loadTree(ctx, s.rdb, id)
+	if err != nil {
+		return nil, err
+	}
+	if msgs := t.path(); len(msgs) > 0 {
+		return msgs, nil
+	}
+	if _, err := s.GetConversation(ctx, id); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// Save 弃用，仅用于调试
+// Save writes the full message list; prefer Update/UpdateWithRetry in normal flows.
+func (s *RedisStore) Save(ctx context.Context, id string, msgs []Message) error {
+	return s.saveMessages(ctx, id, msgs)
+}
+
+// Update: 用 WATCH/MULTI 保证 “读-改-写” 在并发下不会丢更新。
+// updater 接收当前路径（可能为空），返回更新后的 msgs，整棵树换成这一条路径。
+func (s *RedisStore) Update(
+	ctx context.Context,
+	id string,
+	updater func(cur []Message) ([]Message, error),
+) ([]Message, error) {
+
+	key := s.key(id)
+	var out []Message
+	err := s.rdb.Watch(ctx, func(tx *redis.Tx) error {
+		if err := s.checkFence(ctx, tx, id); err != nil {
+			return err
+		}
+		cur, err := s.loadTree(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		// 2) 让调用方基于 cur 生成新值
+		next, err := updater(cur.path())
+		if err != nil {
+			return err
+		}
+
+		// 3) MULTI/EXEC 提交（带 TTL）
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			return s.writeTree(ctx, p, id, linearTree(next))
+		})
+		if err != nil {
+			// 如果 key 在 WATCH 后被别人改过，这里会返回 redis.TxFailedErr
+			if errors.Is(err, redis.TxFailedErr) {
+				return ErrConflict
+			}
+			return err
+		}
+
+		out = next
+		return nil
+	}, key, s.metaKey(id), s.fenceKey(id))
+
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// UpdateWithRetry: retry Update on ErrConflict up to n times.
+func (s *RedisStore) UpdateWithRetry(
+	ctx context.Context,
+	id string,
+	n int,
+	updater func(cur []Message) ([]Message, error),
+) ([]Message, error) {
+	var lastErr error
+	for i := 0; i < n; i++ {
+		out, err := s.Update(ctx, id, updater)
+		if err == nil {
+			return out, nil
+		}
+		if errors.Is(err, ErrConflict) {
+			lastErr = err
+			continue
+		}
+		return nil, err
+	}
+	return nil, lastErr
+}
+
+// loadTree 读出会话的整棵消息树和 head。
+func (s *RedisStore) loadTree(ctx context.Context, cmd redis.Cmdable, id string) (*tree, error) {
+	nodes, err := s.loadMessagesCtx(ctx, cmd, s.key(id))
+	if err != nil {
+		return nil, err
+	}
+	head, err := cmd.HGet(ctx, s.metaKey(id), "head").Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	return newTree(nodes, head), nil
+}
+
+// loadMessages: read all messages stored as a Redis list. Each element is a JSON-encoded Message.
+func (s *RedisStore) loadMessages(ctx context.Context, key string) ([]Message, error) {
+	return s.loadMessagesCtx(ctx, s.rdb, key)
+}
+
+func (s *RedisStore) loadMessagesCtx(ctx context.Context, cmd redis.Cmdable, key string) ([]Message, error) {
+	vals, err := cmd.LRange(ctx, key, 0, -1).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeMessages(vals)
+}
+
+// decodeMessages 解码 list 里的元素。
+func decodeMessages(vals []string) ([]Message, error) {
+	msgs := make([]Message, 0, len(vals))
+	for _, v := range vals {
+		var m Message
+		if err := json.Unmarshal([]byte(v), &m); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+func (s *RedisStore) saveMessages(ctx context.Context, id string, msgs []Message) error {
+	return s.rdb.Watch(ctx, func(tx *redis.Tx) error {
+		if err := s.checkFence(ctx, tx, id); err != nil {
+			return err
+		}
+		_, err := tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			return s.writeTree(ctx, p, id, linearTree(msgs))
+		})
+		if errors.Is(err, redis.TxFailedErr) {
+			return ErrConflict
+		}
+		return err
+	}, s.fenceKey(id))
+}
+
+// writeTree 整体重写 list 并记下 head。
+func (s *RedisStore) writeTree(ctx context.Context, p redis.Pipeliner, id string, t *tree) error {
+	key := s.key(id)
+	p.Del(ctx, key)
+	if len(t.nodes) > 0 {
+		elems := make([]interface{}, 0, len(t.nodes))
+		for _, m := range t.nodes {
+			b, err := json.Marshal(m)
+			if err != nil {
+				return err
+			}
+			elems = append(elems, b)
+		}
+		p.RPush(ctx, key, elems...)
+	}
+	p.Expire(ctx, key, s.ttl)
+	p.HSet(ctx, s.metaKey(id), "head", t.head)
+	return nil
+}
+
+// writeRetries 是乐观写入冲突时的重试次数：两阶段写入不持会话锁，并发写同一个会话时
+// 靠 WATCH 让后提交的一方 EXEC 失败、重新读一遍再写，不会丢更新。
+const writeRetries = 20
+
+// write 是改写消息树的操作共用的提交流程：WATCH 消息 list、元数据和 fencing 计数器，
+// 读出整棵树交给 fn 改写，再按会话策略对当前路径算出 PrunePlan（和内存、SQLite 后端是同一份实现，见 prune.go），
+// 删掉被裁剪的节点（tree.prune），同一个 MULTI 里写回 list 和 head、把丢弃的消息推进待摘要队列、刷新元数据和索引。
+// 期间有别人写入时 EXEC 失败，整体重试，所以不依赖外层的会话锁。
+func (s *RedisStore) write(ctx context.Context, id string, fn treeWrite) ([]Message, error) {
+	for attempt := 0; ; attempt++ {
+		var snap []Message
+		err := s.rdb.Watch(ctx, func(tx *redis.Tx) error {
+			if err := s.checkFence(ctx, tx, id); err != nil {
+				return err
+			}
+			cfg, err := s.writeConfigCtx(ctx, tx, id)
+			if err != nil {
+				return err
+			}
+			t, err := s.loadTree(ctx, tx, id)
+			if err != nil {
+				return err
+			}
+			added, err := fn(t, cfg)
+			if errors.Is(err, errNoWrite) {
+				snap = injectSummary(t.path(), cfg.summary)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			plan := cfg.plan(t.path())
+			dropped := t.prune(plan)
+			_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+				if err := s.writeTree(ctx, p, id, t); err != nil {
+					return err
+				}
+				if plan.Summarize && len(dropped) > 0 {
+					if err := s.pushPending(ctx, p, id, dropped); err != nil {
+						return err
+					}
+				}
+				s.touch(ctx, p, id, cfg.owner, added)
+				return nil
+			})
+			if errors.Is(err, redis.TxFailedErr) {
+				return ErrConflict
+			}
+			if err != nil {
+				return err
+			}
+			snap = injectSummary(t.path(), cfg.summary)
+			return nil
+		}, s.key(id), s.metaKey(id), s.fenceKey(id))
+		if errors.Is(err, ErrConflict) && attempt < writeRetries {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return snap, nil
+	}
+}
+
+// pushPending 把被裁剪的消息追加到待摘要队列。
+func (s *RedisStore) pushPending(ctx context.Context, p redis.Pipeliner, id string, msgs []Message) error {
+	elems := make([]interface{}, 0, len(msgs))
+	for _, m := range msgs {
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		elems = append(elems, b)
+	}
+	p.RPush(ctx, s.pendingKey(id), elems...)
+	return nil
+}
+
+// touch 刷新 updated_at / message_count（增加 added）、各个 key 的 TTL 和会话索引。
+func (s *RedisStore) touch(ctx context.Context, p redis.Pipeliner, id, owner string, added int) {
+	now := time.Now().UnixMilli()
+	meta := s.metaKey(id)
+	p.HSetNX(ctx, meta, "created_at", now)
+	p.HSet(ctx, meta, "updated_at", now)
+	if added > 0 {
+		p.HIncrBy(ctx, meta, "message_count", int64(added))
+	}
+	for _, k := range []string{s.key(id), meta, s.pendingKey(id)} {
+		p.Expire(ctx, k, s.ttl)
+	}
+	p.ZAdd(ctx, conversationIndexKey, redis.Z{Score: float64(now), Member: id})
+	p.ZAdd(ctx, s.ownerIndexKey(owner), redis.Z{Score: float64(now), Member: id})
+	p.Expire(ctx, s.ownerIndexKey(owner), s.ttl)
+}
+
+// 会话元数据：chat_meta:<id> 是一个 hash，和消息 list 使用同样的 TTL；
+// chat_conversations 是按 updated_at 排序的 zset 索引，本身不过期：
+// 元数据已过期但索引还在，说明会话 “存在过”（ErrExpired），索引项超过 CHAT_TOMBSTONE_TTL 后在 List 时清理。
+// chat_owner:<owner> 是每个 owner 自己的 zset 索引（同样按 updated_at），List 只翻这一个 owner 的；
+// 它跟着 owner 最近一次写入续期，元数据已过期的项在 List 时清掉。
+const conversationIndexKey = "chat_conversations"
+
+// listPage 是 ListConversations 每次从 owner 索引里取的条数。
+const listPage = 100
+
+func (s *RedisStore) ownerIndexKey(owner string) string {
+	return "chat_owner:" + owner
+}
+
+func (s *RedisStore) metaKey(id string) string {
+	return "chat_meta:" + id
+}
+
+// pendingKey 是被裁剪、还没并入摘要的消息队列。
+func (s *RedisStore) pendingKey(id string) string {
+	return "chat_pruned:" + id
+}
+
+// pruneConfig 按会话元数据取裁剪配置。
+func (s *RedisStore) pruneConfig(ctx context.Context, id string) (pruneConfig, error) {
+	cfg, err := s.writeConfig(ctx, id)
+	return cfg.pruneConfig, err
+}
+
+func (s *RedisStore) writeConfig(ctx context.Context, id string) (writeConfig, error) {
+	return s.writeConfigCtx(ctx, s.rdb, id)
+}
+
+func (s *RedisStore) writeConfigCtx(ctx context.Context, cmd redis.Cmdable, id string) (writeConfig, error) {
+	vals, err := cmd.HMGet(ctx, s.metaKey(id), "model", "prune_policy", "summary", "system_prompt", "owner").Result()
+	if err != nil {
+		return writeConfig{}, err
+	}
+	model, _ := vals[0].(string)
+	policy, _ := vals[1].(string)
+	summary, _ := vals[2].(string)
+	prompt, _ := vals[3].(string)
+	owner, _ := vals[4].(string)
+	return writeConfig{pruneConfig: newPruneConfig(model, policy, summary), prompt: prompt, owner: owner}, nil
+}
+
+func decodeMeta(id string, h map[string]string) *Conversation {
+	c := &Conversation{
+		ID:           id,
+		Title:        h["title"],
+		Owner:        h["owner"],
+		Model:        h["model"],
+		Summary:      h["summary"],
+		PrunePolicy:  h["prune_policy"],
+		ForkedFrom:   h["forked_from"],
+		Persona:      h["persona"],
+		SystemPrompt: h["system_prompt"],
+	}
+	if v := h["tools"]; v != "" {
+		_ = json.Unmarshal([]byte(v), &c.Tools)
+	}
+	if n, err := strconv.ParseInt(h["created_at"], 10, 64); err == nil {
+		c.CreatedAt = time.UnixMilli(n)
+	}
+	if n, err := strconv.ParseInt(h["updated_at"], 10, 64); err == nil {
+		c.UpdatedAt = time.UnixMilli(n)
+	}
+	if n, err := strconv.Atoi(h["message_count"]); err == nil {
+		c.MessageCount = n
+	}
+	return c
+}
+
+func (s *RedisStore) EnsureConversation(ctx context.Context, c Conversation) (*Conversation, error) {
+	key := s.metaKey(c.ID)
+	now := time.Now().UnixMilli()
+
+	pipe := s.rdb.TxPipeline()
+	pipe.HSetNX(ctx, key, "created_at", now)
+	pipe.HSetNX(ctx, key, "updated_at", now)
+	pipe.HSetNX(ctx, key, "message_count", 0)
+	pipe.HSetNX(ctx, key, "title", c.Title)
+	pipe.HSetNX(ctx, key, "owner", c.Owner)
+	pipe.HSetNX(ctx, key, "model", c.Model)
+	if c.Persona != "" {
+		pipe.HSetNX(ctx, key, "persona", c.Persona)
+	}
+	if c.SystemPrompt != "" {
+		pipe.HSetNX(ctx, key, "system_prompt", c.SystemPrompt)
+	}
+	if len(c.Tools) > 0 {
+		tools, err := jsonColumn(c.Tools)
+		if err != nil {
+			return nil, err
+		}
+		pipe.HSetNX(ctx, key, "tools", tools)
+	}
+	pipe.Expire(ctx, key, s.ttl)
+	pipe.ZAddNX(ctx, conversationIndexKey, redis.Z{Score: float64(now), Member: c.ID})
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	conv, err := s.GetConversation(ctx, c.ID)
+	if err != nil {
+		return nil, err
+	}
+	// 会话已经存在时 owner 以元数据里的为准
+	if err := s.indexOwner(ctx, s.rdb, conv.Owner, c.ID, now); err != nil {
+		return nil, err
+	}
+	return conv, nil
+}
+
+// indexOwner 把会话放进 owner 的索引（已经在里面时不改排序），索引跟着续期。
+func (s *RedisStore) indexOwner(ctx context.Context, cmd redis.Cmdable, owner, id string, now int64) error {
+	key := s.ownerIndexKey(owner)
+	if err := cmd.ZAddNX(ctx, key, redis.Z{Score: float64(now), Member: id}).Err(); err != nil {
+		return err
+	}
+	return cmd.Expire(ctx, key, s.ttl).Err()
+}
+
+func (s *RedisStore) GetConversation(ctx context.Context, id string) (*Conversation, error) {
+	h, err := s.rdb.HGetAll(ctx, s.metaKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(h) == 0 {
+		err := s.rdb.ZScore(ctx, conversationIndexKey, id).Err()
+		if err == redis.Nil {
+			return nil, ErrNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrExpired
+	}
+	return decodeMeta(id, h), nil
+}
+
+// ListConversations 按页翻 owner 自己的索引，顺带清掉元数据已经过期的项。
+func (s *RedisStore) ListConversations(ctx context.Context, owner string) ([]Conversation, error) {
+	cutoff := time.Now().Add(-tombstoneTTL()).UnixMilli()
+	if err := s.rdb.ZRemRangeByScore(ctx, conversationIndexKey, "-inf", strconv.FormatInt(cutoff, 10)).Err(); err != nil {
+		return nil, err
+	}
+
+	key := s.ownerIndexKey(owner)
+	var out []Conversation
+	for start := int64(0); ; {
+		ids, err := s.rdb.ZRevRange(ctx, key, start, start+listPage-1).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		pipe := s.rdb.Pipeline()
+		cmds := make([]*redis.MapStringStringCmd, len(ids))
+		for i, id := range ids {
+			cmds[i] = pipe.HGetAll(ctx, s.metaKey(id))
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+
+		var gone []interface{}
+		for i, id := range ids {
+			h := cmds[i].Val()
+			if len(h) == 0 {
+				gone = append(gone, id)
+				continue
+			}
+			out = append(out, *decodeMeta(id, h))
+		}
+		if len(gone) > 0 {
+			if err := s.rdb.ZRem(ctx, key, gone...).Err(); err != nil {
+				return nil, err
+			}
+		}
+		if len(ids) < listPage {
+			break
+		}
+		// 删掉的项让后面的往前挪了
+		start += int64(len(ids) - len(gone))
+	}
+	return out, nil
+}
+
+func (s *RedisStore) UpdateConversation(ctx context.Context, id string, patch ConversationPatch) (*Conversation, error) {
+	var fields []interface{}
+	if patch.Title != nil {
+		fields = append(fields, "title", *patch.Title)
+	}
+	if patch.PrunePolicy != nil {
+		fields = append(fields, "prune_policy", *patch.PrunePolicy)
+	}
+	if patch.Tools != nil {
+		tools, err := jsonColumn(*patch.Tools)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, "tools", tools)
+	}
+	if patch.SystemPrompt != nil {
+		fields = append(fields, "system_prompt", *patch.SystemPrompt)
+	}
+	if patch.Persona != nil {
+		fields = append(fields, "persona", *patch.Persona)
+	}
+	if patch.Model != nil {
+		fields = append(fields, "model", *patch.Model)
+	}
+	if len(fields) == 0 {
+		return s.GetConversation(ctx, id)
+	}
+	fence, err := fenceFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// 改 system_prompt 时同一个脚本里把树根（list 第一条）的 system 消息换掉（不是 system 时不动）
+	rewrite, prompt, ifEmpty := "0", "", "0"
+	if patch.SystemPrompt != nil {
+		rewrite, prompt = "1", systemPrompt(*patch.SystemPrompt)
+	}
+	if patch.IfEmpty {
+		ifEmpty = "1"
+	}
+	args := append([]interface{}{fence, rewrite, prompt, ifEmpty}, fields...)
+	if err := updateConversationScript.Run(ctx, s.rdb, []string{s.fenceKey(id), s.metaKey(id), s.key(id)}, args...).Err(); err != nil {
+		if strings.Contains(err.Error(), "NOT_EMPTY") {
+			return nil, ErrConflict
+		}
+		return nil, fencedErr(err)
+	}
+	return s.GetConversation(ctx, id)
+}
+
+// updateConversationScript：KEYS[2]=元数据, KEYS[3]=消息 list；
+// ARGV[2]="1" 时把开头的 system 消息换成 ARGV[3]，ARGV[4]="1" 时会话已经有消息就不写（NOT_EMPTY），
+// ARGV[5..] 是 field/value 对。元数据不存在（已过期）时不写，避免造出残缺的 hash。
+var updateConversationScript = redis.NewScript(fenceCheck + `
+if redis.call("EXISTS", KEYS[2]) == 0 then
+  return 0
+end
+if ARGV[4] == "1" and (tonumber(redis.call("HGET", KEYS[2], "message_count") or "0") > 0 or redis.call("EXISTS", KEYS[3]) == 1) then
+  return redis.error_reply("NOT_EMPTY")
+end
+redis.call("HSET", KEYS[2], unpack(ARGV, 5))
+if ARGV[2] == "1" then
+  local raw = redis.call("LINDEX", KEYS[3], 0)
+  if raw then
+    local m = cjson.decode(raw)
+    if m.role == "system" and m.content ~= ARGV[3] then
+      m.content = ARGV[3]
+      redis.call("LSET", KEYS[3], 0, cjson.encode(m))
+    end
+  end
+end
+return 1
+`)
+
+// DeleteConversation 删掉会话的所有 key：消息、元数据、索引项，以及 fencing 计数器、锁和排队、
+// 幂等键记录，同一个 ID 重新创建的会话不会继承这些状态。
+// 计数器删掉后，还在生成的旧持锁方写入会被拒绝（见 fence.go）。
+func (s *RedisStore) DeleteConversation(ctx context.Context, id string) error {
+	meta, idemSet := s.metaKey(id), s.idempotencySetKey(id)
+	var deleted int64
+	err := s.rdb.Watch(ctx, func(tx *redis.Tx) error {
+		owner, err := tx.HGet(ctx, meta, "owner").Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+		idem, err := tx.SMembers(ctx, idemSet).Result()
+		if err != nil {
+			return err
+		}
+		keys := []string{s.key(id), meta, s.pendingKey(id)}
+		state := []string{s.fenceKey(id), s.lockKey(id), s.lockQueueKey(id), s.lockWaitersKey(id), idemSet}
+		for _, k := range idem {
+			state = append(state, s.idempotencyKey(k))
+		}
+
+		var del *redis.IntCmd
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			del = p.Del(ctx, keys...)
+			p.Del(ctx, state...)
+			p.ZRem(ctx, conversationIndexKey, id)
+			p.ZRem(ctx, s.ownerIndexKey(owner), id)
+			// 排队等锁的请求马上重试，不用等到锁过期
+			p.Publish(ctx, s.lockChannel(id), "deleted")
+			return nil
+		})
+		if errors.Is(err, redis.TxFailedErr) {
+			return ErrConflict
+		}
+		if err != nil {
+			return err
+		}
+		deleted = del.Val()
+		return nil
+	}, meta, idemSet)
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Fork WATCH 原会话的消息、元数据和待摘要队列，在一个事务里写出新会话的全部 key（新会话只有复制的这一条路径）。
+// 树上剩下的消息都在摘要覆盖的范围之后，所以摘要和待摘要队列原样复制。
+func (s *RedisStore) Fork(ctx context.Context, convID, msgID, newID string) (*Conversation, error) {
+	if _, err := s.GetConversation(ctx, convID); err != nil {
+		return nil, err
+	}
+	key, meta, pending := s.key(convID), s.metaKey(convID), s.pendingKey(convID)
+	err := s.rdb.Watch(ctx, func(tx *redis.Tx) error {
+		t, err := s.loadTree(ctx, tx, convID)
+		if err != nil {
+			return err
+		}
+		_, msgs, err := forkMessages(t, msgID)
+		if err != nil {
+			return err
+		}
+		h, err := tx.HGetAll(ctx, meta).Result()
+		if err != nil {
+			return err
+		}
+		if len(h) == 0 {
+			return ErrExpired
+		}
+		queued, err := tx.LRange(ctx, pending, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UnixMilli()
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			if err := s.writeTree(ctx, p, newID, linearTree(msgs)); err != nil {
+				return err
+			}
+			p.HSet(ctx, s.metaKey(newID),
+				"created_at", now,
+				"updated_at", now,
+				"message_count", countMessages(msgs),
+				"title", h["title"],
+				"owner", h["owner"],
+				"model", h["model"],
+				"summary", h["summary"],
+				"prune_policy", h["prune_policy"],
+				"tools", h["tools"],
+				"forked_from", convID,
+				"persona", h["persona"],
+				"system_prompt", h["system_prompt"],
+			)
+			p.Expire(ctx, s.metaKey(newID), s.ttl)
+			if len(queued) > 0 {
+				elems := make([]interface{}, len(queued))
+				for i, v := range queued {
+					elems[i] = v
+				}
+				p.RPush(ctx, s.pendingKey(newID), elems...)
+				p.Expire(ctx, s.pendingKey(newID), s.ttl)
+			}
+			p.ZAdd(ctx, conversationIndexKey, redis.Z{Score: float64(now), Member: newID})
+			return s.indexOwner(ctx, p, h["owner"], newID, now)
+		})
+		if errors.Is(err, redis.TxFailedErr) {
+			return ErrConflict
+		}
+		return err
+	}, key, meta, pending)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetConversation(ctx, newID)
+}
+
+func (s *RedisStore) PendingSummary(ctx context.Context, id string) (string, []Message, error) {
+	c, err := s.GetConversation(ctx, id)
+	if err != nil {
+		return "", nil, err
+	}
+	pending, err := s.loadMessages(ctx, s.pendingKey(id))
+	if err != nil {
+		return "", nil, err
+	}
+	return c.Summary, pending, nil
+}
+
+// SaveSummary 用 Lua 做 CAS：摘要没变才写入，并把待摘要队列的前 len(batch) 条弹掉
+// （队列只在尾部追加，摘要没变说明没有别人弹过）。
+func (s *RedisStore) SaveSummary(ctx context.Context, id, prev, summary string, batch []Message) error {
+	fence, err := fenceFrom(ctx)
+	if err != nil {
+		return err
+	}
+	// KEYS[1]=fence key, KEYS[2]=meta key, KEYS[3]=pending key, ARGV[1]=fence, ARGV[2]=prev, ARGV[3]=summary, ARGV[4]=n
+	script := fenceCheck + `
+if redis.call("EXISTS", KEYS[2]) == 0 then
+  return 0
+end
+local cur = redis.call("HGET", KEYS[2], "summary") or ""
+if cur ~= ARGV[2] then
+  return -1
+end
+redis.call("HSET", KEYS[2], "summary", ARGV[3])
+redis.call("LTRIM", KEYS[3], tonumber(ARGV[4]), -1)
+return 1
+`
+	res, err := s.rdb.Eval(ctx, script, []string{s.fenceKey(id), s.metaKey(id), s.pendingKey(id)}, fence, prev, summary, len(batch)).Int()
+	if err != nil {
+		return fencedErr(err)
+	}
+	switch res {
+	case 0:
+		_, err := s.GetConversation(ctx, id)
+		if err == nil {
+			err = ErrNotFound
+		}
+		return err
+	case -1:
+		return ErrConflict
+	}
+	return nil
+}
+
+// PinMessage 用 WATCH 保证改写期间 list 没被别人动过，只 LSET 这一条（树上任意一条消息都可以置顶）。
+func (s *RedisStore) PinMessage(ctx context.Context, convID, msgID string, pinned bool) (*Message, error) {
+	if _, err := s.GetConversation(ctx, convID); err != nil {
+		return nil, err
+	}
+
+	key := s.key(convID)
+	var out *Message
+	err := s.rdb.Watch(ctx, func(tx *redis.Tx) error {
+		if err := s.checkFence(ctx, tx, convID); err != nil {
+			return err
+		}
+		cur, err := s.loadMessagesCtx(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		idx := slices.IndexFunc(cur, func(m Message) bool { return m.ID == msgID })
+		if idx < 0 {
+			return ErrMessageNotFound
+		}
+		m := cur[idx]
+		m.Pinned = pinned
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.LSet(ctx, key, int64(idx), b)
+			return nil
+		})
+		if errors.Is(err, redis.TxFailedErr) {
+			return ErrConflict
+		}
+		if err != nil {
+			return err
+		}
+		out = &m
+		return nil
+	}, key, s.fenceKey(convID))
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
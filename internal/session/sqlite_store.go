@@ -0,0 +1,881 @@
+package session
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS conversations (
+  id            TEXT PRIMARY KEY,
+  created_at    INTEGER NOT NULL,
+  updated_at    INTEGER NOT NULL,
+  title         TEXT NOT NULL DEFAULT '',
+  owner         TEXT NOT NULL DEFAULT '',
+  model         TEXT NOT NULL DEFAULT '',
+  message_count INTEGER NOT NULL DEFAULT 0,
+  summary       TEXT NOT NULL DEFAULT '',
+  prune_policy  TEXT NOT NULL DEFAULT '',
+  tools         TEXT NOT NULL DEFAULT '',
+  forked_from   TEXT NOT NULL DEFAULT '',
+  persona       TEXT NOT NULL DEFAULT '',
+  system_prompt TEXT NOT NULL DEFAULT '',
+  head          TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS conversations_by_owner ON conversations(owner, updated_at);
+CREATE TABLE IF NOT EXISTS messages (
+  seq             INTEGER PRIMARY KEY AUTOINCREMENT,
+  conversation_id TEXT NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+  id              TEXT NOT NULL DEFAULT '',
+  parent_id       TEXT NOT NULL DEFAULT '',
+  role            TEXT NOT NULL,
+  content         TEXT NOT NULL,
+  created_at      INTEGER NOT NULL,
+  pinned          INTEGER NOT NULL DEFAULT 0,
+  tool_calls      TEXT NOT NULL DEFAULT '',
+  tool_call_id    TEXT NOT NULL DEFAULT '',
+  tool_name       TEXT NOT NULL DEFAULT '',
+  name            TEXT NOT NULL DEFAULT '',
+  parts           TEXT NOT NULL DEFAULT '',
+  summarized      INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS messages_by_conversation ON messages(conversation_id, seq);
+CREATE TABLE IF NOT EXISTS locks (
+  conversation_id TEXT PRIMARY KEY,
+  token           TEXT NOT NULL,
+  expire_at       INTEGER NOT NULL,
+  fence           INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS idempotency (
+  key             TEXT PRIMARY KEY,
+  conversation_id TEXT NOT NULL,
+  user_id         TEXT NOT NULL DEFAULT '',
+  answer          TEXT NOT NULL DEFAULT '',
+  status          TEXT NOT NULL,
+  error           TEXT NOT NULL DEFAULT '',
+  updated_at      INTEGER NOT NULL,
+  expire_at       INTEGER NOT NULL,
+  request_hash    TEXT NOT NULL DEFAULT '',
+  title           TEXT NOT NULL DEFAULT '',
+  persisted       INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS idempotency_by_expiry ON idempotency(expire_at);
+`
+
+// SQLiteStore 是持久化的 Store 实现（纯 Go 的 modernc.org/sqlite 驱动）。
+// 与 Redis 不同，它不会在写入时删除数据：完整历史都留在 messages 表里，
+// 裁剪策略只在读取（Load / AppendUser 返回快照）时作用于送给模型的上下文。
+// 滚动摘要也不需要单独的队列：已并入摘要的消息在 messages.summarized 上打标记，
+// 裁剪范围内还没有标记的就是待摘要的消息（裁剪策略、置顶、当前分支变了也不会错位）。
+//
+// messages 表存整棵消息树（所有分支），按 seq 是写入顺序，树的结构在 parent_id 上；
+// 当前激活的叶子记在 conversations.head。两阶段写入时回复插回来要改挂之后追加的 user，只改它们的 parent_id。
+type SQLiteStore struct {
+	db    *sql.DB
+	queue *localQueue
+}
+
+func NewSQLiteStore() (*SQLiteStore, error) {
+	path := os.Getenv("CHAT_SQLITE_PATH")
+	if path == "" {
+		path = "eino.db"
+	}
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// 单连接：所有读写在进程内串行，事务语义简单可靠。
+	db.SetMaxOpenConns(1)
+
+	if err := migrateSQLite(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	s := &SQLiteStore{db: db}
+	s.queue = newLocalQueue(s.tryLock)
+	return s, nil
+}
+
+func migrateSQLite(db *sql.DB) error {
+	_, err := db.Exec(sqliteSchema)
+	return err
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) NewConversationID() string {
+	return newID()
+}
+
+func (s *SQLiteStore) tx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// queryer 是 *sql.DB 和 *sql.Tx 的公共子集。
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// loadAll 读取会话当前路径的完整历史（未裁剪）。
+func (s *SQLiteStore) loadAll(ctx context.Context, q queryer, id string) ([]Message, error) {
+	t, err := s.loadTree(ctx, q, id)
+	if err != nil {
+		return nil, err
+	}
+	return t.path(), nil
+}
+
+// loadTree 读取会话的整棵消息树和 head。
+func (s *SQLiteStore) loadTree(ctx context.Context, q queryer, id string) (*tree, error) {
+	var head string
+	err := q.QueryRowContext(ctx, `SELECT head FROM conversations WHERE id = ?`, id).Scan(&head)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	rows, err := q.QueryContext(ctx, `
+SELECT id, parent_id, role, content, created_at, pinned, tool_calls, tool_call_id, tool_name, name, parts FROM messages
+WHERE conversation_id = ? ORDER BY seq`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []Message
+	for rows.Next() {
+		m := Message{V: MessageVersion}
+		var created int64
+		var toolCalls, parts string
+		if err := rows.Scan(&m.ID, &m.ParentID, &m.Role, &m.Content, &created, &m.Pinned,
+			&toolCalls, &m.ToolCallID, &m.ToolName, &m.Name, &parts); err != nil {
+			return nil, err
+		}
+		m.CreatedAt = time.UnixMilli(created).UTC()
+		if toolCalls != "" {
+			if err := json.Unmarshal([]byte(toolCalls), &m.ToolCalls); err != nil {
+				return nil, err
+			}
+			for i := range m.ToolCalls {
+				if m.ToolCalls[i].Type == "" {
+					m.ToolCalls[i].Type = "function"
+				}
+			}
+		}
+		if parts != "" {
+			if err := json.Unmarshal([]byte(parts), &m.Parts); err != nil {
+				return nil, err
+			}
+		}
+		msgs = append(msgs, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return newTree(msgs, head), nil
+}
+
+// pruneConfig 按会话元数据取裁剪配置。
+func (s *SQLiteStore) pruneConfig(ctx context.Context, q queryer, id string) (pruneConfig, error) {
+	cfg, err := s.writeConfig(ctx, q, id)
+	return cfg.pruneConfig, err
+}
+
+func (s *SQLiteStore) writeConfig(ctx context.Context, q queryer, id string) (writeConfig, error) {
+	var model, policy, summary, prompt, owner string
+	err := q.QueryRowContext(ctx, `SELECT model, prune_policy, summary, system_prompt, owner FROM conversations WHERE id = ?`, id).
+		Scan(&model, &policy, &summary, &prompt, &owner)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return writeConfig{}, err
+	}
+	return writeConfig{pruneConfig: newPruneConfig(model, policy, summary), prompt: prompt, owner: owner}, nil
+}
+
+// touch 创建或刷新会话行，并把 message_count 增加 added。
+func (s *SQLiteStore) touch(ctx context.Context, q queryer, id string, added int, now int64) error {
+	_, err := q.ExecContext(ctx, `
+INSERT INTO conversations (id, created_at, updated_at, message_count) VALUES (?, ?, ?, ?)
+ON CONFLICT(id) DO UPDATE SET
+  updated_at = excluded.updated_at,
+  message_count = conversations.message_count + excluded.message_count`, id, now, now, added)
+	return err
+}
+
+// jsonColumn 把切片编码成 JSON 字符串（SQLite 的 TEXT 列、Redis 的 hash 字段），空切片存空串。
+func jsonColumn[T any](v []T) (string, error) {
+	if len(v) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// insert 写入一条消息；m.CreatedAt 为空时用 now。
+func (s *SQLiteStore) insert(ctx context.Context, q queryer, convID string, m Message, now int64) error {
+	created := now
+	if !m.CreatedAt.IsZero() {
+		created = m.CreatedAt.UnixMilli()
+	}
+	toolCalls, err := jsonColumn(m.ToolCalls)
+	if err != nil {
+		return err
+	}
+	parts, err := jsonColumn(m.Parts)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, `
+INSERT INTO messages (conversation_id, id, parent_id, role, content, created_at, pinned,
+  tool_calls, tool_call_id, tool_name, name, parts)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		convID, m.ID, m.ParentID, m.Role, m.Content, created, m.Pinned,
+		toolCalls, m.ToolCallID, m.ToolName, m.Name, parts)
+	return err
+}
+
+// saveTree 写回 t 的改动：插入新节点、更新改挂的节点的 parent_id，记下 head。
+// SQLite 不在写入时裁剪，t 不会删节点。
+func (s *SQLiteStore) saveTree(ctx context.Context, q queryer, convID string, t *tree, now int64) error {
+	for _, m := range t.changed() {
+		if !t.added[m.ID] {
+			if _, err := q.ExecContext(ctx, `UPDATE messages SET parent_id = ? WHERE conversation_id = ? AND id = ?`,
+				m.ParentID, convID, m.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.insert(ctx, q, convID, m, now); err != nil {
+			return err
+		}
+	}
+	_, err := q.ExecContext(ctx, `UPDATE conversations SET head = ? WHERE id = ?`, t.head, convID)
+	return err
+}
+
+// History 返回完整历史；SQLite 不过期，所以只会报 ErrNotFound。
+func (s *SQLiteStore) History(ctx context.Context, id string) ([]Message, error) {
+	if _, err := s.getConversation(ctx, s.db, id); err != nil {
+		return nil, err
+	}
+	return s.loadAll(ctx, s.db, id)
+}
+
+func (s *SQLiteStore) Load(ctx context.Context, id string) ([]Message, error) {
+	msgs, err := s.loadAll(ctx, s.db, id)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := s.pruneConfig(ctx, s.db, id)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.snapshot(msgs), nil
+}
+
+// Update 整体替换会话历史：cur 是当前路径的完整历史（未裁剪），整棵树换成 updater 返回的这一条路径。
+func (s *SQLiteStore) Update(
+	ctx context.Context,
+	id string,
+	updater func(cur []Message) ([]Message, error),
+) ([]Message, error) {
+	var out []Message
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		if err := s.checkFence(ctx, tx, id); err != nil {
+			return err
+		}
+		cur, err := s.loadAll(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		next, err := updater(cur)
+		if err != nil {
+			return err
+		}
+		// 重写之后还在的消息保留已摘要的标记
+		done, err := s.summarizedIDs(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UnixMilli()
+		if _, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE conversation_id = ?`, id); err != nil {
+			return err
+		}
+		if len(next) == 0 {
+			// 只清空消息，元数据保留
+			out = next
+			_, err := tx.ExecContext(ctx, `UPDATE conversations SET updated_at = ?, head = '' WHERE id = ?`, now, id)
+			return err
+		}
+		if err := s.touch(ctx, tx, id, 0, now); err != nil {
+			return err
+		}
+		t := linearTree(next)
+		if err := s.saveTree(ctx, tx, id, t, now); err != nil {
+			return err
+		}
+		var marked []Message
+		for _, m := range t.nodes {
+			if done[m.ID] {
+				marked = append(marked, m)
+			}
+		}
+		if err := s.markSummarized(ctx, tx, id, marked); err != nil {
+			return err
+		}
+		out = next
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// write 见 treeStore：在一个事务里读出整棵树交给 fn 改写，写回改动；不裁剪，快照在读取时按策略裁剪。
+func (s *SQLiteStore) write(ctx context.Context, id string, fn treeWrite) ([]Message, error) {
+	var snap []Message
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		if err := s.checkFence(ctx, tx, id); err != nil {
+			return err
+		}
+		cfg, err := s.writeConfig(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		t, err := s.loadTree(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		added, err := fn(t, cfg)
+		if errors.Is(err, errNoWrite) {
+			snap = cfg.snapshot(t.path())
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		now := time.Now().UnixMilli()
+		if err := s.touch(ctx, tx, id, added, now); err != nil {
+			return err
+		}
+		if err := s.saveTree(ctx, tx, id, t, now); err != nil {
+			return err
+		}
+		snap = cfg.snapshot(t.path())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+func (s *SQLiteStore) AppendUser(ctx context.Context, convID string, userContent string) ([]Message, string, error) {
+	return appendUserTo(ctx, s, convID, userContent)
+}
+
+func (s *SQLiteStore) InsertAssistant(ctx context.Context, convID, userID, assistantContent string) error {
+	return s.InsertReply(ctx, convID, userID, []Message{{Role: "assistant", Content: assistantContent}})
+}
+
+func (s *SQLiteStore) InsertReply(ctx context.Context, convID, userID string, reply []Message) error {
+	return insertReplyTo(ctx, s, convID, userID, reply)
+}
+
+func (s *SQLiteStore) ReplaceReply(ctx context.Context, convID, userID string, reply []Message) (*Branch, error) {
+	return replaceReplyIn(ctx, s, convID, userID, reply)
+}
+
+func (s *SQLiteStore) EditUser(ctx context.Context, convID, msgID, content string) ([]Message, string, *Branch, error) {
+	return editUserIn(ctx, s, convID, msgID, content)
+}
+
+func (s *SQLiteStore) SwitchBranch(ctx context.Context, convID, branchID string) (*Branch, error) {
+	return switchBranchIn(ctx, s, convID, branchID)
+}
+
+func (s *SQLiteStore) Branches(ctx context.Context, convID string) ([]Branch, error) {
+	if _, err := s.getConversation(ctx, s.db, convID); err != nil {
+		return nil, err
+	}
+	t, err := s.loadTree(ctx, s.db, convID)
+	if err != nil {
+		return nil, err
+	}
+	return t.branches(), nil
+}
+
+// Fork 在一个事务里复制元数据和路径，已摘要的标记跟着复制。
+// 有已摘要的消息不在复制的路径上（在分叉点之后或者别的分支上）时，摘要会包含新会话里没有的内容，
+// 这种情况下新会话不带摘要，重新累积。
+func (s *SQLiteStore) Fork(ctx context.Context, convID, msgID, newID string) (*Conversation, error) {
+	var out *Conversation
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		src, err := s.getConversation(ctx, tx, convID)
+		if err != nil {
+			return err
+		}
+		t, err := s.loadTree(ctx, tx, convID)
+		if err != nil {
+			return err
+		}
+		cur, msgs, err := forkMessages(t, msgID)
+		if err != nil {
+			return err
+		}
+		n := countMessages(msgs)
+		done, err := s.summarizedIDs(ctx, tx, convID)
+		if err != nil {
+			return err
+		}
+		// forkMessages 保持顺序，msgs[i] 是 cur[i] 的副本
+		var marked []Message
+		for i, m := range cur {
+			if done[m.ID] {
+				marked = append(marked, msgs[i])
+			}
+		}
+		summary := src.Summary
+		if len(marked) < len(done) {
+			summary, marked = "", nil
+		}
+		tools, err := jsonColumn(src.Tools)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UnixMilli()
+		if _, err := tx.ExecContext(ctx, `
+INSERT INTO conversations (id, created_at, updated_at, title, owner, model, message_count, summary,
+  prune_policy, tools, forked_from, persona, system_prompt)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			newID, now, now, src.Title, src.Owner, src.Model, n, summary,
+			src.PrunePolicy, tools, convID, src.Persona, src.SystemPrompt); err != nil {
+			return err
+		}
+		if err := s.saveTree(ctx, tx, newID, linearTree(msgs), now); err != nil {
+			return err
+		}
+		if err := s.markSummarized(ctx, tx, newID, marked); err != nil {
+			return err
+		}
+		out, err = s.getConversation(ctx, tx, newID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (s *SQLiteStore) PendingSummary(ctx context.Context, id string) (string, []Message, error) {
+	var (
+		summary string
+		pending []Message
+	)
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		if _, err := s.getConversation(ctx, tx, id); err != nil {
+			return err
+		}
+		msgs, err := s.loadAll(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		cfg, err := s.pruneConfig(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		summary = cfg.summary
+		plan := cfg.plan(msgs)
+		if !plan.Summarize {
+			// 和 Redis / 内存一致：策略不做摘要时裁掉的消息不进待摘要队列
+			return nil
+		}
+		dropped := plan.Dropped(msgs)
+		done, err := s.summarizedIDs(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		for _, m := range dropped {
+			if !done[m.ID] {
+				pending = append(pending, m)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return summary, pending, nil
+}
+
+// summarizedIDs 返回树上已经并入摘要的消息 ID。
+func (s *SQLiteStore) summarizedIDs(ctx context.Context, q queryer, id string) (map[string]bool, error) {
+	rows, err := q.QueryContext(ctx, `
+SELECT id FROM messages WHERE conversation_id = ? AND summarized = 1`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	done := map[string]bool{}
+	for rows.Next() {
+		var msgID string
+		if err := rows.Scan(&msgID); err != nil {
+			return nil, err
+		}
+		done[msgID] = true
+	}
+	return done, rows.Err()
+}
+
+// markSummarized 把 msgs 记为已并入摘要。
+func (s *SQLiteStore) markSummarized(ctx context.Context, q queryer, id string, msgs []Message) error {
+	for _, m := range msgs {
+		if _, err := q.ExecContext(ctx, `UPDATE messages SET summarized = 1 WHERE conversation_id = ? AND id = ?`, id, m.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) SaveSummary(ctx context.Context, id, prev, summary string, batch []Message) error {
+	return s.tx(ctx, func(tx *sql.Tx) error {
+		if err := s.checkFence(ctx, tx, id); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, `UPDATE conversations SET summary = ? WHERE id = ? AND summary = ?`, summary, id, prev)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 1 {
+			return s.markSummarized(ctx, tx, id, batch)
+		}
+		if _, err := s.getConversation(ctx, tx, id); err != nil {
+			return err
+		}
+		return ErrConflict
+	})
+}
+
+func (s *SQLiteStore) PinMessage(ctx context.Context, convID, msgID string, pinned bool) (*Message, error) {
+	var out *Message
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		if err := s.checkFence(ctx, tx, convID); err != nil {
+			return err
+		}
+		if _, err := s.getConversation(ctx, tx, convID); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, `UPDATE messages SET pinned = ? WHERE conversation_id = ? AND id = ?`,
+			pinned, convID, msgID)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrMessageNotFound
+		}
+		t, err := s.loadTree(ctx, tx, convID)
+		if err != nil {
+			return err
+		}
+		if m, ok := t.get(msgID); ok {
+			out = &m
+		}
+		return nil
+	})
+	return out, err
+}
+
+// AcquireLock：在进程内排队抢锁，锁本身记在 locks 表里。
+func (s *SQLiteStore) AcquireLock(ctx context.Context, convID string, wait time.Duration, queued func(pos int)) (*Lease, bool, error) {
+	ttl := lockTTL()
+	token, fence, err := waitLock(ctx, s.queue, convID, ttl, wait, queued)
+	if err != nil || fence == 0 {
+		return nil, false, err
+	}
+	return newLease(ctx, s, convID, token, fence, ttl), true, nil
+}
+
+// tryLock：锁不存在或已过期时才能抢到（INSERT ... ON CONFLICT DO UPDATE WHERE 过期），
+// 抢到时 fence 加一并返回（第一次上锁从 fenceSeed 开始）；没抢到时 UPDATE 不生效，RETURNING 没有行，返回 0。
+func (s *SQLiteStore) tryLock(ctx context.Context, convID, token string, ttl time.Duration) (int64, error) {
+	now := time.Now()
+
+	var fence int64
+	err := s.db.QueryRowContext(ctx, `
+INSERT INTO locks (conversation_id, token, expire_at, fence) VALUES (?, ?, ?, ?)
+ON CONFLICT(conversation_id) DO UPDATE SET token = excluded.token, expire_at = excluded.expire_at, fence = locks.fence + 1
+WHERE locks.expire_at <= ?
+RETURNING fence`, convID, token, now.Add(ttl).UnixMilli(), fenceSeed(), now.UnixMilli()).Scan(&fence)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return fence, err
+}
+
+// RenewLock：锁还是 token 的并且没过期才续期。
+func (s *SQLiteStore) RenewLock(ctx context.Context, convID, token string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	res, err := s.db.ExecContext(ctx, `
+UPDATE locks SET expire_at = ? WHERE conversation_id = ? AND token = ? AND expire_at > ?`,
+		now.Add(ttl).UnixMilli(), convID, token, now.UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// ReleaseLock 只把锁标记为过期、不删行，fence 计数要留给下一个持有者接着加。
+func (s *SQLiteStore) ReleaseLock(ctx context.Context, convID, token string) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE locks SET expire_at = 0 WHERE conversation_id = ? AND token = ?`, convID, token)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		s.queue.notify(convID)
+	}
+	return nil
+}
+
+// checkFence 在写事务里校验 ctx 里的 fencing 号（单连接，事务之间是串行的）。
+func (s *SQLiteStore) checkFence(ctx context.Context, q queryer, convID string) error {
+	fence, err := fenceFrom(ctx)
+	if err != nil || fence == unfenced {
+		return err
+	}
+	var cur int64
+	err = q.QueryRowContext(ctx, `SELECT fence FROM locks WHERE conversation_id = ?`, convID).Scan(&cur)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if fenced(fence, cur) {
+		return ErrFenced
+	}
+	return nil
+}
+
+const conversationColumns = `id, title, created_at, updated_at, message_count, owner, model, summary, prune_policy, tools, forked_from, persona, system_prompt`
+
+func scanConversation(sc interface{ Scan(dest ...any) error }) (*Conversation, error) {
+	var c Conversation
+	var created, updated int64
+	var tools string
+	if err := sc.Scan(&c.ID, &c.Title, &created, &updated, &c.MessageCount, &c.Owner, &c.Model, &c.Summary, &c.PrunePolicy, &tools, &c.ForkedFrom, &c.Persona, &c.SystemPrompt); err != nil {
+		return nil, err
+	}
+	if tools != "" {
+		if err := json.Unmarshal([]byte(tools), &c.Tools); err != nil {
+			return nil, err
+		}
+	}
+	c.CreatedAt = time.UnixMilli(created)
+	c.UpdatedAt = time.UnixMilli(updated)
+	return &c, nil
+}
+
+func (s *SQLiteStore) getConversation(ctx context.Context, q queryer, id string) (*Conversation, error) {
+	c, err := scanConversation(q.QueryRowContext(ctx,
+		`SELECT `+conversationColumns+` FROM conversations WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return c, err
+}
+
+func (s *SQLiteStore) EnsureConversation(ctx context.Context, c Conversation) (*Conversation, error) {
+	now := time.Now().UnixMilli()
+	tools, err := jsonColumn(c.Tools)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.db.ExecContext(ctx, `
+INSERT INTO conversations (id, created_at, updated_at, title, owner, model, persona, system_prompt, tools)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(id) DO NOTHING`, c.ID, now, now, c.Title, c.Owner, c.Model, c.Persona, c.SystemPrompt, tools)
+	if err != nil {
+		return nil, err
+	}
+	return s.getConversation(ctx, s.db, c.ID)
+}
+
+func (s *SQLiteStore) GetConversation(ctx context.Context, id string) (*Conversation, error) {
+	return s.getConversation(ctx, s.db, id)
+}
+
+func (s *SQLiteStore) ListConversations(ctx context.Context, owner string) ([]Conversation, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+conversationColumns+` FROM conversations WHERE owner = ? ORDER BY updated_at DESC`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Conversation
+	for rows.Next() {
+		c, err := scanConversation(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *c)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLiteStore) UpdateConversation(ctx context.Context, id string, patch ConversationPatch) (*Conversation, error) {
+	var out *Conversation
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		if err := s.checkFence(ctx, tx, id); err != nil {
+			return err
+		}
+		c, err := s.getConversation(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if patch.IfEmpty && c.MessageCount > 0 {
+			return ErrConflict
+		}
+		patch.apply(c)
+		tools, err := jsonColumn(c.Tools)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE conversations SET title = ?, prune_policy = ?, tools = ?, system_prompt = ?, persona = ?, model = ? WHERE id = ?`,
+			c.Title, c.PrunePolicy, tools, c.SystemPrompt, c.Persona, c.Model, id); err != nil {
+			return err
+		}
+		if patch.SystemPrompt != nil {
+			// 只改树根的 system 消息
+			if _, err := tx.ExecContext(ctx, `UPDATE messages SET content = ? WHERE conversation_id = ? AND parent_id = '' AND role = 'system'`,
+				systemPrompt(c.SystemPrompt), id); err != nil {
+				return err
+			}
+		}
+		out = c
+		return nil
+	})
+	return out, err
+}
+
+func (s *SQLiteStore) DeleteConversation(ctx context.Context, id string) error {
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE conversation_id = ?`, id); err != nil {
+			return err
+		}
+		// 锁（连同 fencing 计数）和幂等键记录也删掉，同一个 ID 重新创建的会话不会继承它们
+		if _, err := tx.ExecContext(ctx, `DELETE FROM locks WHERE conversation_id = ?`, id); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM idempotency WHERE conversation_id = ?`, id); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, `DELETE FROM conversations WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+	if err == nil {
+		// 排队等锁的请求马上重试
+		s.queue.notify(id)
+	}
+	return err
+}
+
+// BeginIdempotency：key 不存在或已过期时写入（过期的行顺带清掉），否则返回已有的记录。
+func (s *SQLiteStore) BeginIdempotency(ctx context.Context, rec IdempotencyRecord) (*IdempotencyRecord, bool, error) {
+	now := time.Now()
+	rec.UpdatedAt = now.UTC()
+	var out *IdempotencyRecord
+	created := false
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM idempotency WHERE expire_at <= ?`, now.UnixMilli()); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, `
+INSERT INTO idempotency (key, conversation_id, request_hash, user_id, answer, title, persisted, status, error, updated_at, expire_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT(key) DO NOTHING`,
+			rec.Key, rec.ConversationID, rec.RequestHash, rec.UserID, rec.Answer, rec.Title, rec.Persisted, rec.Status, rec.Error,
+			now.UnixMilli(), now.Add(rec.ttl()).UnixMilli())
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 1 {
+			out, created = &rec, true
+			return err
+		}
+		out, err = s.getIdempotency(ctx, tx, rec.Key, now)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return out, created, nil
+}
+
+func (s *SQLiteStore) GetIdempotency(ctx context.Context, key string) (*IdempotencyRecord, error) {
+	return s.getIdempotency(ctx, s.db, key, time.Now())
+}
+
+func (s *SQLiteStore) getIdempotency(ctx context.Context, q queryer, key string, now time.Time) (*IdempotencyRecord, error) {
+	rec := IdempotencyRecord{Key: key}
+	var updated int64
+	err := q.QueryRowContext(ctx, `
+SELECT conversation_id, request_hash, user_id, answer, title, persisted, status, error, updated_at
+FROM idempotency WHERE key = ? AND expire_at > ?`,
+		key, now.UnixMilli()).Scan(&rec.ConversationID, &rec.RequestHash, &rec.UserID, &rec.Answer, &rec.Title,
+		&rec.Persisted, &rec.Status, &rec.Error, &updated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	rec.UpdatedAt = time.UnixMilli(updated).UTC()
+	return &rec, nil
+}
+
+func (s *SQLiteStore) SaveIdempotency(ctx context.Context, rec IdempotencyRecord) error {
+	now := time.Now()
+	_, err := s.db.ExecContext(ctx, `
+INSERT INTO idempotency (key, conversation_id, request_hash, user_id, answer, title, persisted, status, error, updated_at, expire_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(key) DO UPDATE SET conversation_id = excluded.conversation_id, request_hash = excluded.request_hash,
+  user_id = excluded.user_id, answer = excluded.answer, title = excluded.title, persisted = excluded.persisted,
+  status = excluded.status, error = excluded.error, updated_at = excluded.updated_at, expire_at = excluded.expire_at`,
+		rec.Key, rec.ConversationID, rec.RequestHash, rec.UserID, rec.Answer, rec.Title, rec.Persisted, rec.Status, rec.Error,
+		now.UnixMilli(), now.Add(rec.ttl()).UnixMilli())
+	return err
+}
+
+func (s *SQLiteStore) DeleteIdempotency(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM idempotency WHERE key = ?`, key)
+	return err
+}
@@ -2,224 +2,183 @@ package session
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/redis/go-redis/v9"
 )
 
 var ErrConflict = errors.New("session update conflict, please retry")
 
+// Message 是持久化的一条消息，JSON 编解码见 message.go（带版本号，兼容老数据）。
 type Message struct {
-	ID       string `json:"id,omitempty"`
-	ParentID string `json:"parent_id,omitempty"` // assistant 对应的 user id
-	Role     string `json:"role"`
-	Content  string `json:"content"`
+	V         int       `json:"v,omitempty"` // 存储格式版本，写入时总是 MessageVersion
+	ID        string    `json:"id,omitempty"`
+	ParentID  string    `json:"parent_id,omitempty"` // 树上的父节点：user 挂在前一条消息下，一组回复依次挂在 user 下面（见 branch.go）
+	Role      string    `json:"role"`
+	Content   string    `json:"content"`             // 有 Parts 时是其中文本片段的拼接
+	CreatedAt time.Time `json:"created_at,omitzero"` // 老数据没有这个字段
+	Pinned    bool      `json:"pinned,omitempty"`    // 置顶消息不会被 sliding 策略裁掉
+
+	Name       string        `json:"name,omitempty"`         // 发言者名字（多人/多角色场景）
+	Parts      []ContentPart `json:"parts,omitempty"`        // 多模态内容；非空时优先于 Content
+	ToolCalls  []ToolCall    `json:"tool_calls,omitempty"`   // assistant 发起的工具调用
+	ToolCallID string        `json:"tool_call_id,omitempty"` // role=tool 时对应的调用 ID
+	ToolName   string        `json:"tool_name,omitempty"`    // role=tool 时对应的工具名
 }
 
-type Store struct {
-	rdb *redis.Client
-	ttl time.Duration
+// ToolCall 是 assistant 发起的一次工具调用，Arguments 是 JSON 字符串。
+type ToolCall struct {
+	ID        string `json:"id"`
+	Type      string `json:"type,omitempty"` // 目前只有 function，空串按 function 处理
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
 }
 
-func NewStore() (*Store, error) {
-	ttlStr := os.Getenv("CHAT_SESSION_TTL")
-	if ttlStr == "" {
-		ttlStr = "30m"
-	}
-	ttl, err := time.ParseDuration(ttlStr)
-	if err != nil {
-		return nil, err
-	}
-
-	db := 0
-	if v := os.Getenv("REDIS_DB"); v != "" {
-		if n, err := strconv.Atoi(v); err == nil {
-			db = n
-		}
-	}
-
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     os.Getenv("REDIS_ADDR"),
-		Password: os.Getenv("REDIS_PASSWORD"),
-		DB:       db,
-	})
-
-	return &Store{
-		rdb: rdb,
-		ttl: ttl,
-	}, nil
-}
-
-func (s *Store) NewConversationID() string {
-	return uuid.NewString()
+// Store 是会话存储的抽象，各后端对外语义保持一致：
+// Load / AppendUser 返回的都是按会话的 PrunePolicy 裁剪后的上下文（有摘要时带上摘要），锁必须带 token 才能释放。
+// 消息按 ParentID 组成一棵树（见 branch.go），会话记着当前激活的叶子，读写都针对从根到它的那条路径。
+// Redis / 内存后端在写入时裁剪并刷新 TTL；SQLite 后端保留完整历史，只在读取时裁剪。
+type Store interface {
+	NewConversationID() string
+
+	// Load 返回从根到当前激活叶子的路径（已裁剪，有摘要时带上摘要），可以直接交给模型。
+	Load(ctx context.Context, id string) ([]Message, error)
+	// History 返回当前路径上后端保留的全部消息（Redis / 内存是裁剪后剩下的，SQLite 是完整历史）。
+	// 会话从未存在时返回 ErrNotFound，存在过但已过期时返回 ErrExpired。
+	History(ctx context.Context, id string) ([]Message, error)
+	// Update 原子地执行 “读-改-写”，updater 接收当前路径（可能为空），返回更新后的 msgs；
+	// 写回时整棵树换成只有这一条路径（ParentID 依次串起来），其他分支丢弃。
+	Update(ctx context.Context, id string, updater func(cur []Message) ([]Message, error)) ([]Message, error)
+
+	// AppendUser 是两阶段写入的 Phase 1：返回追加后（已裁剪）的快照和本次 user 的 msgID。
+	AppendUser(ctx context.Context, convID string, userContent string) ([]Message, string, error)
+	// InsertAssistant 是 Phase 2：把 assistant 插回对应 user 后面，同一个 userID 只插一次。
+	InsertAssistant(ctx context.Context, convID, userID, assistantContent string) error
+	// InsertReply 是 Phase 2 的通用形式：把一组回复（工具调用、工具结果、最终回复）按顺序挂到对应 user 下面，
+	// 由 Store 补上 ID / ParentID / CreatedAt；同一个 userID 只插一次。
+	InsertReply(ctx context.Context, convID, userID string, reply []Message) error
+	// ReplaceReply 给 userID 再挂一组回复并切过去：旧回复（连同之后的轮次）留在树上，成为一个分支。
+	// 返回旧回复所在的分支，user 还没有回复时为 nil；user 不在树上（已被裁剪）时返回 ErrUserPruned。
+	ReplaceReply(ctx context.Context, convID, userID string, reply []Message) (*Branch, error)
+	// Branches 返回所有不在当前路径上的分支，按创建时间排序。
+	Branches(ctx context.Context, convID string) ([]Branch, error)
+	// EditUser 编辑一条 user：在它的父节点下面挂一个内容为 content 的新 user 并切过去，原来的 user 连同之后的轮次成为一个分支。
+	// 返回值和 AppendUser 一样是（已裁剪的）快照和新 user 的 msgID，另外带上原来的分支；
+	// 树上没有这条 user 时返回 ErrMessageNotFound。
+	EditUser(ctx context.Context, convID, msgID, content string) ([]Message, string, *Branch, error)
+	// SwitchBranch 把当前激活的叶子换成 branchID（树上任意一条消息）下面最新的叶子，返回换下来的分支；
+	// branchID 已经在当前路径上时什么都不做，返回 nil。消息不在树上返回 ErrBranchNotFound。
+	SwitchBranch(ctx context.Context, convID, branchID string) (*Branch, error)
+	// Fork 把 convID 树上从根到 msgID（含，为空表示当前路径）的消息原子地复制到新会话 newID：
+	// 消息换新 ID（parent_id 跟着映射），元数据（标题、owner、模型、裁剪策略、工具、还适用的摘要）一并复制，
+	// ForkedFrom 指向 convID；其他分支不复制。msgID 不在树上时返回 ErrMessageNotFound。
+	Fork(ctx context.Context, convID, msgID, newID string) (*Conversation, error)
+
+	// PendingSummary 返回当前摘要和已被裁剪、还没并入摘要的消息（按时间顺序）。
+	// 只有 CHAT_SUMMARIZE 开启时写入路径才会记录被裁剪的消息。
+	PendingSummary(ctx context.Context, id string) (summary string, pending []Message, err error)
+	// SaveSummary 把摘要替换为 summary，并把 batch（PendingSummary 返回的前几条）记为已并入摘要；
+	// 摘要在此期间被别人改过（不等于 prev）时返回 ErrConflict。
+	SaveSummary(ctx context.Context, id, prev, summary string, batch []Message) error
+	// PinMessage 设置消息的置顶状态并返回更新后的消息；消息不存在（或已被裁剪）时返回 ErrMessageNotFound。
+	PinMessage(ctx context.Context, convID, msgID string, pinned bool) (*Message, error)
+
+	// AcquireLock 排队抢会话锁（TTL 为 CHAT_LOCK_TTL）：等锁的请求按到达顺序排队，锁释放时立刻唤醒队首，
+	// 最多等 wait（<= 0 时只试一次），等不到返回 ok=false；排队位置变化时回调 queued（可以为 nil，1 表示下一个）。
+	// 抢到时返回在后台续期的租约，用完调 Lease.Release；ctx 结束后停止续期。
+	AcquireLock(ctx context.Context, convID string, wait time.Duration, queued func(pos int)) (lease *Lease, ok bool, err error)
+	// RenewLock 在锁仍由 token 持有且未过期时把过期时间重置为 ttl，返回是否续上。
+	RenewLock(ctx context.Context, convID, token string, ttl time.Duration) (bool, error)
+	ReleaseLock(ctx context.Context, convID, token string) error
+
+	// EnsureConversation 在会话元数据不存在时按 c 创建（只取 ID/Title/Owner/Model/Persona/SystemPrompt/Tools），
+	// 已存在则原样返回，不做修改。
+	EnsureConversation(ctx context.Context, c Conversation) (*Conversation, error)
+	// GetConversation 不存在（或已过期）时返回 ErrNotFound。
+	GetConversation(ctx context.Context, id string) (*Conversation, error)
+	// ListConversations 返回 owner 名下的会话，按最近更新时间倒序。
+	ListConversations(ctx context.Context, owner string) ([]Conversation, error)
+	UpdateConversation(ctx context.Context, id string, patch ConversationPatch) (*Conversation, error)
+	// DeleteConversation 删除元数据和全部消息；不存在时返回 ErrNotFound。
+	DeleteConversation(ctx context.Context, id string) error
+
+	// BeginIdempotency 原子地登记 rec（Status 为 pending）：rec.Key 不存在（或已过期）时写入并返回 created=true，
+	// 已存在时不做修改，返回已有的记录。
+	BeginIdempotency(ctx context.Context, rec IdempotencyRecord) (existing *IdempotencyRecord, created bool, err error)
+	// GetIdempotency 不存在（或已过期）时返回 ErrNotFound。
+	GetIdempotency(ctx context.Context, key string) (*IdempotencyRecord, error)
+	// SaveIdempotency 覆盖写入记录，并按新的 Status 重置过期时间。
+	SaveIdempotency(ctx context.Context, rec IdempotencyRecord) error
+	DeleteIdempotency(ctx context.Context, key string) error
 }
 
-func (s *Store) key(id string) string {
-	return "chat_session:" + id
-}
-
-func (s *Store) systemPrompt() string {
-	prompt := strings.TrimSpace(os.Getenv("CHAT_SYSTEM_PROMPT"))
-	if prompt == "" {
-		return "你是一个后端助手，回答简洁、工程化。"
+// NewStore 按 CHAT_STORE 选择后端：redis（默认）/ memory / sqlite。
+func NewStore() (Store, error) {
+	switch kind := strings.ToLower(strings.TrimSpace(os.Getenv("CHAT_STORE"))); kind {
+	case "", "redis":
+		return NewRedisStore()
+	case "memory":
+		return NewMemoryStore()
+	case "sqlite":
+		return NewSQLiteStore()
+	default:
+		return nil, fmt.Errorf("unknown CHAT_STORE %q (want redis, memory or sqlite)", kind)
 	}
-	return prompt
 }
 
-func (s *Store) Load(ctx context.Context, id string) ([]Message, error) {
-	return s.loadMessages(ctx, s.key(id))
-}
-
-// Save 弃用，仅用于调试
-// Save writes the full message list; prefer Update/UpdateWithRetry in normal flows.
-func (s *Store) Save(ctx context.Context, id string, msgs []Message) error {
-	return s.saveMessages(ctx, s.key(id), msgs)
-}
-
-// Update: 用 WATCH/MULTI 保证 “读-改-写” 在并发下不会丢更新。
-// updater 接收当前 msgs（可能为空），返回更新后的 msgs。
-func (s *Store) Update(
-	ctx context.Context,
-	id string,
-	updater func(cur []Message) ([]Message, error),
-) ([]Message, error) {
-
-	key := s.key(id)
-
-	var out []Message
-	err := s.rdb.Watch(ctx, func(tx *redis.Tx) error {
-		cur, err := s.loadMessagesCtx(ctx, tx, key)
-		if err != nil {
-			return err
-		}
-
-		// 2) 让调用方基于 cur 生成新值
-		next, err := updater(cur)
-		if err != nil {
-			return err
-		}
-
-		// 3) MULTI/EXEC 提交（带 TTL）
-		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
-			return s.writeMessages(ctx, p, key, next)
-		})
-		if err != nil {
-			// 如果 key 在 WATCH 后被别人改过，这里会返回 redis.TxFailedErr
-			if errors.Is(err, redis.TxFailedErr) {
-				return ErrConflict
-			}
-			return err
-		}
-
-		out = next
-		return nil
-	}, key)
-
-	if err != nil {
-		return nil, err
-	}
-	return out, nil
+func newID() string {
+	return uuid.NewString()
 }
 
-// UpdateWithRetry: retry Update on ErrConflict up to n times.
-func (s *Store) UpdateWithRetry(
-	ctx context.Context,
-	id string,
-	n int,
-	updater func(cur []Message) ([]Message, error),
-) ([]Message, error) {
-	var lastErr error
-	for i := 0; i < n; i++ {
-		out, err := s.Update(ctx, id, updater)
-		if err == nil {
-			return out, nil
+// stampReply 给一组回复消息补上 ID / ParentID / CreatedAt（返回新切片）：
+// 第一条挂在 userID 下面，之后每条挂在前一条下面。
+func stampReply(userID string, reply []Message) []Message {
+	out := make([]Message, len(reply))
+	parent := userID
+	for i, m := range reply {
+		if m.ID == "" {
+			m.ID = newID()
 		}
-		if errors.Is(err, ErrConflict) {
-			lastErr = err
-			continue
+		m.ParentID = parent
+		if m.CreatedAt.IsZero() {
+			m.CreatedAt = nowUTC()
 		}
-		return nil, err
+		out[i] = m
+		parent = m.ID
 	}
-	return nil, lastErr
+	return out
 }
 
-// loadMessages: read all messages stored as a Redis list. Each element is a JSON-encoded Message.
-func (s *Store) loadMessages(ctx context.Context, key string) ([]Message, error) {
-	return s.loadMessagesCtx(ctx, s.rdb, key)
+// nowUTC 统一用 UTC，保证 Message 序列化后再解码、再序列化得到的字节不变。
+func nowUTC() time.Time {
+	return time.Now().UTC()
 }
 
-func (s *Store) loadMessagesCtx(ctx context.Context, cmd redis.Cmdable, key string) ([]Message, error) {
-	vals, err := cmd.LRange(ctx, key, 0, -1).Result()
-	if err == redis.Nil {
-		return nil, nil
-	}
-	if err != nil {
-		return nil, err
-	}
-	msgs := make([]Message, 0, len(vals))
-	for _, v := range vals {
-		var m Message
-		if err := json.Unmarshal([]byte(v), &m); err != nil {
-			return nil, err
-		}
-		msgs = append(msgs, m)
-	}
-	return msgs, nil
+// tombstoneTTL 是过期会话留下的 “曾经存在过” 标记的保留时间，用于区分过期和不存在。
+func tombstoneTTL() time.Duration {
+	return getDurationEnv("CHAT_TOMBSTONE_TTL", 30*24*time.Hour)
 }
 
-func (s *Store) saveMessages(ctx context.Context, key string, msgs []Message) error {
-	_, err := s.rdb.TxPipelined(ctx, func(p redis.Pipeliner) error {
-		return s.writeMessages(ctx, p, key, msgs)
-	})
-	return err
-}
-
-func (s *Store) writeMessages(ctx context.Context, p redis.Pipeliner, key string, msgs []Message) error {
-	p.Del(ctx, key)
-	if len(msgs) > 0 {
-		elems := make([]interface{}, 0, len(msgs))
-		for _, m := range msgs {
-			b, err := json.Marshal(m)
-			if err != nil {
-				return err
-			}
-			elems = append(elems, b)
-		}
-		p.RPush(ctx, key, elems...)
+func sessionTTL() (time.Duration, error) {
+	ttlStr := os.Getenv("CHAT_SESSION_TTL")
+	if ttlStr == "" {
+		ttlStr = "30m"
 	}
-	p.Expire(ctx, key, s.ttl)
-	return nil
+	return time.ParseDuration(ttlStr)
 }
 
-// applyPrune trims the list to match prune rules using list ops, and refreshes TTL.
-func (s *Store) applyPrune(ctx context.Context, key string, history []Message) error {
-	if len(history) == 0 {
-		return s.rdb.Del(ctx, key).Err()
-	}
-
-	keepSystem, tailStart := prunePlan(history)
-	if tailStart < 0 {
-		tailStart = 0
-	}
-
-	pipe := s.rdb.Pipeline()
-	if tailStart > 0 {
-		pipe.LTrim(ctx, key, int64(tailStart), -1)
+// systemPrompt 返回会话的 system prompt：custom 是会话自己的，为空时用全局默认。
+func systemPrompt(custom string) string {
+	if custom != "" {
+		return custom
 	}
-	if keepSystem && tailStart > 0 {
-		b, err := json.Marshal(history[0])
-		if err != nil {
-			return err
-		}
-		pipe.LPush(ctx, key, b)
+	prompt := strings.TrimSpace(os.Getenv("CHAT_SYSTEM_PROMPT"))
+	if prompt == "" {
+		return "你是一个后端助手，回答简洁、工程化。"
 	}
-	pipe.Expire(ctx, key, s.ttl)
-	_, err := pipe.Exec(ctx)
-	return err
+	return prompt
 }
@@ -0,0 +1,378 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// testStores 返回三个后端的新实例：内存、临时文件上的 SQLite、miniredis 上的 Redis。
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	mem, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("CHAT_SQLITE_PATH", filepath.Join(t.TempDir(), "eino.db"))
+	sqlite, err := NewSQLiteStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sqlite.Close() })
+
+	t.Setenv("REDIS_ADDR", miniredis.RunT(t).Addr())
+	rdb, err := NewRedisStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = rdb.rdb.Close() })
+
+	return map[string]Store{"memory": mem, "sqlite": sqlite, "redis": rdb}
+}
+
+// describe 把消息压成便于比较的字符串（ID 各后端不同，不参与比较）。
+func describe(msgs []Message) []string {
+	out := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		s := m.Role + ":" + m.Content
+		if m.Pinned {
+			s += " [pinned]"
+		}
+		if len(m.ToolCalls) > 0 {
+			s += " [calls " + m.ToolCalls[0].Name + "]"
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// runHistory 在 s 上按固定顺序写一段对话：第 2 轮是一组工具调用，第 1 轮的 user 置顶，
+// 第 5、6 轮两个 user 先后追加、回复再按相反的顺序插回（两阶段写入的并发顺序）。
+// 返回最后的上下文和待摘要的消息。
+func runHistory(t *testing.T, s Store, policy string) (window, pending []string) {
+	t.Helper()
+	ctx := WithoutFence(context.Background())
+	id := s.NewConversationID()
+	if _, err := s.EnsureConversation(ctx, Conversation{ID: id, Model: "gpt-4o"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UpdateConversation(ctx, id, ConversationPatch{PrunePolicy: &policy}); err != nil {
+		t.Fatal(err)
+	}
+	filler := strings.Repeat(" lorem ipsum dolor sit amet", 4)
+	ask := func(i int) string {
+		_, userID, err := s.AppendUser(ctx, id, fmt.Sprintf("q%d%s", i, filler))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return userID
+	}
+	reply := func(userID string, i int) {
+		msgs := []Message{{Role: "assistant", Content: fmt.Sprintf("a%d%s", i, filler)}}
+		if i == 2 {
+			msgs = []Message{
+				{Role: "assistant", ToolCalls: []ToolCall{{ID: "call-1", Name: "clock", Arguments: "{}"}}},
+				{Role: "tool", ToolCallID: "call-1", ToolName: "clock", Content: "12:00"},
+				msgs[0],
+			}
+		}
+		if err := s.InsertReply(ctx, id, userID, msgs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		userID := ask(i)
+		reply(userID, i)
+		if i == 1 {
+			if _, err := s.PinMessage(ctx, id, userID, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	u5, u6 := ask(5), ask(6)
+	reply(u6, 6)
+	reply(u5, 5)
+	reply(ask(7), 7)
+
+	msgs, err := s.Load(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, dropped, err := s.PendingSummary(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return describe(msgs), describe(dropped)
+}
+
+// 同一段历史在三个后端上裁剪出的窗口必须完全一致：裁剪计划只有 prune.go 一份实现。
+func TestPruneParity(t *testing.T) {
+	t.Setenv("CHAT_MAX_TURNS", "3")
+	t.Setenv("CHAT_MODEL_BUDGETS", "gpt-4o=160/0")
+	t.Setenv("CHAT_SYSTEM_PROMPT", "sys")
+
+	for _, policy := range []string{PolicyTurns, PolicyTokens, PolicySliding, PolicySummarize} {
+		t.Run(policy, func(t *testing.T) {
+			stores := testStores(t)
+			want, wantPending := runHistory(t, stores["memory"], policy)
+			if len(want) < 3 || want[0] != "system:sys" {
+				t.Fatalf("unexpected memory window: %q", want)
+			}
+			if len(want) >= 19 {
+				t.Fatalf("nothing pruned, the test budget is too loose: %q", want)
+			}
+			if (policy == PolicySummarize) != (len(wantPending) > 0) {
+				t.Fatalf("pending = %q", wantPending)
+			}
+			for _, name := range []string{"sqlite", "redis"} {
+				got, pending := runHistory(t, stores[name], policy)
+				if !slices.Equal(got, want) {
+					t.Errorf("%s window differs:\n got  %q\n want %q", name, got, want)
+				}
+				if !slices.Equal(pending, wantPending) {
+					t.Errorf("%s pending differs:\n got  %q\n want %q", name, pending, wantPending)
+				}
+			}
+		})
+	}
+}
+
+// 两阶段写入不持会话锁：并发追加和插回的回复一条都不能丢，每条回复都紧跟在自己的 user 后面。
+func TestConcurrentTwoPhase(t *testing.T) {
+	t.Setenv("CHAT_MAX_TURNS", "100")
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := WithoutFence(context.Background())
+			id := s.NewConversationID()
+			const n = 8
+			var wg sync.WaitGroup
+			errs := make(chan error, n)
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, userID, err := s.AppendUser(ctx, id, fmt.Sprintf("q%d", i))
+					if err == nil {
+						err = s.InsertAssistant(ctx, id, userID, fmt.Sprintf("a%d", i))
+					}
+					errs <- err
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			msgs, err := s.History(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(msgs) != 1+2*n {
+				t.Fatalf("got %d messages, want %d: %q", len(msgs), 1+2*n, describe(msgs))
+			}
+			for i := 1; i < len(msgs); i += 2 {
+				u, a := msgs[i], msgs[i+1]
+				if u.Role != "user" || a.ParentID != u.ID || "a"+u.Content[1:] != a.Content {
+					t.Fatalf("reply not after its user at %d: %q", i, describe(msgs))
+				}
+			}
+		})
+	}
+}
+
+// 重新生成和编辑都在树上挂兄弟节点：旧版本出现在 Branches 里，可以切回去，切来切去置顶状态不丢。
+func TestBranchSiblings(t *testing.T) {
+	t.Setenv("CHAT_MAX_TURNS", "100")
+	t.Setenv("CHAT_SYSTEM_PROMPT", "sys")
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := WithoutFence(context.Background())
+			id := s.NewConversationID()
+			round := func(q, a string) string {
+				_, userID, err := s.AppendUser(ctx, id, q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := s.InsertAssistant(ctx, id, userID, a); err != nil {
+					t.Fatal(err)
+				}
+				return userID
+			}
+			history := func() []string {
+				msgs, err := s.History(ctx, id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return describe(msgs)
+			}
+			expect := func(want ...string) {
+				t.Helper()
+				if got := history(); !slices.Equal(got, want) {
+					t.Fatalf("history = %q, want %q", got, want)
+				}
+			}
+
+			u0 := round("q0", "a0")
+			if _, err := s.PinMessage(ctx, id, u0, true); err != nil {
+				t.Fatal(err)
+			}
+			u1 := round("q1", "a1")
+
+			// 重新生成：旧回复成为分支，ID 就是旧回复的 ID
+			old, err := s.ReplaceReply(ctx, id, u1, []Message{{Role: "assistant", Content: "b1"}})
+			if err != nil || old == nil {
+				t.Fatalf("ReplaceReply = %v, %v", old, err)
+			}
+			if old.ParentID != u1 || !slices.Equal(describe(old.Messages), []string{"assistant:a1"}) {
+				t.Fatalf("replaced branch = %+v", old)
+			}
+			expect("system:sys", "user:q0 [pinned]", "assistant:a0", "user:q1", "assistant:b1")
+
+			// 编辑第一条 user：原来整条路径成为分支
+			_, e0, edited, err := s.EditUser(ctx, id, u0, "e0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if edited.ID != u0 || len(edited.Messages) != 4 {
+				t.Fatalf("edited branch = %q", describe(edited.Messages))
+			}
+			if err := s.InsertAssistant(ctx, id, e0, "f0"); err != nil {
+				t.Fatal(err)
+			}
+			expect("system:sys", "user:e0", "assistant:f0")
+
+			branches, err := s.Branches(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 分支里面的分叉（q1 下面的 a1 / b1）也各算一个
+			var heads []string
+			for _, b := range branches {
+				heads = append(heads, describe(b.Messages[:1])[0])
+			}
+			if want := []string{"user:q0 [pinned]", "assistant:a1", "assistant:b1"}; !slices.Equal(heads, want) || branches[0].ID != u0 {
+				t.Fatalf("branches start with %q, want %q", heads, want)
+			}
+
+			// 切回原来的 user：走到它下面最新的叶子（b1），置顶还在
+			back, err := s.SwitchBranch(ctx, id, u0)
+			if err != nil || back == nil || back.ID != e0 {
+				t.Fatalf("SwitchBranch(u0) = %+v, %v", back, err)
+			}
+			expect("system:sys", "user:q0 [pinned]", "assistant:a0", "user:q1", "assistant:b1")
+			if _, err := s.SwitchBranch(ctx, id, old.ID); err != nil {
+				t.Fatal(err)
+			}
+			expect("system:sys", "user:q0 [pinned]", "assistant:a0", "user:q1", "assistant:a1")
+
+			// 已经在路径上：什么都不做
+			if b, err := s.SwitchBranch(ctx, id, u1); err != nil || b != nil {
+				t.Fatalf("SwitchBranch(on path) = %+v, %v", b, err)
+			}
+			if _, err := s.SwitchBranch(ctx, id, "missing"); !errors.Is(err, ErrBranchNotFound) {
+				t.Fatalf("SwitchBranch(missing) = %v", err)
+			}
+			round("q2", "a2")
+			expect("system:sys", "user:q0 [pinned]", "assistant:a0", "user:q1", "assistant:a1", "user:q2", "assistant:a2")
+		})
+	}
+}
+
+// 分叉点被裁剪掉之后分支仍然可以切回去：Redis / 内存把分支改挂到保留下来的祖先上，SQLite 本来就不删。
+func TestBranchAfterForkPointPruned(t *testing.T) {
+	t.Setenv("CHAT_MAX_TURNS", "1")
+	t.Setenv("CHAT_PRUNE_POLICY", PolicyTurns)
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := WithoutFence(context.Background())
+			id := s.NewConversationID()
+			_, u0, err := s.AppendUser(ctx, id, "q0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.InsertAssistant(ctx, id, u0, "a0"); err != nil {
+				t.Fatal(err)
+			}
+			old, err := s.ReplaceReply(ctx, id, u0, []Message{{Role: "assistant", Content: "b0"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, u1, err := s.AppendUser(ctx, id, "q1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.InsertAssistant(ctx, id, u1, "a1"); err != nil {
+				t.Fatal(err)
+			}
+			msgs, err := s.Load(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := describe(msgs[1:]); !slices.Equal(got, []string{"user:q1", "assistant:a1"}) {
+				t.Fatalf("window = %q", got)
+			}
+
+			if _, err := s.SwitchBranch(ctx, id, old.ID); err != nil {
+				t.Fatal(err)
+			}
+			history, err := s.History(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if last := history[len(history)-1]; last.ID != old.ID || last.Content != "a0" {
+				t.Fatalf("history after switch = %q", describe(history))
+			}
+		})
+	}
+}
+
+// IfEmpty 的修改只在会话还没有消息时生效，之后返回 ErrConflict，元数据和 system 消息都不变。
+func TestUpdateConversationIfEmpty(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := WithoutFence(context.Background())
+			if _, err := s.EnsureConversation(ctx, Conversation{ID: "c1", Model: "m0"}); err != nil {
+				t.Fatal(err)
+			}
+			persona, model, prompt := "coder", "m1", "You write Go."
+			c, err := s.UpdateConversation(ctx, "c1", ConversationPatch{Persona: &persona, Model: &model, SystemPrompt: &prompt, IfEmpty: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Persona != persona || c.Model != model || c.SystemPrompt != prompt {
+				t.Fatalf("after update: %+v", c)
+			}
+
+			if _, _, err := s.AppendUser(ctx, "c1", "q0"); err != nil {
+				t.Fatal(err)
+			}
+			other := "You write Rust."
+			if _, err := s.UpdateConversation(ctx, "c1", ConversationPatch{SystemPrompt: &other, IfEmpty: true}); !errors.Is(err, ErrConflict) {
+				t.Fatalf("update after the first message: err = %v, want ErrConflict", err)
+			}
+			c, err = s.GetConversation(ctx, "c1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs, err := s.History(ctx, "c1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.SystemPrompt != prompt || msgs[0].Content != prompt {
+				t.Fatalf("conflicting update changed the prompt: meta %q, root %q", c.SystemPrompt, msgs[0].Content)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package session
+
+import (
+	"os"
+	"strings"
+)
+
+// 滚动摘要（summarize 策略）：
+// 裁剪掉的消息先进入会话的待摘要队列，由调用方在锁外异步调用 LLM 压缩成一段摘要，
+// 通过 SaveSummary 写回元数据；之后 Load / AppendUser 返回的快照会把摘要作为第二条 system 消息
+// 紧跟在 system prompt 后面，并从 token 预算里扣掉摘要占用的部分。
+
+const summaryHeader = "以下是本次对话更早部分的摘要，供你参考：\n"
+
+// summaryEnabled：CHAT_SUMMARIZE=true 时默认策略为 summarize（兼容旧配置，优先级低于 CHAT_PRUNE_POLICY）。
+func summaryEnabled() bool {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("CHAT_SUMMARIZE"))) {
+	case "1", "true", "on", "yes":
+		return true
+	}
+	return false
+}
+
+// Summarizes 报告名为 policy 的策略（空串为默认策略）是否需要生成滚动摘要。
+func Summarizes(policy string) bool {
+	_, ok := PolicyFor(policy).(SummarizeAndDrop)
+	return ok
+}
+
+func summaryMessage(summary string) Message {
+	return Message{Role: "system", Content: summaryHeader + summary}
+}
+
+// withSummary 返回扣掉摘要占用后的预算。
+func (b Budget) withSummary(summary string) Budget {
+	if summary != "" {
+		b.Fixed += b.Count(summaryMessage(summary))
+	}
+	return b
+}
+
+// injectSummary 把摘要插到快照的 system prompt 后面（返回新切片，不改 msgs）。
+func injectSummary(msgs []Message, summary string) []Message {
+	if summary == "" {
+		return msgs
+	}
+	at := 0
+	if len(msgs) > 0 && msgs[0].Role == "system" {
+		at = 1
+	}
+	out := make([]Message, 0, len(msgs)+1)
+	out = append(out, msgs[:at]...)
+	out = append(out, summaryMessage(summary))
+	out = append(out, msgs[at:]...)
+	return out
+}
+
+// pruneConfig 是某个会话当前的裁剪配置，由元数据里的 model / prune_policy / summary 决定。
+type pruneConfig struct {
+	policy  PrunePolicy
+	budget  Budget // 已扣掉摘要
+	summary string
+}
+
+func newPruneConfig(model, policy, summary string) pruneConfig {
+	return pruneConfig{
+		policy:  PolicyFor(policy),
+		budget:  BudgetFor(model).withSummary(summary),
+		summary: summary,
+	}
+}
+
+func (c pruneConfig) plan(msgs []Message) PrunePlan {
+	return c.policy.Plan(msgs, c.budget)
+}
+
+// writeConfig 是写入时要用的会话元数据。
+type writeConfig struct {
+	pruneConfig
+	prompt string // 会话自己的 system prompt，为空表示默认
+	owner  string // 决定写入时刷新哪个 owner 的会话索引（Redis）
+}
+
+// snapshot 返回送给模型的上下文：按策略裁剪后带上摘要。
+func (c pruneConfig) snapshot(msgs []Message) []Message {
+	return injectSummary(c.plan(msgs).Apply(msgs), c.summary)
+}
@@ -2,128 +2,132 @@ package session
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
-
-	"github.com/google/uuid"
 )
 
 var ErrUserPruned = errors.New("user message pruned before assistant insertion")
 
+// errNoWrite 让 treeWrite 声明这次什么都不用写（比如回复已经插过了）。
+var errNoWrite = errors.New("nothing to write")
+
+// treeWrite 在后端的写事务里改写会话的消息树 t，返回新增的 user/assistant 消息数；
+// 返回 errNoWrite 时后端不写入，照常返回快照。
+type treeWrite func(t *tree, cfg writeConfig) (added int, err error)
+
+// treeStore 是三个后端共用的写入入口：write 在后端自己的事务里（内存的锁、SQLite 的事务、Redis 的 WATCH/MULTI）
+// 读出整棵树交给 fn 改写、写回改动，返回写入后的上下文快照（已裁剪，有摘要时带上摘要）。
+// 下面的两阶段写入和分支操作都只依赖它，所以三个后端的语义是同一份实现。
+type treeStore interface {
+	GetConversation(ctx context.Context, id string) (*Conversation, error)
+	write(ctx context.Context, id string, fn treeWrite) ([]Message, error)
+}
+
 // Phase 1: 原子追加 user（很快）
 // 返回：追加后快照 + 本次 user 的 msgID
-func (s *Store) AppendUser(ctx context.Context, convID string, userContent string) ([]Message, string, error) {
-	key := s.key(convID)
-	userID := uuid.NewString()
-
-	cur, err := s.loadMessages(ctx, key)
+func appendUserTo(ctx context.Context, s treeStore, convID, content string) ([]Message, string, error) {
+	var userID string
+	snap, err := s.write(ctx, convID, func(t *tree, cfg writeConfig) (int, error) {
+		userID = t.appendUser(cfg.prompt, content).ID
+		return 1, nil
+	})
 	if err != nil {
 		return nil, "", err
 	}
+	return snap, userID, nil
+}
 
-	history := cur
-	if len(history) == 0 {
-		history = append(history, Message{
-			Role:    "system",
-			Content: s.systemPrompt(),
-		})
-	}
-
-	history = append(history, Message{
-		ID:      userID,
-		Role:    "user",
-		Content: userContent,
+// Phase 2: 把一组回复挂回 “对应 user 下面”
+// 并发下即使有其他 user 已经追加，也能按 userID 找到它，回复在路径上紧跟着它（见 tree.insertReply）。
+// 按 userID 幂等：已经有回复时什么都不做。
+func insertReplyTo(ctx context.Context, s treeStore, convID, userID string, reply []Message) error {
+	_, err := s.write(ctx, convID, func(t *tree, _ writeConfig) (int, error) {
+		return len(reply), t.insertReply(userID, reply)
 	})
+	return err
+}
 
-	pruned := Prune(history)
-	snap := append([]Message(nil), pruned...)
-
-	if len(cur) == 0 {
-		sys := history[0]
-		b, err := json.Marshal(sys)
-		if err != nil {
-			return nil, "", err
-		}
-		if err := s.rdb.RPush(ctx, key, b).Err(); err != nil {
-			return nil, "", err
-		}
+// replaceReplyIn 给 userID 再挂一组回复并切过去，返回旧回复所在的分支。
+func replaceReplyIn(ctx context.Context, s treeStore, convID, userID string, reply []Message) (*Branch, error) {
+	var prev *Branch
+	_, err := s.write(ctx, convID, func(t *tree, _ writeConfig) (int, error) {
+		b, err := t.replaceReply(userID, reply)
+		prev = b
+		return len(reply), err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return prev, nil
+}
 
-	userMsg := history[len(history)-1]
-	b, err := json.Marshal(userMsg)
+// editUserIn 给 msgID 挂一个兄弟 user 并切过去，返回快照、新 user 的 msgID 和原来的分支。
+func editUserIn(ctx context.Context, s treeStore, convID, msgID, content string) ([]Message, string, *Branch, error) {
+	var (
+		user Message
+		prev *Branch
+	)
+	snap, err := s.write(ctx, convID, func(t *tree, _ writeConfig) (int, error) {
+		var err error
+		user, prev, err = t.editUser(msgID, content)
+		return 1, err
+	})
 	if err != nil {
-		return nil, "", err
-	}
-	if err := s.rdb.RPush(ctx, key, b).Err(); err != nil {
-		return nil, "", err
+		return nil, "", nil, err
 	}
+	return snap, user.ID, prev, nil
+}
 
-	if err := s.applyPrune(ctx, key, history); err != nil {
-		return nil, "", err
+// switchBranchIn 把 head 换到 branchID 下面最新的叶子，返回换下来的分支。
+func switchBranchIn(ctx context.Context, s treeStore, convID, branchID string) (*Branch, error) {
+	if _, err := s.GetConversation(ctx, convID); err != nil {
+		return nil, err
 	}
+	var prev *Branch
+	_, err := s.write(ctx, convID, func(t *tree, _ writeConfig) (int, error) {
+		b, err := t.switchTo(branchID)
+		if err == nil && b == nil {
+			return 0, errNoWrite
+		}
+		prev = b
+		return 0, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return prev, nil
+}
 
-	return snap, userID, nil
+func (s *RedisStore) AppendUser(ctx context.Context, convID string, userContent string) ([]Message, string, error) {
+	return appendUserTo(ctx, s, convID, userContent)
 }
 
-// Phase 2: 把 assistant 插回 “对应 user 后面”
-// 并发下即使有其他 user 已经追加，也能找到 userID 并插入到它后面。
-func (s *Store) InsertAssistant(ctx context.Context, convID, userID, assistantContent string) error {
-	key := s.key(convID)
+func (s *RedisStore) InsertAssistant(ctx context.Context, convID, userID, assistantContent string) error {
+	return s.InsertReply(ctx, convID, userID, []Message{{Role: "assistant", Content: assistantContent}})
+}
 
-	cur, err := s.loadMessages(ctx, key)
-	if err != nil {
-		return err
-	}
-	if len(cur) == 0 {
-		return ErrUserPruned
-	}
+func (s *RedisStore) InsertReply(ctx context.Context, convID, userID string, reply []Message) error {
+	return insertReplyTo(ctx, s, convID, userID, reply)
+}
 
-	userIdx := -1
-	for i := range cur {
-		if cur[i].Role == "user" && cur[i].ID == userID {
-			userIdx = i
-			break
-		}
-	}
-	if userIdx == -1 {
-		return ErrUserPruned
-	}
+func (s *RedisStore) ReplaceReply(ctx context.Context, convID, userID string, reply []Message) (*Branch, error) {
+	return replaceReplyIn(ctx, s, convID, userID, reply)
+}
 
-	for i := range cur {
-		if cur[i].Role == "assistant" && cur[i].ParentID == userID {
-			return nil
-		}
-	}
+func (s *RedisStore) EditUser(ctx context.Context, convID, msgID, content string) ([]Message, string, *Branch, error) {
+	return editUserIn(ctx, s, convID, msgID, content)
+}
 
-	assist := Message{
-		ID:       uuid.NewString(),
-		ParentID: userID,
-		Role:     "assistant",
-		Content:  assistantContent,
-	}
-	assistJSON, err := json.Marshal(assist)
-	if err != nil {
-		return err
-	}
+func (s *RedisStore) SwitchBranch(ctx context.Context, convID, branchID string) (*Branch, error) {
+	return switchBranchIn(ctx, s, convID, branchID)
+}
 
-	userJSON, err := json.Marshal(cur[userIdx])
-	if err != nil {
-		return err
+func (s *RedisStore) Branches(ctx context.Context, convID string) ([]Branch, error) {
+	if _, err := s.GetConversation(ctx, convID); err != nil {
+		return nil, err
 	}
-
-	res, err := s.rdb.LInsert(ctx, key, "AFTER", userJSON, assistJSON).Result()
+	t, err := s.loadTree(ctx, s.rdb, convID)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if res == -1 {
-		return ErrUserPruned
-	}
-
-	next := make([]Message, 0, len(cur)+1)
-	next = append(next, cur[:userIdx+1]...)
-	next = append(next, assist)
-	next = append(next, cur[userIdx+1:]...)
-	next = Prune(next)
-
-	return s.applyPrune(ctx, key, next)
+	return t.branches(), nil
 }
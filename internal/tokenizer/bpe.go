@@ -0,0 +1,58 @@
+package tokenizer
+
+import (
+	"strings"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+func init() {
+	// 使用内嵌词表，避免运行时去 openaipublic 下载
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+// 模型名前缀 -> 编码，越长越先匹配。
+var modelEncodings = []struct{ prefix, encoding string }{
+	{"gpt-4.1", tiktoken.MODEL_O200K_BASE},
+	{"gpt-4.5", tiktoken.MODEL_O200K_BASE},
+	{"gpt-4o", tiktoken.MODEL_O200K_BASE},
+	{"gpt-5", tiktoken.MODEL_O200K_BASE},
+	{"o1", tiktoken.MODEL_O200K_BASE},
+	{"o3", tiktoken.MODEL_O200K_BASE},
+	{"o4", tiktoken.MODEL_O200K_BASE},
+	{"gpt-4", tiktoken.MODEL_CL100K_BASE},
+	{"gpt-3.5", tiktoken.MODEL_CL100K_BASE},
+}
+
+func encodingForModel(model string) string {
+	model = strings.ToLower(model)
+	for _, m := range modelEncodings {
+		if strings.HasPrefix(model, m.prefix) {
+			return m.encoding
+		}
+	}
+	return Heuristic
+}
+
+type bpe struct {
+	name string
+	enc  *tiktoken.Tiktoken
+}
+
+func newBPE(encoding string) (*bpe, error) {
+	enc, err := tiktoken.GetEncoding(encoding)
+	if err != nil {
+		return nil, err
+	}
+	return &bpe{name: encoding, enc: enc}, nil
+}
+
+func (b *bpe) Name() string { return b.name }
+
+func (b *bpe) Count(text string) int {
+	if text == "" {
+		return 0
+	}
+	return len(b.enc.EncodeOrdinary(text))
+}
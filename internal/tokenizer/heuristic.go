@@ -0,0 +1,26 @@
+package tokenizer
+
+import "unicode"
+
+// heuristic 按字符类别估算：CJK 字符大约 1 字 1 token，
+// 其他文字（英文、代码、标点）大约 4 个字符 1 token。
+// 宁可略微高估，裁剪时留出的余量比超窗报错划算。
+type heuristic struct{}
+
+func (heuristic) Name() string { return Heuristic }
+
+func (heuristic) Count(text string) int {
+	cjk, other := 0, 0
+	for _, r := range text {
+		switch {
+		case unicode.Is(unicode.Han, r),
+			unicode.Is(unicode.Hiragana, r),
+			unicode.Is(unicode.Katakana, r),
+			unicode.Is(unicode.Hangul, r):
+			cjk++
+		default:
+			other++
+		}
+	}
+	return cjk + (other+3)/4
+}
@@ -0,0 +1,54 @@
+// Package tokenizer 估算文本的 token 数，用于按模型上下文窗口裁剪会话。
+//
+// OpenAI 系列模型走真实的 BPE 编码（cl100k_base / o200k_base，词表随二进制内嵌，不联网），
+// 其他模型（DeepSeek、Qwen、本地模型等）词表各不相同，默认用按字符类别估算的启发式实现。
+package tokenizer
+
+import (
+	"os"
+	"strings"
+	"sync"
+)
+
+// Tokenizer 计算一段文本的 token 数。
+type Tokenizer interface {
+	Name() string
+	Count(text string) int
+}
+
+// Heuristic 是不依赖词表的估算器名称。
+const Heuristic = "heuristic"
+
+var (
+	cacheMu sync.Mutex
+	cache   = map[string]Tokenizer{}
+)
+
+// Get 按编码名取 tokenizer（cl100k_base / o200k_base / heuristic），
+// 未知编码或词表加载失败时退回启发式实现。
+func Get(encoding string) Tokenizer {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	if encoding == "" || encoding == Heuristic {
+		return heuristic{}
+	}
+
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	if t, ok := cache[encoding]; ok {
+		return t
+	}
+	t, err := newBPE(encoding)
+	if err != nil {
+		return heuristic{}
+	}
+	cache[encoding] = t
+	return t
+}
+
+// ForModel 为模型选择 tokenizer：CHAT_TOKENIZER 优先，其次按模型名匹配 OpenAI 编码，否则用启发式。
+func ForModel(model string) Tokenizer {
+	if enc := os.Getenv("CHAT_TOKENIZER"); enc != "" {
+		return Get(enc)
+	}
+	return Get(encodingForModel(model))
+}
@@ -0,0 +1,53 @@
+package tokenizer
+
+import "testing"
+
+func TestCount(t *testing.T) {
+	cases := []struct {
+		encoding, text string
+		want           int
+	}{
+		{Heuristic, "", 0},
+		{Heuristic, "abcd", 1},
+		{Heuristic, "abcde", 2},
+		{Heuristic, "你好世界", 4},
+		{Heuristic, "你好 abc", 3},
+		{"cl100k_base", "", 0},
+		{"cl100k_base", "hello world", 2},
+		{"cl100k_base", "你好，世界", 6},
+		{"o200k_base", "hello world", 2},
+		{"o200k_base", "你好，世界", 3},
+	}
+	for _, c := range cases {
+		if got := Get(c.encoding).Count(c.text); got != c.want {
+			t.Errorf("%s: Count(%q) = %d, want %d", c.encoding, c.text, got, c.want)
+		}
+	}
+}
+
+func TestForModel(t *testing.T) {
+	cases := map[string]string{
+		"gpt-4o-mini":   "o200k_base",
+		"gpt-4.1":       "o200k_base",
+		"o3-mini":       "o200k_base",
+		"gpt-4-turbo":   "cl100k_base",
+		"GPT-3.5-Turbo": "cl100k_base",
+		"deepseek-chat": Heuristic,
+		"qwen2.5:7b":    Heuristic,
+		"":              Heuristic,
+	}
+	for model, want := range cases {
+		if got := ForModel(model).Name(); got != want {
+			t.Errorf("ForModel(%q) = %s, want %s", model, got, want)
+		}
+	}
+
+	t.Setenv("CHAT_TOKENIZER", "cl100k_base")
+	if got := ForModel("deepseek-chat").Name(); got != "cl100k_base" {
+		t.Errorf("CHAT_TOKENIZER override: got %s", got)
+	}
+	t.Setenv("CHAT_TOKENIZER", "bogus")
+	if got := ForModel("gpt-4o").Name(); got != Heuristic {
+		t.Errorf("unknown CHAT_TOKENIZER: got %s, want fallback to %s", got, Heuristic)
+	}
+}
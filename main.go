@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"net/http"
 	"os"
 
 	"github.com/JekYUlll/eino-mini/internal/httpapi"
 	"github.com/JekYUlll/eino-mini/internal/llm"
+	"github.com/JekYUlll/eino-mini/internal/mcp"
+	"github.com/JekYUlll/eino-mini/internal/persona"
 	"github.com/JekYUlll/eino-mini/internal/session"
 	"github.com/joho/godotenv"
 )
@@ -30,9 +33,40 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "mcp" {
+		runMCP(llmClient, store, os.Args[2:])
+		return
+	}
+
+	tools, err := llm.DefaultTools()
+	if err != nil {
+		log.Fatal(err)
+	}
+	mcpCfg, err := mcp.LoadConfig("")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mcpClient, err := mcp.Connect(context.Background(), mcpCfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer mcpClient.Close()
+	tools = append(tools, mcpClient.Tools()...)
+	agent, err := llm.NewAgent(context.Background(), llmClient, tools)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	personas, err := persona.Load("")
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	s := &httpapi.Server{
-		LLM:   llmClient,
-		Store: store,
+		LLM:      llmClient,
+		Store:    store,
+		Agent:    agent,
+		Personas: personas,
 	}
 	mux := http.NewServeMux()
 	s.Register(mux)
@@ -40,3 +74,24 @@ func main() {
 	log.Println("listening on : " + port)
 	log.Fatal(http.ListenAndServe(":"+port, mux))
 }
+
+// runMCP 是 `eino-mini mcp` 子命令：把会话记忆作为 MCP server 提供给其他 agent。
+// 默认走 stdio（日志写 stderr，不污染协议流）；-http 给出地址时改为 streamable HTTP，挂在 /mcp。
+func runMCP(llmClient llm.Provider, store session.Store, args []string) {
+	fs := flag.NewFlagSet("mcp", flag.ExitOnError)
+	addr := fs.String("http", "", "listen address for streamable HTTP, e.g. :8081 (default: stdio)")
+	owner := fs.String("owner", os.Getenv("MCP_OWNER"), "conversation owner for stdio mode")
+	_ = fs.Parse(args)
+
+	srv := &mcp.Server{LLM: llmClient, Store: store}
+	if *addr == "" {
+		if err := srv.ServeStdio(context.Background(), *owner); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/mcp", srv.Handler())
+	log.Println("mcp listening on " + *addr + "/mcp")
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}